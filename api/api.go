@@ -1,6 +1,8 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
@@ -24,6 +26,31 @@ func ApiServe(r *mux.Router) {
 	// Get analytics
 	r.HandleFunc("/tanks/{tankID}/analytics", handleCORS(getAnalytics)).Methods("GET")
 
+	// Get the night-time flow analysis and leak history of a tank
+	r.HandleFunc("/tanks/{tankID}/leaks", handleCORS(GetLeakHandler)).Methods("GET")
+
+	// Get the consumption and level of a tank per hour, day, week or month
+	r.HandleFunc("/tanks/{tankID}/rollups", handleCORS(GetRollupsHandler)).Methods("GET")
+
+	// Get the daily water cost of a tank for a month
+	r.HandleFunc("/tanks/{tankID}/costs", handleCORS(GetCostsHandler)).Methods("GET")
+
+	// Delivery log of a tank, detected truck refills reconciled with the invoices
+	r.HandleFunc("/tanks/{tankID}/deliveries", handleCORS(GetDeliveriesHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/deliveries", handleCORS(PostDeliveryHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/deliveries/export", handleCORS(ExportDeliveriesHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/deliveries/{deliveryID}", handleCORS(UpdateDeliveryHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/deliveries/{deliveryID}", handleCORS(DeleteDeliveryHandler)).Methods("DELETE")
+
+	// Get the per-person usage and daily quota of a tank
+	r.HandleFunc("/tanks/{tankID}/household", handleCORS(GetHouseholdHandler)).Methods("GET")
+
+	// Daily outflow of the flow meter of a tank reconciled with its level
+	r.HandleFunc("/tanks/{tankID}/flow", handleCORS(GetFlowHandler)).Methods("GET")
+
+	// Get the consumption, refill and idle periods of a tank
+	r.HandleFunc("/tanks/{tankID}/events", handleCORS(GetTankEventsHandler)).Methods("GET")
+
 	// Internet & services
 	// r.HandleFunc("/internet", handleCORS(getWifiStatus)).Methods("GET")
 
@@ -33,6 +60,27 @@ func ApiServe(r *mux.Router) {
 	// Endpoint to get tanks under majiup
 	r.HandleFunc("/tanks", handleCORS(TankHandler)).Methods("GET")
 
+	// Get the state of every tank with fleet totals, sortable and filterable by status
+	r.HandleFunc("/summary", handleCORS(GetSummaryHandler)).Methods("GET")
+
+	// Tank groups, a group is exposed as a virtual tank aggregating its members
+	r.HandleFunc("/groups", handleCORS(GetGroupsHandler)).Methods("GET")
+	r.HandleFunc("/groups", handleCORS(PostGroupHandler)).Methods("POST")
+	r.HandleFunc("/groups/{groupID}", handleCORS(GetGroupHandler)).Methods("GET")
+	r.HandleFunc("/groups/{groupID}", handleCORS(UpdateGroupHandler)).Methods("POST")
+	r.HandleFunc("/groups/{groupID}", handleCORS(DeleteGroupHandler)).Methods("DELETE")
+	r.HandleFunc("/groups/{groupID}/analytics", handleCORS(GetGroupAnalyticsHandler)).Methods("GET")
+
+	// Water quality profiles, the TDS bands used to classify the water of a tank
+	r.HandleFunc("/quality-profiles", handleCORS(GetQualityProfilesHandler)).Methods("GET")
+	r.HandleFunc("/quality-profiles", handleCORS(PostQualityProfileHandler)).Methods("POST")
+	r.HandleFunc("/quality-profiles/{profileID}", handleCORS(PostQualityProfileHandler)).Methods("POST")
+	r.HandleFunc("/quality-profiles/{profileID}", handleCORS(DeleteQualityProfileHandler)).Methods("DELETE")
+
+	// Water quality parameters and the composite water quality index of a tank
+	r.HandleFunc("/quality-parameters", handleCORS(GetQualityParametersHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/water-quality-index", handleCORS(GetQualityIndexHandler)).Methods("GET")
+
 	// Endpoint to get actuators under majiup
 	//: TODO
 	// r.HandleFunc("/actuators", handleCORS(TankHandler)).Methods("GET")
@@ -63,47 +111,92 @@ func ApiServe(r *mux.Router) {
 	// POST Meta fields
 	r.HandleFunc("/tanks/{tankID}/profile", handleCORS(postMetaField)).Methods("POST")
 
+	/*-----------------------------SENSOR ENDPOINTS--------------------------------*/
+
+	// Registered sensor kinds with their units and alert semantics
+	r.HandleFunc("/sensor-kinds", handleCORS(GetSensorKindsHandler)).Methods("GET")
+
+	// Sensors of a tank by kind, slug or sensor ID, the per-kind routes below are aliases of these
+	r.HandleFunc("/tanks/{tankID}/sensors/{kindOrID}", handleCORS(GetKindSensorsHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/sensors/{kindOrID}/value", handleCORS(GetKindValueHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/sensors/{kindOrID}/values", handleCORS(GetKindValuesHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/sensors/{kindOrID}/alerts", handleCORS(PostKindAlertsHandler)).Methods("POST")
+
+	// Virtual sensors computed from expressions over the sensors and settings of a tank
+	r.HandleFunc("/tanks/{tankID}/virtual-sensors", handleCORS(GetVirtualSensorsHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/virtual-sensors", handleCORS(PostVirtualSensorHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/virtual-sensors/evaluate", handleCORS(EvaluateExpressionHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/virtual-sensors/{key}", handleCORS(UpdateVirtualSensorHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/virtual-sensors/{key}", handleCORS(DeleteVirtualSensorHandler)).Methods("DELETE")
+
+	// Level readings before and after temperature compensation
+	r.HandleFunc("/tanks/{tankID}/compensation", handleCORS(GetCompensationHandler)).Methods("GET")
+
+	// Redundant level sensors of a tank and the level fused from them
+	r.HandleFunc("/tanks/{tankID}/level-sensors", handleCORS(GetLevelSensorsHandler)).Methods("GET")
+
+	// Data quality of the sensors of a tank
+	r.HandleFunc("/tanks/{tankID}/diagnostics", handleCORS(GetDiagnosticsHandler)).Methods("GET")
+
+	// Freeze, Legionella and livestock heat stress risks from the water temperature
+	r.HandleFunc("/tanks/{tankID}/temperature-safety", handleCORS(GetTemperatureSafetyHandler)).Methods("GET")
+
+	// Cleaning, disinfection and inspection tasks of a tank with their completion records
+	r.HandleFunc("/tanks/{tankID}/maintenance-tasks", handleCORS(GetMaintenanceTasksHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/maintenance-tasks", handleCORS(PostMaintenanceTaskHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/maintenance-tasks/attachments/{attachmentID}", handleCORS(GetMaintenanceAttachmentHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/maintenance-tasks/{taskID}", handleCORS(UpdateMaintenanceTaskHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/maintenance-tasks/{taskID}", handleCORS(DeleteMaintenanceTaskHandler)).Methods("DELETE")
+	r.HandleFunc("/tanks/{tankID}/maintenance-tasks/{taskID}/complete", handleCORS(CompleteMaintenanceTaskHandler)).Methods("POST")
+
+	// Chlorine dosing after refills and the dosing log for compliance reports
+	r.HandleFunc("/tanks/{tankID}/dosing", handleCORS(GetDosingLogHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/dosing", handleCORS(PostDosingHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/dosing/calculate", handleCORS(CalculateDoseHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/dosing/export", handleCORS(ExportDosingLogHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/dosing/{recordID}/confirm", handleCORS(ConfirmDosingHandler)).Methods("POST")
+
 	/*-----------------------------WATER LEVEL SENSOR ENDPOINTS--------------------------------*/
 
 	// Endpoint to get the water level sensor data from a specific tank
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel", handleCORS(WaterLevelSensorHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel", handleCORS(sensorKindRoute("waterlevel", GetKindSensorsHandler))).Methods("GET")
 
 	// Endpoint to get the water level value
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel/value", handleCORS(GetWaterLevelValueHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel/value", handleCORS(sensorKindRoute("waterlevel", GetWaterLevelValueHandler))).Methods("GET")
 
 	// Endpoint to get the water level history values
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel/values", handleCORS(GetWaterLevelHistoryHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel/values", handleCORS(sensorKindRoute("waterlevel", GetWaterLevelHistoryHandler))).Methods("GET")
 
 	// Endpoint to change the waterlevel meta field
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel/alerts", handleCORS(ChangeWaterLevelAlerts)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/waterlevel/alerts", handleCORS(sensorKindRoute("waterlevel", PostKindAlertsHandler))).Methods("POST")
 
 	/*-----------------------------WATER TEMPERATURE SENSOR ENDPOINTS---------------------------*/
 
 	// Endpoint to get the water temperature sensor data from a specific tank
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature", handleCORS(WaterTemperatureSensorHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature", handleCORS(sensorKindRoute("water-temperature", GetKindSensorsHandler))).Methods("GET")
 
 	// Endpoint to get the water temperature value from a specific tank
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature/value", handleCORS(GetWaterTemperatureValueHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature/value", handleCORS(sensorKindRoute("water-temperature", GetWaterTemperatureValueHandler))).Methods("GET")
 
 	// Endpoint to get the water temperature history values data from a specific tank
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature/values", handleCORS(GetWaterTemperatureHistoryHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature/values", handleCORS(sensorKindRoute("water-temperature", GetWaterTemperatureHistoryHandler))).Methods("GET")
 
 	// Endpoint to change the water temp level
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature/alerts", handleCORS(ChangeWaterTemperatureAlerts)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-temperature/alerts", handleCORS(sensorKindRoute("water-temperature", PostKindAlertsHandler))).Methods("POST")
 
 	/*-----------------------------WATER QUALITY SENSOR ENDPOINTS---------------------------*/
 
 	// Endpoint to get the water quality sensor data from a specific tank
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality", handleCORS(WaterQualitySensorHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality", handleCORS(sensorKindRoute("water-quality", GetKindSensorsHandler))).Methods("GET")
 
 	// Endpoint to get the water quality sensor data from a specific tank
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality/value", handleCORS(GetWaterQualityValueHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality/value", handleCORS(sensorKindRoute("water-quality", GetWaterQualityValueHandler))).Methods("GET")
 
 	// Endpoint to get the water quality history values from a specific tank
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality/values", handleCORS(GetWaterQualityHistoryHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality/values", handleCORS(sensorKindRoute("water-quality", GetWaterQualityHistoryHandler))).Methods("GET")
 
 	// Endpoint to change water quality alerts
-	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality/alerts", handleCORS(ChangeWaterQualityAlerts)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/tank-sensors/water-quality/alerts", handleCORS(sensorKindRoute("water-quality", PostKindAlertsHandler))).Methods("POST")
 
 	/*---------------------------------ACTUATOR ENDPOINTS - v1.0 FOR ACTUATOR ON SAME DEVICE AS TANK-------------------------------------------*/
 
@@ -116,6 +209,22 @@ func ApiServe(r *mux.Router) {
 	// Endpoint to post actuator state
 	r.HandleFunc("/tanks/{tankID}/actuators/state", handleCORS(TankStatePostHandler)).Methods("POST")
 
+	// Endpoints to enable and disable the maintenance mode of a tank
+	r.HandleFunc("/tanks/{tankID}/maintenance-mode", handleCORS(GetMaintenanceModeHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/maintenance-mode", handleCORS(PostMaintenanceModeHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/maintenance-mode", handleCORS(DeleteMaintenanceModeHandler)).Methods("DELETE")
+
+	// Endpoint to get the run hours, starts and liters pumped of the tank pumps
+	r.HandleFunc("/tanks/{tankID}/actuators/runtime", handleCORS(GetPumpRuntimeHandler)).Methods("GET")
+
+	// Endpoints to manage pump maintenance schedules
+	r.HandleFunc("/tanks/{tankID}/actuators/maintenance", handleCORS(GetPumpMaintenanceHandler)).Methods("GET")
+	r.HandleFunc("/tanks/{tankID}/actuators/maintenance", handleCORS(PostPumpMaintenanceHandler)).Methods("POST")
+	r.HandleFunc("/tanks/{tankID}/actuators/maintenance/{scheduleID}", handleCORS(DeletePumpMaintenanceHandler)).Methods("DELETE")
+
+	// Endpoint to acknowledge a pump service
+	r.HandleFunc("/tanks/{tankID}/actuators/maintenance/{scheduleID}/ack", handleCORS(AckPumpMaintenanceHandler)).Methods("POST")
+
 
 	/*---------------------------------ACTUATOR ENDPOINTS - v1.1 FOR ACTUATOR ON DIFFERENT DEVICE AS TANK-------------------------------------------*/
 	// replace tankID with actuator device's ID
@@ -152,4 +261,17 @@ func handleCORS(h http.HandlerFunc) http.HandlerFunc {
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		h(w, r)
 	}
-}
\ No newline at end of file
+}
+
+// writeJSON marshals v and writes it as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Error marshaling response:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
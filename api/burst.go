@@ -0,0 +1,146 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Minutes of readings used to measure the rate of change
+const defaultBurstWindowMinutes = 15
+
+// Drop rate (liters per minute) treated as a burst when no threshold is configured
+const defaultBurstDropRate = 20.0
+
+// BurstSettings configures the rapid drop detection of a tank,
+// a drop faster than either threshold fires a critical alert
+type BurstSettings struct {
+	MaxDropRate      float64 `json:"maxDropRate" bson:"maxDropRate"`
+	MaxDropPercent   float64 `json:"maxDropPercent" bson:"maxDropPercent"`
+	WindowMinutes    float64 `json:"windowMinutes" bson:"windowMinutes"`
+	AutoCloseValve   bool    `json:"autoCloseValve" bson:"autoCloseValve"`
+	ValveDeviceID    string  `json:"valveDeviceID" bson:"valveDeviceID"`
+	ValveActuatorID  string  `json:"valveActuatorID" bson:"valveActuatorID"`
+	ValveClosedValue float64 `json:"valveClosedValue" bson:"valveClosedValue"`
+	Disabled         bool    `json:"disabled" bson:"disabled"`
+}
+
+// Tanks for which a burst has been reported and the level is still dropping
+var burstNotified = make(map[string]bool)
+var burstNotifiedLock sync.Mutex
+
+// Time of the level reading the burst check last ran for, by tank. The tank publishes every
+// sensor, the drop rate only changes with a new level reading.
+var burstCheckedReading = make(map[string]time.Time)
+
+// getDropRate returns how fast the level dropped over the window, in liters per minute
+func getDropRate(levels []WaterLevel, window time.Duration) float64 {
+	if len(levels) < 2 {
+		return 0
+	}
+
+	// Only the readings since the last maintenance period are compared
+	segments := splitAtGaps(levels)
+	levels = segments[len(segments)-1]
+
+	latest := *levels[len(levels)-1].Timestamp
+	var recent []WaterLevel
+	for _, entry := range levels {
+		if latest.Sub(*entry.Timestamp) <= window {
+			recent = append(recent, entry)
+		}
+	}
+	if len(recent) < 2 {
+		return 0
+	}
+
+	return -slopePerHour(recent) / 60
+}
+
+// findValve returns the valve actuator linked to the tank for automatic shut off
+func findValve(tank Tank, settings BurstSettings) (string, string, bool) {
+	if settings.ValveActuatorID != "" {
+		deviceID := settings.ValveDeviceID
+		if deviceID == "" {
+			deviceID = tank.ID
+		}
+		return deviceID, settings.ValveActuatorID, true
+	}
+
+	for _, actuator := range tank.Actuators {
+		if actuator.ActuatorMeta.Kind == "Valve" {
+			return tank.ID, actuator.ID, true
+		}
+	}
+	return "", "", false
+}
+
+// checkBurst fires a critical alert when the level drops faster than a burst pipe threshold
+func checkBurst(tank Tank) {
+	settings := tank.Meta.BurstSettings
+	if settings.Disabled || tank.Meta.Settings.Capacity <= 0 {
+		return
+	}
+
+	sensor, ok := levelSensor(tank)
+	if !ok || sensor.Time == nil {
+		return
+	}
+	burstNotifiedLock.Lock()
+	if last, ok := burstCheckedReading[tank.ID]; ok && !sensor.Time.After(last) {
+		burstNotifiedLock.Unlock()
+		return
+	}
+	burstCheckedReading[tank.ID] = *sensor.Time
+	burstNotifiedLock.Unlock()
+
+	window := settings.WindowMinutes
+	if window <= 0 {
+		window = defaultBurstWindowMinutes
+	}
+
+	// Readings from a little before the window are needed to measure the first step
+	from := time.Now().Add(-time.Duration(window*2) * time.Minute).Format(time.RFC3339)
+	levels, err := getLevelHistory(tank, from, "")
+	if err != nil {
+		fmt.Println("Error retrieving water level history:", err)
+		return
+	}
+
+	dropRate := getDropRate(levels, time.Duration(window)*time.Minute)
+	dropPercent := dropRate / tank.Meta.Settings.Capacity * 100
+
+	maxDropRate := settings.MaxDropRate
+	if maxDropRate <= 0 && settings.MaxDropPercent <= 0 {
+		maxDropRate = defaultBurstDropRate
+	}
+
+	burst := (maxDropRate > 0 && dropRate >= maxDropRate) || (settings.MaxDropPercent > 0 && dropPercent >= settings.MaxDropPercent)
+
+	burstNotifiedLock.Lock()
+	alreadyNotified := burstNotified[tank.ID]
+	burstNotified[tank.ID] = burst
+	burstNotifiedLock.Unlock()
+
+	if !burst || alreadyNotified {
+		return
+	}
+
+	body := fmt.Sprintf("Water in %s is dropping at %d L/min (%.1f%%/min). Check for a burst pipe or a tap left open.", tank.Name, int(dropRate), dropPercent)
+
+	if settings.AutoCloseValve {
+		deviceID, actuatorID, ok := findValve(tank, settings)
+		if !ok {
+			fmt.Println("No valve linked to tank:", tank.Name)
+		} else if err := setActuatorValue(deviceID, actuatorID, settings.ValveClosedValue); err != nil {
+			fmt.Println("Error closing valve:", err)
+		} else {
+			body += " The valve has been closed automatically."
+			log.Printf("[%s] Valve closed on burst: %s", time.Now().Format(time.RFC3339), tank.Name)
+		}
+	}
+
+	title := fmt.Sprintf("%s is draining rapidly", tank.Name)
+	notifyTank(tank, title, body, PriorityCritical)
+}
@@ -0,0 +1,816 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Forms of chlorine product, liquids are dosed in milliliters and granules or tablets in grams
+const (
+	ProductLiquid   = "liquid"
+	ProductGranular = "granular"
+)
+
+// States of a dosing record
+const (
+	DosingScheduled = "scheduled"
+	DosingDone      = "dosed"
+	DosingSkipped   = "skipped"
+)
+
+// How a dose was given
+const (
+	DosingManual = "manual"
+	DosingDoser  = "doser"
+)
+
+// Free chlorine dose (mg/L) used when no target is configured
+const defaultDosingTarget = 1.0
+
+// Available chlorine (%) of household bleach, used when no product is configured
+const defaultProductPercent = 5.0
+
+// Refills smaller than this (liters) are not dosed unless configured otherwise
+const defaultMinDosingLiters = 50.0
+
+// Hours of history scanned for refills that still need a dose
+const dosingLookbackHours = 24
+
+// Dosing records kept in the tank meta
+const dosingLogSize = 500
+
+// A doser is never run longer than this in one go
+const maxDoserSeconds = 30 * 60
+
+// DosingSettings configures the chlorination of a tank after each refill. The product
+// percent is its available chlorine, by weight per volume for liquids.
+type DosingSettings struct {
+	Enabled         bool    `json:"enabled" bson:"enabled"`
+	TargetDose      float64 `json:"targetDose" bson:"targetDose"`
+	ProductName     string  `json:"productName" bson:"productName"`
+	ProductPercent  float64 `json:"productPercent" bson:"productPercent"`
+	ProductForm     string  `json:"productForm" bson:"productForm"`
+	MinRefillLiters float64 `json:"minRefillLiters" bson:"minRefillLiters"`
+	Caretaker       string  `json:"caretaker" bson:"caretaker"`
+	DoserDeviceID   string  `json:"doserDeviceID" bson:"doserDeviceID"`
+	DoserActuatorID string  `json:"doserActuatorID" bson:"doserActuatorID"`
+	DoserRate       float64 `json:"doserRate" bson:"doserRate"`
+	MaxDoseAmount   float64 `json:"maxDoseAmount" bson:"maxDoseAmount"`
+}
+
+// DoserRun is a run of the doser, stored before it is switched on so that it is switched
+// off at startup when the service stopped while it was dosing
+type DoserRun struct {
+	DeviceID   string    `json:"deviceID" bson:"deviceID"`
+	ActuatorID string    `json:"actuatorID" bson:"actuatorID"`
+	Until      time.Time `json:"until" bson:"until"`
+}
+
+// ChlorineDose is the amount of product needed to chlorinate a volume of water
+type ChlorineDose struct {
+	Liters         float64 `json:"liters" bson:"liters"`
+	TargetDose     float64 `json:"targetDose" bson:"targetDose"`
+	ChlorineGrams  float64 `json:"chlorineGrams" bson:"chlorineGrams"`
+	ProductName    string  `json:"productName" bson:"productName"`
+	ProductPercent float64 `json:"productPercent" bson:"productPercent"`
+	ProductAmount  float64 `json:"productAmount" bson:"productAmount"`
+	ProductUnit    string  `json:"productUnit" bson:"productUnit"`
+}
+
+// DosingRecord is the chlorination of a refill, kept for compliance reports
+type DosingRecord struct {
+	ID          string     `json:"id" bson:"id"`
+	RefillStart *time.Time `json:"refillStart" bson:"refillStart"`
+	RefillEnd   *time.Time `json:"refillEnd" bson:"refillEnd"`
+	Source      string     `json:"source" bson:"source"`
+	ChlorineDose
+	Status       string     `json:"status" bson:"status"`
+	Method       string     `json:"method" bson:"method"`
+	Scheduled    time.Time  `json:"scheduled" bson:"scheduled"`
+	Dosed        *time.Time `json:"dosed" bson:"dosed"`
+	DosedAmount  float64    `json:"dosedAmount" bson:"dosedAmount"`
+	DoserSeconds float64    `json:"doserSeconds" bson:"doserSeconds"`
+	By           string     `json:"by" bson:"by"`
+	Residual     *float64   `json:"residual" bson:"residual"`
+	Notes        string     `json:"notes" bson:"notes"`
+	Manual       bool       `json:"manual" bson:"manual"`
+}
+
+// Last time the refills were scanned for dosing, by tank
+var dosingCheckedAt = make(map[string]time.Time)
+var dosingCheckedAtLock sync.Mutex
+
+// Refills dosed or announced to the caretaker by tank, kept in memory so that a refill is
+// never dosed again when its record could not be stored
+var dosingAttempted = make(map[string][]DosingRecord)
+var dosingAttemptedLock sync.Mutex
+
+// The dosing logs are read again and written under this lock, so that records added while
+// a dose is confirmed are kept
+var dosingLogLock sync.Mutex
+
+var errDosingRecordNotFound = errors.New("dosing record not found")
+
+// Tanks whose doser is switched off by a timer of this process
+var doserTimers = make(map[string]bool)
+var doserTimersLock sync.Mutex
+
+func (s DosingSettings) withDefaults() DosingSettings {
+	if s.TargetDose <= 0 {
+		s.TargetDose = defaultDosingTarget
+	}
+	if s.ProductPercent <= 0 {
+		s.ProductPercent = defaultProductPercent
+	}
+	if s.ProductForm != ProductGranular {
+		s.ProductForm = ProductLiquid
+	}
+	if s.ProductName == "" {
+		if s.ProductForm == ProductGranular {
+			s.ProductName = "Chlorine granules"
+		} else {
+			s.ProductName = "Bleach"
+		}
+	}
+	if s.MinRefillLiters <= 0 {
+		s.MinRefillLiters = defaultMinDosingLiters
+	}
+	return s
+}
+
+// maxDose returns the most product the doser gives for one refill, the dose of a full tank
+// unless set lower
+func (s DosingSettings) maxDose(tank Tank) float64 {
+	full := calculateDose(s, tank.Meta.Settings.Capacity).ProductAmount
+	if s.MaxDoseAmount > 0 && s.MaxDoseAmount < full {
+		return s.MaxDoseAmount
+	}
+	return full
+}
+
+// calculateDose returns the product needed to bring the given liters to the target dose,
+// 1 mg/L is 1 g of chlorine per 1000 liters
+func calculateDose(settings DosingSettings, liters float64) ChlorineDose {
+	settings = settings.withDefaults()
+	chlorine := liters * settings.TargetDose / 1000
+	unit := "mL"
+	if settings.ProductForm == ProductGranular {
+		unit = "g"
+	}
+
+	return ChlorineDose{
+		Liters:         math.Round(liters),
+		TargetDose:     settings.TargetDose,
+		ChlorineGrams:  math.Round(chlorine*100) / 100,
+		ProductName:    settings.ProductName,
+		ProductPercent: settings.ProductPercent,
+		ProductAmount:  math.Round(chlorine/(settings.ProductPercent/100)*10) / 10,
+		ProductUnit:    unit,
+	}
+}
+
+// matchesEvent checks if the dosing record was made for the refill event
+func (d DosingRecord) matchesEvent(event WaterEvent) bool {
+	if d.RefillStart == nil || d.RefillEnd == nil {
+		return false
+	}
+	return !event.Start.After(d.RefillEnd.Add(deliveryMatchSlack)) && !event.End.Before(d.RefillStart.Add(-deliveryMatchSlack))
+}
+
+// updateDosingLog applies a change to the current dosing log of a tank and stores it, the
+// oldest records are dropped beyond the size of the log
+func updateDosingLog(tankID string, update func(records []DosingRecord) ([]DosingRecord, error)) error {
+	dosingLogLock.Lock()
+	defer dosingLogLock.Unlock()
+
+	var meta struct {
+		DosingLog []DosingRecord `json:"dosingLog"`
+	}
+	if err := getTankMeta(tankID, &meta); err != nil {
+		return err
+	}
+	records, err := update(meta.DosingLog)
+	if err != nil {
+		return err
+	}
+	if len(records) > dosingLogSize {
+		records = records[len(records)-dosingLogSize:]
+	}
+	return postTankMeta(tankID, map[string]interface{}{"dosingLog": records})
+}
+
+// attemptedDosing tells whether a refill was dosed or announced since the service started,
+// and forgets the refills too old to be scanned again
+func attemptedDosing(tankID string, event WaterEvent, now time.Time) bool {
+	dosingAttemptedLock.Lock()
+	defer dosingAttemptedLock.Unlock()
+
+	kept := []DosingRecord{}
+	attempted := false
+	for _, record := range dosingAttempted[tankID] {
+		if record.RefillEnd == nil || record.RefillEnd.Before(now.Add(-2*dosingLookbackHours*time.Hour)) {
+			continue
+		}
+		kept = append(kept, record)
+		attempted = attempted || record.matchesEvent(event)
+	}
+	dosingAttempted[tankID] = kept
+	return attempted
+}
+
+func recordDosingAttempt(tankID string, record DosingRecord) {
+	dosingAttemptedLock.Lock()
+	dosingAttempted[tankID] = append(dosingAttempted[tankID], record)
+	dosingAttemptedLock.Unlock()
+}
+
+// chlorineResidual returns the latest free chlorine reading of the tank
+func chlorineResidual(tank Tank) *float64 {
+	sensor, ok := findSensor(tank.Sensors, KindChlorine)
+	if !ok {
+		return nil
+	}
+	value, ok := numericValue(sensor.Value)
+	if !ok {
+		return nil
+	}
+	return &value
+}
+
+// runDoser switches the doser on for as long as the amount of product takes and returns the
+// seconds. The doses of the refills found in one scan are given in a single run, as the doser
+// has one switch. The end of the run is stored before the doser is switched on, it is switched
+// off again in the background.
+func runDoser(tank Tank, settings DosingSettings, amount float64) (float64, error) {
+	if settings.DoserActuatorID == "" || settings.DoserRate <= 0 {
+		return 0, fmt.Errorf("no doser configured")
+	}
+	deviceID := settings.DoserDeviceID
+	if deviceID == "" {
+		deviceID = tank.ID
+	}
+
+	seconds := amount / settings.DoserRate
+	if seconds > maxDoserSeconds {
+		return 0, fmt.Errorf("dose needs %.0f seconds of dosing, more than the %d allowed", seconds, maxDoserSeconds)
+	}
+
+	run := DoserRun{
+		DeviceID:   deviceID,
+		ActuatorID: settings.DoserActuatorID,
+		Until:      time.Now().Add(time.Duration(seconds * float64(time.Second))),
+	}
+	if err := postTankMeta(tank.ID, map[string]interface{}{"doserRun": run}); err != nil {
+		return 0, err
+	}
+	if err := setActuatorValue(deviceID, settings.DoserActuatorID, 1); err != nil {
+		stopDoser(tank, run)
+		return 0, err
+	}
+
+	scheduleDoserStop(tank, run)
+	return math.Round(seconds*10) / 10, nil
+}
+
+// doserBusy tells whether the doser of a tank is still running a dose
+func doserBusy(tank Tank) bool {
+	doserTimersLock.Lock()
+	defer doserTimersLock.Unlock()
+	return doserTimers[tank.ID] || tank.Meta.DoserRun != nil
+}
+
+// scheduleDoserStop switches the doser off at the end of its run
+func scheduleDoserStop(tank Tank, run DoserRun) {
+	doserTimersLock.Lock()
+	doserTimers[tank.ID] = true
+	doserTimersLock.Unlock()
+
+	time.AfterFunc(time.Until(run.Until), func() {
+		doserTimersLock.Lock()
+		delete(doserTimers, tank.ID)
+		doserTimersLock.Unlock()
+
+		stopDoser(tank, run)
+	})
+}
+
+// stopDoser switches the doser off and clears its run, the caretaker is alerted when it
+// cannot be switched off
+func stopDoser(tank Tank, run DoserRun) {
+	if err := setActuatorValue(run.DeviceID, run.ActuatorID, 0); err != nil {
+		fmt.Println("Error stopping doser:", err)
+		notifyTank(tank, fmt.Sprintf("Chlorine doser of %s did not stop", tank.Name),
+			fmt.Sprintf("The chlorine doser of %s could not be switched off after dosing. Switch it off by hand.", tank.Name), PriorityCritical)
+		return
+	}
+	if err := postTankMeta(tank.ID, map[string]interface{}{"doserRun": nil}); err != nil {
+		fmt.Println("Error clearing doser run:", err)
+	}
+	log.Printf("[%s] Doser stopped: %s", time.Now().Format(time.RFC3339), tank.Name)
+}
+
+// recoverDoser switches off a doser whose run has ended without being stopped, or sets the
+// timer again for a run started before the service restarted
+func recoverDoser(tank Tank) {
+	run := tank.Meta.DoserRun
+	if run == nil {
+		return
+	}
+	doserTimersLock.Lock()
+	scheduled := doserTimers[tank.ID]
+	doserTimersLock.Unlock()
+	if scheduled {
+		return
+	}
+
+	if time.Now().Before(run.Until) {
+		scheduleDoserStop(tank, *run)
+		return
+	}
+	stopDoser(tank, *run)
+}
+
+// StopDosers switches off the dosers left running when the service stopped
+func StopDosers() {
+	tanks, err := getTanks()
+	if err != nil {
+		fmt.Println("Error retrieving tanks:", err)
+		return
+	}
+	for _, tank := range tanks {
+		recoverDoser(tank)
+	}
+}
+
+// checkDosing schedules the chlorination of the refills completed in the last hours, the
+// caretaker is notified or the doser is run, and the dose is logged
+func checkDosing(tank Tank) {
+	// A doser is switched off even when dosing has been disabled since
+	recoverDoser(tank)
+
+	if !tank.Meta.DosingSettings.Enabled || tank.Meta.Settings.Capacity <= 0 {
+		return
+	}
+
+	now := time.Now()
+	dosingCheckedAtLock.Lock()
+	if last, ok := dosingCheckedAt[tank.ID]; ok && now.Sub(last) < 15*time.Minute {
+		dosingCheckedAtLock.Unlock()
+		return
+	}
+	dosingCheckedAt[tank.ID] = now
+	dosingCheckedAtLock.Unlock()
+
+	from := now.Add(-dosingLookbackHours * time.Hour).Format(time.RFC3339)
+	events, err := getTankEvents(tank, from, "")
+	if err != nil {
+		fmt.Println("Error detecting events:", err)
+		return
+	}
+
+	settings := tank.Meta.DosingSettings.withDefaults()
+	doser := settings.DoserActuatorID != ""
+
+	// A new run would cut the one in progress short, the refills are dosed at a later scan
+	if doser && doserBusy(tank) {
+		return
+	}
+
+	added := []DosingRecord{}
+	liters := []float64{}
+	// The last event may still be in progress
+	for i := 0; i < len(events)-1; i++ {
+		event := events[i]
+		if event.Type != EventRefill || event.Liters < settings.MinRefillLiters {
+			continue
+		}
+
+		recorded := attemptedDosing(tank.ID, event, now)
+		for _, record := range tank.Meta.DosingLog {
+			if record.matchesEvent(event) {
+				recorded = true
+				break
+			}
+		}
+		if recorded {
+			continue
+		}
+
+		record := DosingRecord{
+			ID:           newID() + strconv.Itoa(len(added)),
+			RefillStart:  event.Start,
+			RefillEnd:    event.End,
+			Source:       event.Source,
+			ChlorineDose: calculateDose(settings, event.Liters),
+			Status:       DosingScheduled,
+			Method:       DosingManual,
+			Scheduled:    now,
+		}
+
+		// Remembered before the doser runs, the refill is not dosed again if the log cannot be stored
+		recordDosingAttempt(tank.ID, record)
+		added = append(added, record)
+		liters = append(liters, event.Liters)
+	}
+
+	if len(added) == 0 {
+		return
+	}
+
+	var doserErr error
+	if doser {
+		// Each refill gets its dose up to the most allowed per refill, in one run
+		total := 0.0
+		for i := range added {
+			added[i].DosedAmount = math.Min(added[i].ProductAmount, settings.maxDose(tank))
+			total += added[i].DosedAmount
+		}
+		var seconds float64
+		if seconds, doserErr = runDoser(tank, settings, total); doserErr != nil {
+			fmt.Println("Error running doser:", doserErr)
+		} else {
+			log.Printf("[%s] Doser run for %.1f s: %s", time.Now().Format(time.RFC3339), seconds, tank.Name)
+		}
+	}
+
+	residual := chlorineResidual(tank)
+	for i := range added {
+		record := &added[i]
+		amount := fmt.Sprintf("%.1f %s of %s (%.1f%%)", record.ProductAmount, record.ProductUnit, record.ProductName, record.ProductPercent)
+		switch {
+		case doser && doserErr == nil:
+			dosed := now
+			record.Status = DosingDone
+			record.Method = DosingDoser
+			record.Dosed = &dosed
+			record.DoserSeconds = math.Round(record.DosedAmount/settings.DoserRate*10) / 10
+			record.By = DosingDoser
+			record.Residual = residual
+		case doser:
+			record.DosedAmount = 0
+			notifyTank(tank, fmt.Sprintf("Chlorinate %s by hand", tank.Name),
+				fmt.Sprintf("%s received %d liters but the doser could not be run (%s). Add %s to reach %.1f mg/L.",
+					tank.Name, int(liters[i]), doserErr, amount, record.TargetDose), PriorityHigh)
+		default:
+			caretaker := ""
+			if settings.Caretaker != "" {
+				caretaker = fmt.Sprintf(" Caretaker: %s.", settings.Caretaker)
+			}
+			notifyTank(tank, fmt.Sprintf("Chlorinate %s", tank.Name),
+				fmt.Sprintf("%s received %d liters. Add %s to reach %.1f mg/L of chlorine and confirm the dose.%s",
+					tank.Name, int(liters[i]), amount, record.TargetDose, caretaker), PriorityMedium)
+		}
+	}
+
+	err = updateDosingLog(tank.ID, func(records []DosingRecord) ([]DosingRecord, error) {
+		return append(records, added...), nil
+	})
+	if err != nil {
+		fmt.Println("Error storing dosing log:", err)
+		return
+	}
+	log.Printf("[%s] Scheduled %d chlorine doses: %s", time.Now().Format(time.RFC3339), len(added), tank.Name)
+}
+
+// filterDosingLog returns the dosing records of the refills that started between from and to
+func filterDosingLog(records []DosingRecord, from string, to string, loc *time.Location) ([]DosingRecord, error) {
+	var fromTime, toTime time.Time
+	var err error
+	if from != "" {
+		if fromTime, err = parseTime(from, loc); err != nil {
+			return nil, fmt.Errorf("invalid from date")
+		}
+	}
+	if to != "" {
+		if toTime, err = parseTime(to, loc); err != nil {
+			return nil, fmt.Errorf("invalid to date")
+		}
+	}
+
+	filtered := []DosingRecord{}
+	for _, record := range records {
+		start := record.Scheduled
+		if record.RefillStart != nil {
+			start = *record.RefillStart
+		}
+		if from != "" && start.Before(fromTime) {
+			continue
+		}
+		if to != "" && start.After(toTime) {
+			continue
+		}
+		filtered = append(filtered, record)
+	}
+	return filtered, nil
+}
+
+// GetDosingLogHandler returns the chlorine dosing log of a tank with the settings in use
+func GetDosingLogHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	records, err := filterDosingLog(tank.Meta.DosingLog, r.URL.Query().Get("from"), r.URL.Query().Get("to"), tankLocation(tank))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pending := 0
+	for _, record := range records {
+		if record.Status == DosingScheduled {
+			pending++
+		}
+	}
+
+	log.Printf("[%s] Fetched dosing log: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]interface{}{
+		"settings": tank.Meta.DosingSettings.withDefaults(),
+		"pending":  pending,
+		"records":  records,
+	})
+}
+
+// CalculateDoseHandler returns the chlorine product needed for a volume of water, the
+// current water in the tank when no liters are given
+func CalculateDoseHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var liters float64
+	if value := r.URL.Query().Get("liters"); value != "" {
+		liters, err = strconv.ParseFloat(value, 64)
+		if err != nil || liters <= 0 {
+			http.Error(w, "invalid liters", http.StatusBadRequest)
+			return
+		}
+	} else {
+		sensor, ok := levelSensor(tank)
+		distance, valid := numericValue(sensor.Value)
+		if !ok || !valid {
+			http.Error(w, "no level reading, liters are required", http.StatusBadRequest)
+			return
+		}
+		liters = math.Max(currentLiters(tank, distance), 0)
+	}
+
+	log.Printf("[%s] Calculated chlorine dose: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, calculateDose(tank.Meta.DosingSettings, liters))
+}
+
+// PostDosingHandler records a dose given outside of the refills detected, e.g. after
+// cleaning the tank
+func PostDosingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	var dosing struct {
+		Liters   float64    `json:"liters"`
+		Amount   float64    `json:"amount"`
+		Dosed    *time.Time `json:"dosed"`
+		By       string     `json:"by"`
+		Residual *float64   `json:"residual"`
+		Notes    string     `json:"notes"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err = json.Unmarshal(body, &dosing); err != nil {
+		http.Error(w, "invalid dosing", http.StatusBadRequest)
+		return
+	}
+	if dosing.Liters <= 0 {
+		http.Error(w, "liters are required", http.StatusBadRequest)
+		return
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	if dosing.Dosed == nil {
+		dosing.Dosed = &now
+	}
+	record := DosingRecord{
+		ID:           newID(),
+		ChlorineDose: calculateDose(tank.Meta.DosingSettings, dosing.Liters),
+		Status:       DosingDone,
+		Method:       DosingManual,
+		Scheduled:    *dosing.Dosed,
+		Dosed:        dosing.Dosed,
+		By:           dosing.By,
+		Residual:     dosing.Residual,
+		Notes:        dosing.Notes,
+		Manual:       true,
+	}
+	record.DosedAmount = record.ProductAmount
+	if dosing.Amount > 0 {
+		record.DosedAmount = dosing.Amount
+	}
+	if record.Residual == nil {
+		record.Residual = chlorineResidual(tank)
+	}
+
+	err = updateDosingLog(tankID, func(records []DosingRecord) ([]DosingRecord, error) {
+		return append(records, record), nil
+	})
+	if err != nil {
+		fmt.Println("Error storing dosing log:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Dosing recorded: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, record)
+}
+
+// ConfirmDosingHandler records that a scheduled dose was given, or skipped with a reason
+func ConfirmDosingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	var confirmation struct {
+		Amount   float64    `json:"amount"`
+		Dosed    *time.Time `json:"dosed"`
+		By       string     `json:"by"`
+		Residual *float64   `json:"residual"`
+		Notes    string     `json:"notes"`
+		Skipped  bool       `json:"skipped"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &confirmation); err != nil {
+			http.Error(w, "invalid confirmation", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var record DosingRecord
+	err = updateDosingLog(tankID, func(records []DosingRecord) ([]DosingRecord, error) {
+		index := -1
+		for i := range records {
+			if records[i].ID == vars["recordID"] {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, errDosingRecordNotFound
+		}
+
+		record = records[index]
+		record.By = confirmation.By
+		record.Notes = confirmation.Notes
+		if confirmation.Skipped {
+			record.Status = DosingSkipped
+			record.Dosed = nil
+			record.DosedAmount = 0
+		} else {
+			dosed := time.Now()
+			if confirmation.Dosed != nil {
+				dosed = *confirmation.Dosed
+			}
+			record.Status = DosingDone
+			record.Dosed = &dosed
+			record.DosedAmount = record.ProductAmount
+			if confirmation.Amount > 0 {
+				record.DosedAmount = confirmation.Amount
+			}
+			record.Residual = confirmation.Residual
+			if record.Residual == nil {
+				record.Residual = chlorineResidual(tank)
+			}
+		}
+		records[index] = record
+		return records, nil
+	})
+	if errors.Is(err, errDosingRecordNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error storing dosing log:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Dosing confirmed: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, record)
+}
+
+// ExportDosingLogHandler returns the dosing log of a tank as a CSV file for compliance reports
+func ExportDosingLogHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	loc := tankLocation(tank)
+	records, err := filterDosingLog(tank.Meta.DosingLog, r.URL.Query().Get("from"), r.URL.Query().Get("to"), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.In(loc).Format(time.RFC3339)
+	}
+	formatNumber := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"dosing-%s.csv\"", tank.ID))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "refill_start", "refill_end", "source", "liters", "target_mg_l", "chlorine_g",
+		"product", "product_percent", "recommended_amount", "dosed_amount", "unit", "status", "method",
+		"dosed", "by", "residual_mg_l", "notes"})
+	for _, record := range records {
+		residual := ""
+		if record.Residual != nil {
+			residual = formatNumber(*record.Residual)
+		}
+		writer.Write([]string{
+			record.ID,
+			formatTime(record.RefillStart),
+			formatTime(record.RefillEnd),
+			record.Source,
+			formatNumber(record.Liters),
+			formatNumber(record.TargetDose),
+			formatNumber(record.ChlorineGrams),
+			csvText(record.ProductName),
+			formatNumber(record.ProductPercent),
+			formatNumber(record.ProductAmount),
+			formatNumber(record.DosedAmount),
+			csvText(record.ProductUnit),
+			record.Status,
+			record.Method,
+			formatTime(record.Dosed),
+			csvText(record.By),
+			residual,
+			csvText(record.Notes),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		fmt.Println("Error writing dosing CSV:", err)
+	}
+
+	log.Printf("[%s] Exported dosing log: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+}
@@ -0,0 +1,315 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Sensor kind of thermometers measuring the air, like the one inside the tank lid
+const KindAirThermometer = "AirThermometer"
+
+// Where the temperature used to compensate the level readings comes from
+const (
+	CompensationAuto  = "auto"
+	CompensationAir   = "air"
+	CompensationWater = "water"
+)
+
+// Temperature at which ultrasonic sensors are calibrated, in °C, unless another is set
+const defaultReferenceTemperature = 20.0
+
+// Temperatures outside this range come from a faulty or disconnected thermometer
+const (
+	minValidTemperature = -40.0
+	maxValidTemperature = 85.0
+)
+
+// Days of compensated readings returned when no range is given
+const defaultCompensationDays = 1
+
+// CompensationSettings corrects the distance read by an ultrasonic level sensor for the
+// speed of sound at the measured temperature. The air thermometer is preferred in auto mode,
+// the air between the sensor and the water being what the sound travels through.
+// SensorID picks a thermometer explicitly.
+type CompensationSettings struct {
+	Enabled              bool     `json:"enabled" bson:"enabled"`
+	Source               string   `json:"source" bson:"source"`
+	SensorID             string   `json:"sensorID" bson:"sensorID"`
+	ReferenceTemperature *float64 `json:"referenceTemperature" bson:"referenceTemperature"`
+}
+
+// LevelCompensation reports a level reading before and after compensation
+type LevelCompensation struct {
+	SensorID    string     `json:"sensorID"`
+	Kind        string     `json:"kind"`
+	Temperature float64    `json:"temperature"`
+	Reference   float64    `json:"reference"`
+	Factor      float64    `json:"factor"`
+	RawDistance float64    `json:"rawDistance"`
+	Distance    float64    `json:"distance"`
+	RawLiters   float64    `json:"rawLiters"`
+	Liters      float64    `json:"liters"`
+	Time        *time.Time `json:"time,omitempty"`
+}
+
+// compensationSeries holds the temperatures used to compensate a level history
+type compensationSeries struct {
+	reference    float64
+	temperatures []HistoryPoint
+}
+
+// reference returns the calibration temperature, 0 °C being a valid one
+func (s CompensationSettings) reference() float64 {
+	if s.ReferenceTemperature != nil {
+		return *s.ReferenceTemperature
+	}
+	return defaultReferenceTemperature
+}
+
+// kinds returns the thermometer kinds usable for the source, in order of preference
+func (s CompensationSettings) kinds() []string {
+	switch s.Source {
+	case CompensationAir:
+		return []string{KindAirThermometer}
+	case CompensationWater:
+		return []string{"WaterThermometer"}
+	}
+	return []string{KindAirThermometer, "WaterThermometer"}
+}
+
+func validTemperature(temperature float64) bool {
+	return temperature >= minValidTemperature && temperature <= maxValidTemperature
+}
+
+// speedOfSoundFactor is the ratio of the speed of sound at a temperature to the one at the
+// reference temperature, about 0.17% per °C. The sensor converts the echo time at the reference
+// speed, so the true distance is the reading multiplied by this ratio.
+func speedOfSoundFactor(temperature float64, reference float64) float64 {
+	return math.Sqrt((273.15 + temperature) / (273.15 + reference))
+}
+
+// compensationSensor returns the thermometer compensating the level readings of a tank,
+// none when compensation is disabled or the tank has no suitable thermometer
+func compensationSensor(tank Tank) (SensorData, bool) {
+	settings := tank.Meta.Compensation
+	if !settings.Enabled {
+		return SensorData{}, false
+	}
+	if settings.SensorID != "" {
+		for _, sensor := range tank.Sensors {
+			if sensor.ID == settings.SensorID {
+				return sensor, true
+			}
+		}
+		return SensorData{}, false
+	}
+	for _, kind := range settings.kinds() {
+		if sensor, ok := findSensor(tank.Sensors, kind); ok {
+			return sensor, true
+		}
+	}
+	return SensorData{}, false
+}
+
+// compensateDistance corrects a current level reading with the current temperature. The
+// reading is returned as it is, with no report, when it cannot be compensated.
+func compensateDistance(tank Tank, distance float64) (float64, *LevelCompensation) {
+	sensor, ok := compensationSensor(tank)
+	if !ok {
+		return distance, nil
+	}
+	temperature, ok := numericValue(sensor.Value)
+	if !ok || !validTemperature(temperature) {
+		return distance, nil
+	}
+
+	settings := tank.Meta.Settings
+	reference := tank.Meta.Compensation.reference()
+	factor := speedOfSoundFactor(temperature, reference)
+	compensation := &LevelCompensation{
+		SensorID:    sensor.ID,
+		Kind:        sensor.Meta.Kind,
+		Temperature: temperature,
+		Reference:   reference,
+		Factor:      factor,
+		RawDistance: distance,
+		Distance:    distance * factor,
+		RawLiters:   toLiters(settings, distance),
+		Liters:      toLiters(settings, distance*factor),
+	}
+	return compensation.Distance, compensation
+}
+
+// currentLiters converts the current level reading of a tank to liters, compensated when enabled
+func currentLiters(tank Tank, distance float64) float64 {
+	distance, _ = compensateDistance(tank, distance)
+	return toLiters(tank.Meta.Settings, distance)
+}
+
+// LevelStatus is the water in a tank with the alert limits of its level sensor, which are
+// a percentage of the capacity
+type LevelStatus struct {
+	Liters      float64
+	Percent     float64
+	CriticalMin float64
+	CriticalMax float64
+}
+
+// TankLevel returns the current level of a tank fused from its level sensors and compensated
+// for the temperature when enabled, not ok when the tank has no level reading or no capacity
+func TankLevel(tank Tank) (LevelStatus, bool) {
+	sensor, ok := levelSensor(tank)
+	if !ok || tank.Meta.Settings.Capacity <= 0 {
+		return LevelStatus{}, false
+	}
+	distance, ok := numericValue(sensor.Value)
+	if !ok {
+		return LevelStatus{}, false
+	}
+
+	liters := currentLiters(tank, distance)
+	return LevelStatus{
+		Liters:      liters,
+		Percent:     liters / tank.Meta.Settings.Capacity * 100,
+		CriticalMin: sensor.Meta.CriticalMin,
+		CriticalMax: sensor.Meta.CriticalMax,
+	}, true
+}
+
+// getCompensationSeries fetches the temperatures compensating the level history of a tank
+// between from and to, nil when the tank is not compensated
+func getCompensationSeries(tank Tank, from string, to string) (*compensationSeries, error) {
+	sensor, ok := compensationSensor(tank)
+	if !ok {
+		return nil, nil
+	}
+
+	values, err := getSensorValues(tank.ID, sensor.ID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	series := &compensationSeries{reference: tank.Meta.Compensation.reference()}
+	for _, point := range sensorHistoryPoints(values) {
+		if validTemperature(point.Value) {
+			series.temperatures = append(series.temperatures, point)
+		}
+	}
+
+	// Without readings in the range the current temperature is the best there is
+	if len(series.temperatures) == 0 {
+		temperature, ok := numericValue(sensor.Value)
+		if !ok || !validTemperature(temperature) || sensor.Time == nil {
+			return nil, nil
+		}
+		series.temperatures = []HistoryPoint{{Time: *sensor.Time, Value: temperature}}
+	}
+	sort.Slice(series.temperatures, func(i, j int) bool {
+		return series.temperatures[i].Time.Before(series.temperatures[j].Time)
+	})
+	return series, nil
+}
+
+// temperature returns the last temperature at or before t, falling back to the first one after it
+func (s *compensationSeries) temperature(t time.Time) (float64, bool) {
+	if s == nil || len(s.temperatures) == 0 {
+		return 0, false
+	}
+	i := sort.Search(len(s.temperatures), func(i int) bool {
+		return s.temperatures[i].Time.After(t)
+	})
+	if i == 0 {
+		return s.temperatures[0].Value, true
+	}
+	return s.temperatures[i-1].Value, true
+}
+
+// distance corrects a level reading taken at t, a nil series leaves it as it is
+func (s *compensationSeries) distance(t time.Time, distance float64) float64 {
+	temperature, ok := s.temperature(t)
+	if !ok {
+		return distance
+	}
+	return distance * speedOfSoundFactor(temperature, s.reference)
+}
+
+// GetCompensationHandler returns the temperature compensation of the level readings of a
+// tank, the current reading and its history before and after compensation
+func GetCompensationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	levelSensor, ok := findSensor(tank.Sensors, "WaterLevel")
+	if !ok {
+		http.Error(w, "no WaterLevel sensor on this tank", http.StatusNotFound)
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = time.Now().AddDate(0, 0, -defaultCompensationDays).Format(time.RFC3339)
+	}
+	to := r.URL.Query().Get("to")
+
+	values, err := getSensorValues(tank.ID, levelSensor.ID, from, to)
+	if err != nil {
+		fmt.Println("Error retrieving water level values:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	series, err := getCompensationSeries(tank, from, to)
+	if err != nil {
+		fmt.Println("Error retrieving temperature values:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	history := []LevelCompensation{}
+	for _, point := range sensorHistoryPoints(values) {
+		temperature, ok := series.temperature(point.Time)
+		if !ok {
+			continue
+		}
+		at := point.Time
+		factor := speedOfSoundFactor(temperature, series.reference)
+		history = append(history, LevelCompensation{
+			Temperature: temperature,
+			Reference:   series.reference,
+			Factor:      factor,
+			RawDistance: point.Value,
+			Distance:    point.Value * factor,
+			RawLiters:   toLiters(tank.Meta.Settings, point.Value),
+			Liters:      toLiters(tank.Meta.Settings, point.Value*factor),
+			Time:        &at,
+		})
+	}
+
+	var current *LevelCompensation
+	if distance, ok := numericValue(levelSensor.Value); ok {
+		if _, current = compensateDistance(tank, distance); current != nil {
+			current.Time = levelSensor.Time
+		}
+	}
+
+	log.Printf("[%s] Fetched level compensation: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]interface{}{
+		"settings": tank.Meta.Compensation,
+		"active":   current != nil,
+		"current":  current,
+		"history":  history,
+	})
+}
@@ -0,0 +1,443 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Hours of history scanned for new deliveries on each check
+const deliveryLookbackHours = 48
+
+// Refills starting this close to a recorded delivery belong to it
+const deliveryMatchSlack = 10 * time.Minute
+
+// Deliveries kept in the tank meta
+const deliveryLogSize = 500
+
+// Delivery is a truck refill measured from the level history, the vendor, invoice and price
+// are attached by the user to reconcile it with what was paid for
+type Delivery struct {
+	ID                 string     `json:"id" bson:"id"`
+	Start              *time.Time `json:"start" bson:"start"`
+	End                *time.Time `json:"end" bson:"end"`
+	Source             string     `json:"source" bson:"source"`
+	MeasuredLiters     float64    `json:"measuredLiters" bson:"measuredLiters"`
+	Vendor             string     `json:"vendor" bson:"vendor"`
+	InvoicedLiters     float64    `json:"invoicedLiters" bson:"invoicedLiters"`
+	Price              float64    `json:"price" bson:"price"`
+	Currency           string     `json:"currency" bson:"currency"`
+	Notes              string     `json:"notes" bson:"notes"`
+	Manual             bool       `json:"manual" bson:"manual"`
+	Dismissed          bool       `json:"dismissed" bson:"dismissed"`
+	Discrepancy        float64    `json:"discrepancy" bson:"discrepancy"`
+	DiscrepancyPercent float64    `json:"discrepancyPercent" bson:"discrepancyPercent"`
+	ShortfallCost      float64    `json:"shortfallCost" bson:"shortfallCost"`
+}
+
+// Last time the deliveries were scanned, by tank
+var deliveriesCheckedAt = make(map[string]time.Time)
+var deliveriesCheckedAtLock sync.Mutex
+
+// reconcile compares the invoiced liters with the measured ones, a positive discrepancy
+// means less water was delivered than invoiced
+func (d *Delivery) reconcile() {
+	d.Discrepancy = 0
+	d.DiscrepancyPercent = 0
+	d.ShortfallCost = 0
+	if d.InvoicedLiters <= 0 {
+		return
+	}
+
+	d.Discrepancy = d.InvoicedLiters - d.MeasuredLiters
+	d.DiscrepancyPercent = d.Discrepancy / d.InvoicedLiters * 100
+	if d.Price > 0 {
+		d.ShortfallCost = d.Discrepancy * d.Price / d.InvoicedLiters
+	}
+}
+
+// matchesEvent checks if the delivery was recorded from the refill event
+func (d Delivery) matchesEvent(event WaterEvent) bool {
+	if d.Start == nil || d.End == nil {
+		return false
+	}
+	return !event.Start.After(d.End.Add(deliveryMatchSlack)) && !event.End.Before(d.Start.Add(-deliveryMatchSlack))
+}
+
+// recordDeliveries adds the completed truck refills of the last hours to the delivery log
+func recordDeliveries(tank Tank) {
+	if tank.Meta.Settings.Capacity <= 0 {
+		return
+	}
+
+	now := time.Now()
+	deliveriesCheckedAtLock.Lock()
+	if last, ok := deliveriesCheckedAt[tank.ID]; ok && now.Sub(last) < 15*time.Minute {
+		deliveriesCheckedAtLock.Unlock()
+		return
+	}
+	deliveriesCheckedAt[tank.ID] = now
+	deliveriesCheckedAtLock.Unlock()
+
+	from := now.Add(-deliveryLookbackHours * time.Hour).Format(time.RFC3339)
+	events, err := getTankEvents(tank, from, "")
+	if err != nil {
+		fmt.Println("Error detecting events:", err)
+		return
+	}
+
+	deliveries := tank.Meta.Deliveries
+	added := 0
+	// The last event may still be in progress
+	for i := 0; i < len(events)-1; i++ {
+		event := events[i]
+		if event.Type != EventRefill || event.Source != RefillTruck {
+			continue
+		}
+
+		recorded := false
+		for _, delivery := range deliveries {
+			if delivery.matchesEvent(event) {
+				recorded = true
+				break
+			}
+		}
+		if recorded {
+			continue
+		}
+
+		deliveries = append(deliveries, Delivery{
+			ID:             newID() + strconv.Itoa(added),
+			Start:          event.Start,
+			End:            event.End,
+			Source:         event.Source,
+			MeasuredLiters: event.Liters,
+			Currency:       tank.Meta.Tariff.Currency,
+		})
+		added++
+	}
+
+	if added == 0 {
+		return
+	}
+	if len(deliveries) > deliveryLogSize {
+		deliveries = deliveries[len(deliveries)-deliveryLogSize:]
+	}
+
+	if err := postTankMeta(tank.ID, map[string]interface{}{"deliveries": deliveries}); err != nil {
+		fmt.Println("Error storing deliveries:", err)
+		return
+	}
+	log.Printf("[%s] Recorded %d deliveries: %s", time.Now().Format(time.RFC3339), added, tank.Name)
+}
+
+// filterDeliveries returns the reconciled deliveries that started between from and to
+func filterDeliveries(deliveries []Delivery, from string, to string, loc *time.Location) ([]Delivery, error) {
+	var fromTime, toTime time.Time
+	var err error
+	if from != "" {
+		if fromTime, err = parseTime(from, loc); err != nil {
+			return nil, fmt.Errorf("invalid from date")
+		}
+	}
+	if to != "" {
+		if toTime, err = parseTime(to, loc); err != nil {
+			return nil, fmt.Errorf("invalid to date")
+		}
+	}
+
+	filtered := []Delivery{}
+	for _, delivery := range deliveries {
+		if delivery.Dismissed {
+			continue
+		}
+		if delivery.Start != nil {
+			if from != "" && delivery.Start.Before(fromTime) {
+				continue
+			}
+			if to != "" && delivery.Start.After(toTime) {
+				continue
+			}
+		}
+		delivery.reconcile()
+		filtered = append(filtered, delivery)
+	}
+	return filtered, nil
+}
+
+// GetDeliveriesHandler returns the delivery log of a tank with the discrepancy of each delivery
+func GetDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := filterDeliveries(tank.Meta.Deliveries, r.URL.Query().Get("from"), r.URL.Query().Get("to"), tankLocation(tank))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[%s] Fetched deliveries: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, deliveries)
+}
+
+// ExportDeliveriesHandler returns the delivery log of a tank as a CSV file
+func ExportDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	loc := tankLocation(tank)
+	deliveries, err := filterDeliveries(tank.Meta.Deliveries, r.URL.Query().Get("from"), r.URL.Query().Get("to"), loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.In(loc).Format(time.RFC3339)
+	}
+	formatNumber := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"deliveries-%s.csv\"", tank.ID))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "start", "end", "source", "vendor", "measured_liters", "invoiced_liters",
+		"discrepancy_liters", "discrepancy_percent", "price", "currency", "shortfall_cost", "manual", "notes"})
+	for _, delivery := range deliveries {
+		writer.Write([]string{
+			delivery.ID,
+			formatTime(delivery.Start),
+			formatTime(delivery.End),
+			delivery.Source,
+			csvText(delivery.Vendor),
+			formatNumber(delivery.MeasuredLiters),
+			formatNumber(delivery.InvoicedLiters),
+			formatNumber(delivery.Discrepancy),
+			formatNumber(delivery.DiscrepancyPercent),
+			formatNumber(delivery.Price),
+			csvText(delivery.Currency),
+			formatNumber(delivery.ShortfallCost),
+			strconv.FormatBool(delivery.Manual),
+			csvText(delivery.Notes),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		fmt.Println("Error writing deliveries CSV:", err)
+	}
+
+	log.Printf("[%s] Exported deliveries: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+}
+
+// csvText keeps text typed by users from being run as a formula when the CSV is opened
+// in a spreadsheet
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// PostDeliveryHandler records a delivery that was not detected from the level history
+func PostDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var delivery Delivery
+	if err = json.Unmarshal(body, &delivery); err != nil {
+		fmt.Println("Error unmarshaling delivery:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if delivery.Start == nil {
+		now := time.Now()
+		delivery.Start = &now
+	}
+	if delivery.End == nil {
+		delivery.End = delivery.Start
+	}
+	if delivery.Source == "" {
+		delivery.Source = RefillTruck
+	}
+	if delivery.Currency == "" {
+		delivery.Currency = tank.Meta.Tariff.Currency
+	}
+	delivery.ID = newID()
+	delivery.Manual = true
+	delivery.reconcile()
+
+	deliveries := append(tank.Meta.Deliveries, delivery)
+	if err = postTankMeta(tankID, map[string]interface{}{"deliveries": deliveries}); err != nil {
+		fmt.Println("Error storing deliveries:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Delivery added: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, delivery)
+}
+
+// UpdateDeliveryHandler attaches the vendor, invoiced liters, price and notes to a delivery
+func UpdateDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+	deliveryID := vars["deliveryID"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var update struct {
+		Vendor         *string  `json:"vendor"`
+		InvoicedLiters *float64 `json:"invoicedLiters"`
+		Price          *float64 `json:"price"`
+		Currency       *string  `json:"currency"`
+		Notes          *string  `json:"notes"`
+	}
+	if err = json.Unmarshal(body, &update); err != nil {
+		fmt.Println("Error unmarshaling delivery:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	deliveries := tank.Meta.Deliveries
+	var updated *Delivery
+	for i := range deliveries {
+		if deliveries[i].ID == deliveryID {
+			updated = &deliveries[i]
+			break
+		}
+	}
+
+	if updated == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if update.Vendor != nil {
+		updated.Vendor = *update.Vendor
+	}
+	if update.InvoicedLiters != nil {
+		updated.InvoicedLiters = *update.InvoicedLiters
+	}
+	if update.Price != nil {
+		updated.Price = *update.Price
+	}
+	if update.Currency != nil {
+		updated.Currency = *update.Currency
+	}
+	if update.Notes != nil {
+		updated.Notes = *update.Notes
+	}
+	updated.reconcile()
+
+	if err = postTankMeta(tankID, map[string]interface{}{"deliveries": deliveries}); err != nil {
+		fmt.Println("Error storing deliveries:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Delivery updated: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, updated)
+}
+
+// DeleteDeliveryHandler removes a delivery from the log, detected deliveries are only dismissed
+// so that they are not recorded again from the level history
+func DeleteDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+	deliveryID := vars["deliveryID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	deliveries := []Delivery{}
+	found := false
+	for _, delivery := range tank.Meta.Deliveries {
+		if delivery.ID == deliveryID && !delivery.Dismissed {
+			found = true
+			if delivery.Manual {
+				continue
+			}
+			delivery.Dismissed = true
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err = postTankMeta(tankID, map[string]interface{}{"deliveries": deliveries}); err != nil {
+		fmt.Println("Error storing deliveries:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Delivery deleted: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Delivery deleted",
+	})
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errTankNotFound is returned by getTank when the gateway has no device with the ID
+var errTankNotFound = errors.New("tank not found")
+
+// getTank fetches a single tank (device) from the gateway
+func getTank(tankID string) (Tank, error) {
+	var tank Tank
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s", tankID))
+	if err != nil {
+		return tank, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return tank, errTankNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tank, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tank, err
+	}
+
+	err = json.Unmarshal(body, &tank)
+	return tank, err
+}
+
+// getTanks fetches every device registered on the gateway
+func getTanks() ([]Tank, error) {
+	resp, err := http.Get("http://localhost/devices")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tanks []Tank
+	err = json.Unmarshal(body, &tanks)
+	return tanks, err
+}
+
+// getSensorValues fetches the stored values of a sensor, optionally limited by from/to
+func getSensorValues(deviceID string, sensorID string, from string, to string) ([]SensorData, error) {
+	u, err := url.Parse(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/values", deviceID, sensorID))
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	if from != "" {
+		q.Set("from", strings.ReplaceAll(from, " ", "+"))
+	}
+	if to != "" {
+		q.Set("to", strings.ReplaceAll(to, " ", "+"))
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []SensorData
+	err = json.Unmarshal(body, &values)
+	return values, err
+}
+
+// getActuatorValues fetches the stored states of an actuator in chronological order
+func getActuatorValues(deviceID string, actuatorID string) ([]SensorData, error) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s/actuators/%s/values", deviceID, actuatorID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []SensorData
+	err = json.Unmarshal(body, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		if values[i].Time == nil || values[j].Time == nil {
+			return false
+		}
+		return values[i].Time.Before(*values[j].Time)
+	})
+
+	return values, nil
+}
+
+// postTankMeta updates only the given top level meta fields of a tank,
+// the gateway merges them with the fields already stored
+func postTankMeta(tankID string, fields map[string]interface{}) error {
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost/devices/%s/meta", tankID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(responseBody))
+	}
+
+	return nil
+}
+
+// getTankMeta decodes the meta of a tank, including the fields the Tank struct leaves out
+func getTankMeta(tankID string, v interface{}) error {
+	resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s/meta", tankID))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// postSensorMeta updates the given meta fields of a sensor, the gateway merges them
+// with the fields already stored
+func postSensorMeta(deviceID string, sensorID string, fields map[string]interface{}) error {
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost/devices/%s/sensors/%s/meta", deviceID, sensorID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(responseBody))
+	}
+
+	return nil
+}
+
+// createSensor adds a sensor to a device and returns its ID
+func createSensor(deviceID string, name string, meta map[string]interface{}) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"name": name,
+		"meta": meta,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost/devices/%s/sensors", deviceID), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(responseBody))
+	}
+
+	// The gateway answers with the ID, quoted or not depending on its version
+	return strings.Trim(strings.TrimSpace(string(responseBody)), "\""), nil
+}
+
+// deleteSensor removes a sensor and its values from a device
+func deleteSensor(deviceID string, sensorID string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://localhost/devices/%s/sensors/%s", deviceID, sensorID), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// postSensorValue stores a new value of a sensor
+func postSensorValue(deviceID string, sensorID string, value float64) error {
+	body := []byte(strconv.FormatFloat(value, 'f', -1, 64))
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/value", deviceID, sensorID), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setActuatorValue posts a new value to an actuator
+func setActuatorValue(deviceID string, actuatorID string, value interface{}) error {
+	body := []byte(fmt.Sprintf("%v", value))
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost/devices/%s/actuators/%s/value", deviceID, actuatorID), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// numericValue converts a raw sensor or actuator value to float64
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toLiters converts a distance reading from the level sensor to liters in the tank
+func toLiters(settings Settings, distance float64) float64 {
+	if settings.Height <= 0 || settings.Capacity <= 0 {
+		return 0
+	}
+	return ((settings.Height - (distance - settings.Offset)) / settings.Height) * settings.Capacity
+}
+
+// findSensor returns the first sensor of the given kind
+func findSensor(sensors []SensorData, kind string) (SensorData, bool) {
+	for _, sensor := range sensors {
+		if sensor.Meta.Kind == kind {
+			return sensor, true
+		}
+	}
+	return SensorData{}, false
+}
+
+// getLevelHistory returns the liters history of a tank between from and to
+func getLevelHistory(tank Tank, from string, to string) ([]WaterLevel, error) {
+	distances, err := getLevelDistances(tank, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var waterLevelEntries []WaterLevel
+	for _, point := range distances {
+		timestamp := point.Time
+		waterLevelEntries = append(waterLevelEntries, WaterLevel{
+			Level:     toLiters(tank.Meta.Settings, point.Value),
+			Timestamp: &timestamp,
+		})
+	}
+
+	return excludeMaintenancePeriods(waterLevelEntries, tank), nil
+}
+
+// levelAt returns the last recorded level at or before t, falling back to the first level after it
+func levelAt(levels []WaterLevel, t time.Time) (float64, bool) {
+	if len(levels) == 0 {
+		return 0, false
+	}
+	level := levels[0].Level
+	for _, entry := range levels {
+		if entry.Timestamp.After(t) {
+			break
+		}
+		level = entry.Level
+	}
+	return level, true
+}
+
+// newID returns a short unique identifier for records stored in the meta fields
+func newID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// getGatewayMeta decodes the gateway profile stored in the gateway device meta
+func getGatewayMeta(v interface{}) error {
+	resp, err := http.Get("http://localhost/device/meta")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// postGatewayMeta updates only the given top level fields of the gateway profile
+func postGatewayMeta(fields map[string]interface{}) error {
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post("http://localhost/device/meta", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(responseBody))
+	}
+
+	return nil
+}
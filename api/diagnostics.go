@@ -0,0 +1,508 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Checks run on the data of each sensor
+const (
+	CheckFlatline   = "flatline"
+	CheckImpossible = "impossible-values"
+	CheckOffset     = "sudden-offset"
+	CheckMissing    = "missing-data"
+	CheckSkew       = "timestamp-skew"
+)
+
+// Data quality of a sensor from its score
+const (
+	DiagnosticGood     = "good"
+	DiagnosticDegraded = "degraded"
+	DiagnosticFaulty   = "faulty"
+	DiagnosticNoData   = "no-data"
+)
+
+// Days of readings diagnosed when no range is given
+const defaultDiagnosticDays = 3
+
+// A sensor repeating the same value for this long is taken as stuck, unless set per tank
+const defaultFlatlineHours = 24
+
+// Readings repeated fewer times than this are never a flatline
+const minFlatlineReadings = 3
+
+// A tank that is neither used nor refilled also reads the same level, so a flatline alone
+// only degrades a sensor, it is faulty with other problems in its data
+const flatlinePenalty = 30
+
+// A gap longer than this many times the usual interval between readings is missing data
+const missingGapFactor = 3
+
+// Gaps shorter than this are never missing data, sensors report on their own schedule
+const minMissingGap = 15 * time.Minute
+
+// Readings further in the future than this come from a device with a wrong clock
+const maxClockAhead = 5 * time.Minute
+
+// A step is an offset when it is this many times the usual change between readings
+const offsetNoiseFactor = 8
+
+// Level readings are impossible this far below empty or above full, in percent of the capacity
+const impossibleLevelMargin = 2.0
+
+// Diagnostics run at most this often for the maintenance notifications
+const diagnosticsInterval = 6 * time.Hour
+
+// DiagnosticSettings configures the sensor diagnostics of a tank
+type DiagnosticSettings struct {
+	FlatlineHours float64 `json:"flatlineHours" bson:"flatlineHours"`
+	Disabled      bool    `json:"disabled" bson:"disabled"`
+}
+
+// DiagnosticIssue is a problem found in the data of a sensor
+type DiagnosticIssue struct {
+	Check   string     `json:"check"`
+	Message string     `json:"message"`
+	Count   int        `json:"count"`
+	Penalty float64    `json:"penalty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// SensorDiagnostics scores the data quality of a sensor from 100 down to 0
+type SensorDiagnostics struct {
+	SensorID        string            `json:"sensorID"`
+	Name            string            `json:"name"`
+	Kind            string            `json:"kind"`
+	Readings        int               `json:"readings"`
+	LastReading     *time.Time        `json:"lastReading"`
+	IntervalMinutes float64           `json:"intervalMinutes"`
+	Coverage        float64           `json:"coverage"`
+	Score           float64           `json:"score"`
+	Status          string            `json:"status"`
+	Issues          []DiagnosticIssue `json:"issues"`
+}
+
+// TankDiagnostics is the diagnostics of the sensors of a tank, scored as its worst sensor
+type TankDiagnostics struct {
+	TankID  string              `json:"tankID"`
+	From    time.Time           `json:"from"`
+	To      time.Time           `json:"to"`
+	Score   float64             `json:"score"`
+	Status  string              `json:"status"`
+	Sensors []SensorDiagnostics `json:"sensors"`
+}
+
+// Time of the last run and date of the last notification, by tank
+var diagnosticsCheckedAt = make(map[string]time.Time)
+var diagnosticsNotified = make(map[string]string)
+var diagnosticsLock sync.Mutex
+
+func (s DiagnosticSettings) flatline() time.Duration {
+	if s.FlatlineHours > 0 {
+		return time.Duration(s.FlatlineHours * float64(time.Hour))
+	}
+	return defaultFlatlineHours * time.Hour
+}
+
+func diagnosticStatus(score float64) string {
+	switch {
+	case score >= 80:
+		return DiagnosticGood
+	case score >= 50:
+		return DiagnosticDegraded
+	}
+	return DiagnosticFaulty
+}
+
+// impossibleValue tells whether a reading cannot be right for the kind of sensor, level
+// readings being in liters
+func impossibleValue(tank Tank, sensor SensorData, value float64) bool {
+	switch sensor.Meta.Kind {
+	case "WaterLevel":
+		capacity := tank.Meta.Settings.Capacity
+		if capacity <= 0 {
+			return false
+		}
+		margin := capacity * impossibleLevelMargin / 100
+		return value < -margin || value > capacity+margin
+	case "WaterThermometer", KindAirThermometer:
+		return !validTemperature(value)
+	case "VoltageSensor":
+		return value < 0
+	case KindFlowMeter:
+		return isFlowRate(sensor) && value < 0
+	}
+	if parameter, ok := qualityParameter(sensor.Meta.Kind); ok {
+		return !parameter.valid(value)
+	}
+	return false
+}
+
+// offsetFloor is the smallest step taken as an offset, level sensors step by a tenth of the
+// tank and the others by a twentieth of their usual value
+func offsetFloor(tank Tank, sensor SensorData, values []float64) float64 {
+	if sensor.Meta.Kind == "WaterLevel" && tank.Meta.Settings.Capacity > 0 {
+		return tank.Meta.Settings.Capacity / 10
+	}
+	magnitudes := make([]float64, len(values))
+	for i, value := range values {
+		magnitudes[i] = math.Abs(value)
+	}
+	return math.Max(median(magnitudes)/20, 1e-6)
+}
+
+// diagnoseSensor scores the readings of a sensor between from and to
+func diagnoseSensor(tank Tank, sensor SensorData, values []SensorData, from time.Time, to time.Time, now time.Time) SensorDiagnostics {
+	diagnostics := SensorDiagnostics{
+		SensorID: sensor.ID,
+		Name:     sensor.Name,
+		Kind:     sensor.Meta.Kind,
+		Issues:   []DiagnosticIssue{},
+	}
+
+	// Timestamps are checked in the order the gateway stored the readings, out of order
+	// being against the direction most of the readings follow
+	kind, _ := sensorKind(sensor.Meta.Kind)
+	history := []HistoryPoint{}
+	future, forwards, backwards, duplicates := 0, 0, 0, 0
+	for _, value := range values {
+		number, ok := numericValue(value.Value)
+		if !ok || value.Time == nil {
+			continue
+		}
+		at := *value.Time
+		if at.After(now.Add(maxClockAhead)) {
+			future++
+		}
+		if n := len(history); n > 0 {
+			if at.Equal(history[n-1].Time) {
+				duplicates++
+			} else if at.Before(history[n-1].Time) {
+				backwards++
+			} else {
+				forwards++
+			}
+		}
+		history = append(history, HistoryPoint{Time: at, Value: kind.value(tank, number)})
+	}
+
+	if forwards < backwards {
+		backwards = forwards
+	}
+	diagnostics.Readings = len(history)
+	if len(history) == 0 {
+		diagnostics.Status = DiagnosticNoData
+		diagnostics.Issues = append(diagnostics.Issues, DiagnosticIssue{
+			Check:   CheckMissing,
+			Message: "No readings in the period",
+			Penalty: 100,
+		})
+		return diagnostics
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Time.Before(history[j].Time)
+	})
+	last := history[len(history)-1].Time
+	diagnostics.LastReading = &last
+
+	numbers := make([]float64, len(history))
+	for i, point := range history {
+		numbers[i] = point.Value
+	}
+
+	if skewed := future + backwards + duplicates; skewed > 0 {
+		parts := []string{}
+		if future > 0 {
+			parts = append(parts, fmt.Sprintf("%d in the future", future))
+		}
+		if backwards > 0 {
+			parts = append(parts, fmt.Sprintf("%d out of order", backwards))
+		}
+		if duplicates > 0 {
+			parts = append(parts, fmt.Sprintf("%d with a repeated timestamp", duplicates))
+		}
+		diagnostics.Issues = append(diagnostics.Issues, DiagnosticIssue{
+			Check:   CheckSkew,
+			Message: fmt.Sprintf("Readings %s, the clock of the device may be wrong", strings.Join(parts, ", ")),
+			Count:   skewed,
+			Penalty: math.Min(20, 2*float64(skewed)),
+		})
+	}
+
+	// Impossible values
+	impossible := 0
+	var firstImpossible *time.Time
+	for i := range history {
+		if impossibleValue(tank, sensor, history[i].Value) {
+			if firstImpossible == nil {
+				firstImpossible = &history[i].Time
+			}
+			impossible++
+		}
+	}
+	if impossible > 0 {
+		share := float64(impossible) / float64(len(history)) * 100
+		diagnostics.Issues = append(diagnostics.Issues, DiagnosticIssue{
+			Check:   CheckImpossible,
+			Message: fmt.Sprintf("%d readings (%.0f%%) outside what the sensor can measure", impossible, share),
+			Count:   impossible,
+			Penalty: math.Round(math.Min(60, 5+share)*10) / 10,
+			Since:   firstImpossible,
+		})
+	}
+
+	// Flatline, the longest run of the same value, up to the end of the period when it still runs
+	flatStart, flatCount := 0, 0
+	var flat time.Duration
+	for start := 0; start < len(history); {
+		end := start
+		for end+1 < len(history) && history[end+1].Value == history[start].Value {
+			end++
+		}
+		until := history[end].Time
+		if end == len(history)-1 {
+			until = to
+		}
+		if run := until.Sub(history[start].Time); end-start+1 >= minFlatlineReadings && run > flat {
+			flatStart, flatCount, flat = start, end-start+1, run
+		}
+		start = end + 1
+	}
+	if flatCount > 0 && flat >= tank.Meta.DiagnosticSettings.flatline() {
+		since := history[flatStart].Time
+		diagnostics.Issues = append(diagnostics.Issues, DiagnosticIssue{
+			Check:   CheckFlatline,
+			Message: fmt.Sprintf("The same value %v was read %d times over %.0f hours, the sensor may be stuck", history[flatStart].Value, flatCount, flat.Hours()),
+			Count:   flatCount,
+			Penalty: flatlinePenalty,
+			Since:   &since,
+		})
+	}
+
+	// Sudden offsets, a large step between steady readings. A spike comes back and is not an offset.
+	if len(history) >= 3 {
+		steps := make([]float64, len(history)-1)
+		changes := make([]float64, len(steps))
+		for i := range steps {
+			steps[i] = history[i+1].Value - history[i].Value
+			changes[i] = math.Abs(steps[i])
+		}
+		threshold := math.Max(offsetNoiseFactor*median(changes), offsetFloor(tank, sensor, numbers))
+		offsets := 0
+		var firstOffset *time.Time
+		for i, step := range steps {
+			if math.Abs(step) <= threshold {
+				continue
+			}
+			if i == 0 || i+1 == len(steps) || changes[i-1] > threshold || changes[i+1] > threshold {
+				continue
+			}
+			if firstOffset == nil {
+				firstOffset = &history[i+1].Time
+			}
+			offsets++
+		}
+		if offsets > 0 {
+			diagnostics.Issues = append(diagnostics.Issues, DiagnosticIssue{
+				Check:   CheckOffset,
+				Message: fmt.Sprintf("%d sudden jumps of more than %.1f %s between steady readings, the sensor may have moved or been replaced", offsets, threshold, kind.unit(sensor)),
+				Count:   offsets,
+				Penalty: math.Min(20, 5*float64(offsets)),
+				Since:   firstOffset,
+			})
+		}
+	}
+
+	// Missing intervals, gaps much longer than the usual interval and the silence since the last reading
+	window := to.Sub(from)
+	if len(history) >= 2 {
+		gaps := make([]float64, len(history)-1)
+		for i := range gaps {
+			gaps[i] = float64(history[i+1].Time.Sub(history[i].Time))
+		}
+		interval := time.Duration(median(gaps))
+		diagnostics.IntervalMinutes = math.Round(interval.Minutes()*10) / 10
+
+		limit := time.Duration(math.Max(float64(missingGapFactor*interval), float64(minMissingGap)))
+		var missing time.Duration
+		gapCount := 0
+		var firstGap *time.Time
+		ends := append(gaps, float64(to.Sub(last)))
+		for i, gap := range ends {
+			if time.Duration(gap) <= limit {
+				continue
+			}
+			if firstGap == nil {
+				at := history[i].Time
+				firstGap = &at
+			}
+			missing += time.Duration(gap) - interval
+			gapCount++
+		}
+		if window > 0 {
+			diagnostics.Coverage = math.Round(math.Max(0, 1-float64(missing)/float64(window))*1000) / 10
+		}
+		if gapCount > 0 {
+			share := 100 - diagnostics.Coverage
+			diagnostics.Issues = append(diagnostics.Issues, DiagnosticIssue{
+				Check:   CheckMissing,
+				Message: fmt.Sprintf("%d gaps in the readings, %.1f hours missing (%.0f%% of the period)", gapCount, missing.Hours(), share),
+				Count:   gapCount,
+				Penalty: math.Round(math.Min(30, share)*10) / 10,
+				Since:   firstGap,
+			})
+		}
+	} else {
+		diagnostics.Issues = append(diagnostics.Issues, DiagnosticIssue{
+			Check:   CheckMissing,
+			Message: "Only one reading in the period",
+			Count:   1,
+			Penalty: 30,
+		})
+	}
+
+	score := 100.0
+	for _, issue := range diagnostics.Issues {
+		score -= issue.Penalty
+	}
+	diagnostics.Score = math.Max(0, math.Round(score))
+	diagnostics.Status = diagnosticStatus(diagnostics.Score)
+	return diagnostics
+}
+
+// getDiagnostics diagnoses the sensors of a tank between from and to, virtual sensors
+// being computed are left out
+func getDiagnostics(tank Tank, from time.Time, to time.Time) (TankDiagnostics, error) {
+	now := time.Now()
+	report := TankDiagnostics{
+		TankID:  tank.ID,
+		From:    from,
+		To:      to,
+		Score:   100,
+		Status:  DiagnosticGood,
+		Sensors: []SensorDiagnostics{},
+	}
+	for _, sensor := range tank.Sensors {
+		if sensor.Meta.Kind == KindVirtual {
+			continue
+		}
+		values, err := getSensorValues(tank.ID, sensor.ID, from.Format(time.RFC3339), to.Format(time.RFC3339))
+		if err != nil {
+			return report, err
+		}
+		diagnostics := diagnoseSensor(tank, sensor, values, from, to, now)
+		report.Sensors = append(report.Sensors, diagnostics)
+		if diagnostics.Score < report.Score {
+			report.Score = diagnostics.Score
+		}
+	}
+	report.Status = diagnosticStatus(report.Score)
+	return report, nil
+}
+
+// checkDiagnostics diagnoses the sensors of a tank every few hours and asks for maintenance
+// once a day while a sensor is faulty
+func checkDiagnostics(tank Tank) {
+	settings := tank.Meta.DiagnosticSettings
+	if settings.Disabled {
+		return
+	}
+
+	now := time.Now()
+	date := now.In(tankLocation(tank)).Format("2006-01-02")
+	diagnosticsLock.Lock()
+	last, ok := diagnosticsCheckedAt[tank.ID]
+	if diagnosticsNotified[tank.ID] == date || (ok && now.Sub(last) < diagnosticsInterval) {
+		diagnosticsLock.Unlock()
+		return
+	}
+	diagnosticsCheckedAt[tank.ID] = now
+	diagnosticsLock.Unlock()
+
+	// The window covers at least two flatline periods
+	window := time.Duration(defaultDiagnosticDays) * 24 * time.Hour
+	if flatline := 2 * settings.flatline(); flatline > window {
+		window = flatline
+	}
+	report, err := getDiagnostics(tank, now.Add(-window), now)
+	if err != nil {
+		fmt.Println("Error diagnosing sensors:", err)
+		return
+	}
+
+	faulty := []string{}
+	for _, sensor := range report.Sensors {
+		if sensor.Status != DiagnosticFaulty {
+			continue
+		}
+		checks := []string{}
+		for _, issue := range sensor.Issues {
+			checks = append(checks, strings.ReplaceAll(issue.Check, "-", " "))
+		}
+		faulty = append(faulty, fmt.Sprintf("%s (%s)", sensor.Name, strings.Join(checks, ", ")))
+	}
+	if len(faulty) == 0 {
+		return
+	}
+
+	diagnosticsLock.Lock()
+	diagnosticsNotified[tank.ID] = date
+	diagnosticsLock.Unlock()
+
+	title := fmt.Sprintf("Sensor maintenance needed at %s", tank.Name)
+	body := fmt.Sprintf("The readings of %s look faulty: %s. Check the sensors and their wiring.",
+		tank.Name, strings.Join(faulty, "; "))
+	notifyTank(tank, title, body, PriorityMedium)
+}
+
+// GetDiagnosticsHandler scores the data quality of the sensors of a tank
+func GetDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	loc := tankLocation(tank)
+	to := time.Now()
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid to time", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.AddDate(0, 0, -defaultDiagnosticDays)
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid from time", http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	report, err := getDiagnostics(tank, from, to)
+	if err != nil {
+		fmt.Println("Error diagnosing sensors:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched sensor diagnostics: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, report)
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	AggAvg  = "avg"
+	AggMin  = "min"
+	AggMax  = "max"
+	AggLast = "last"
+	AggLTTB = "lttb"
+)
+
+// Points returned when only agg is given
+const defaultDownsamplePoints = 500
+
+// Most points a downsampled history may return
+const maxDownsamplePoints = 5000
+
+// Approximate length of the calendar buckets and the next larger one
+var calendarLength = map[string]time.Duration{
+	IntervalHour:  time.Hour,
+	IntervalDay:   24 * time.Hour,
+	IntervalWeek:  7 * 24 * time.Hour,
+	IntervalMonth: 31 * 24 * time.Hour,
+}
+
+var coarserCalendar = map[string]string{
+	IntervalHour: IntervalDay,
+	IntervalDay:  IntervalWeek,
+	IntervalWeek: IntervalMonth,
+}
+
+// HistoryPoint is a single value of a sensor history
+type HistoryPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// DownsampleOptions holds the interval and agg query parameters of a history request,
+// the interval is either a duration ("15m", "1h") or a calendar bucket (hour, day, week, month)
+type DownsampleOptions struct {
+	Agg      string
+	Interval time.Duration
+	Calendar string
+	Points   int
+}
+
+// parseDownsampleOptions reads the downsampling query parameters, the second value is false
+// when the raw history is requested
+func parseDownsampleOptions(r *http.Request) (DownsampleOptions, bool, error) {
+	query := r.URL.Query()
+	options := DownsampleOptions{
+		Agg: query.Get("agg"),
+	}
+
+	interval := query.Get("interval")
+	points := query.Get("points")
+	if options.Agg == "" && interval == "" && points == "" {
+		return options, false, nil
+	}
+
+	switch options.Agg {
+	case "":
+		options.Agg = AggAvg
+	case AggAvg, AggMin, AggMax, AggLast, AggLTTB:
+	default:
+		return options, false, fmt.Errorf("agg must be avg, min, max, last or lttb")
+	}
+
+	if interval != "" {
+		if validInterval(interval) {
+			options.Calendar = interval
+		} else {
+			duration, err := time.ParseDuration(interval)
+			if err != nil || duration <= 0 {
+				return options, false, fmt.Errorf("invalid interval: %s", interval)
+			}
+			options.Interval = duration
+		}
+	}
+
+	if points != "" {
+		n, err := strconv.Atoi(points)
+		if err != nil || n < 3 {
+			return options, false, fmt.Errorf("points must be a number of at least 3")
+		}
+		options.Points = n
+	}
+	if options.Points == 0 {
+		options.Points = defaultDownsamplePoints
+	} else if options.Points > maxDownsamplePoints {
+		options.Points = maxDownsamplePoints
+	}
+
+	return options, true, nil
+}
+
+// downsample reduces the history to a bounded number of points, bucketing aggregations
+// use the interval or split the range evenly in options.Points buckets
+func downsample(history []HistoryPoint, options DownsampleOptions, loc *time.Location) []HistoryPoint {
+	if len(history) < 3 {
+		return history
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Time.Before(history[j].Time)
+	})
+
+	if options.Agg == AggLTTB {
+		threshold := options.Points
+		if options.Interval > 0 {
+			span := history[len(history)-1].Time.Sub(history[0].Time)
+			threshold = int(span/options.Interval) + 1
+		}
+		if threshold > maxDownsamplePoints {
+			threshold = maxDownsamplePoints
+		}
+		return lttb(history, threshold)
+	}
+
+	// Calendar buckets are coarsened until they fit in the maximum number of points
+	span := history[len(history)-1].Time.Sub(history[0].Time)
+	for options.Calendar != "" && span/calendarLength[options.Calendar] >= maxDownsamplePoints {
+		options.Calendar = coarserCalendar[options.Calendar]
+	}
+
+	interval := options.Interval
+	evenSplit := false
+	if options.Calendar == "" {
+		if interval <= 0 {
+			interval = span / time.Duration(options.Points)
+			evenSplit = true
+		} else if span/interval > maxDownsamplePoints {
+			// Too fine an interval would still return an unbounded number of points
+			interval = span / maxDownsamplePoints
+		}
+		if interval <= 0 {
+			return history
+		}
+	}
+
+	key := func(t time.Time) time.Time {
+		if options.Calendar != "" {
+			return bucketStart(t, options.Calendar, loc)
+		}
+		if evenSplit {
+			origin := history[0].Time
+			return origin.Add(t.Sub(origin) / interval * interval)
+		}
+		return t.Truncate(interval)
+	}
+
+	sampled := []HistoryPoint{}
+	var bucket []HistoryPoint
+	flush := func() {
+		if len(bucket) > 0 {
+			sampled = append(sampled, aggregate(bucket, options.Agg, key(bucket[0].Time)))
+		}
+	}
+
+	for _, point := range history {
+		if len(bucket) > 0 && !key(point.Time).Equal(key(bucket[0].Time)) {
+			flush()
+			bucket = nil
+		}
+		bucket = append(bucket, point)
+	}
+	flush()
+
+	return sampled
+}
+
+// aggregate reduces a bucket to one point, min, max and last keep the time of the chosen reading
+func aggregate(bucket []HistoryPoint, agg string, start time.Time) HistoryPoint {
+	switch agg {
+	case AggMin, AggMax:
+		chosen := bucket[0]
+		for _, point := range bucket[1:] {
+			if (agg == AggMin && point.Value < chosen.Value) || (agg == AggMax && point.Value > chosen.Value) {
+				chosen = point
+			}
+		}
+		return chosen
+	case AggLast:
+		return bucket[len(bucket)-1]
+	}
+
+	var sum float64
+	for _, point := range bucket {
+		sum += point.Value
+	}
+	return HistoryPoint{Time: start, Value: sum / float64(len(bucket))}
+}
+
+// lttb selects threshold points with the Largest-Triangle-Three-Buckets algorithm,
+// which keeps the peaks and the shape of the curve
+func lttb(history []HistoryPoint, threshold int) []HistoryPoint {
+	if threshold >= len(history) || threshold < 3 {
+		return history
+	}
+
+	x := func(point HistoryPoint) float64 {
+		return float64(point.Time.Sub(history[0].Time)) / float64(time.Second)
+	}
+
+	sampled := make([]HistoryPoint, 0, threshold)
+	sampled = append(sampled, history[0])
+
+	every := float64(len(history)-2) / float64(threshold-2)
+	selected := 0
+	for i := 0; i < threshold-2; i++ {
+		// Average of the next bucket is the third point of the triangle
+		nextStart := int(math.Floor(float64(i+1)*every)) + 1
+		nextEnd := int(math.Floor(float64(i+2)*every)) + 1
+		if nextEnd > len(history) {
+			nextEnd = len(history)
+		}
+		var avgX, avgY float64
+		for _, point := range history[nextStart:nextEnd] {
+			avgX += x(point)
+			avgY += point.Value
+		}
+		count := float64(nextEnd - nextStart)
+		avgX /= count
+		avgY /= count
+
+		start := int(math.Floor(float64(i)*every)) + 1
+		end := nextStart
+		aX := x(history[selected])
+		aY := history[selected].Value
+
+		maxArea := -1.0
+		next := start
+		for j := start; j < end; j++ {
+			area := math.Abs((aX-avgX)*(history[j].Value-aY) - (aX-x(history[j]))*(avgY-aY))
+			if area > maxArea {
+				maxArea = area
+				next = j
+			}
+		}
+
+		sampled = append(sampled, history[next])
+		selected = next
+	}
+
+	return append(sampled, history[len(history)-1])
+}
+
+// sensorHistoryPoints converts the stored values of a sensor to history points
+func sensorHistoryPoints(values []SensorData) []HistoryPoint {
+	history := []HistoryPoint{}
+	for _, value := range values {
+		v, ok := numericValue(value.Value)
+		if !ok || value.Time == nil {
+			continue
+		}
+		history = append(history, HistoryPoint{Time: *value.Time, Value: v})
+	}
+	return history
+}
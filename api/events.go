@@ -0,0 +1,273 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	EventConsumption = "consumption"
+	EventRefill      = "refill"
+	EventIdle        = "idle"
+)
+
+const (
+	RefillTruck     = "truck"
+	RefillMunicipal = "municipal"
+	RefillRain      = "rain"
+	RefillPump      = "pump"
+)
+
+// Level changes within this fraction of the capacity either way are sensor noise
+const noiseBandFraction = 0.005
+
+// Idle periods up to this long between two consumptions or two refills are pauses of one event
+const eventPauseMinutes = 60
+
+// Refills faster than this (liters per minute) come from a truck delivery
+const truckRefillRate = 20.0
+
+// Refills slower than this (liters per minute) are attributed to rain harvesting
+const rainRefillRate = 0.5
+
+// WaterEvent is a period in which the tank was consumed from, refilled or left idle
+type WaterEvent struct {
+	Type    string     `json:"type" bson:"type"`
+	Source  string     `json:"source,omitempty" bson:"source,omitempty"`
+	Start   *time.Time `json:"start" bson:"start"`
+	End     *time.Time `json:"end" bson:"end"`
+	Liters  float64    `json:"liters" bson:"liters"`
+	Rate    float64    `json:"rate" bson:"rate"`
+	Minutes float64    `json:"minutes" bson:"minutes"`
+}
+
+type EventSummary struct {
+	ConsumedLiters    float64 `json:"consumedLiters" bson:"consumedLiters"`
+	RefilledLiters    float64 `json:"refilledLiters" bson:"refilledLiters"`
+	Refills           int     `json:"refills" bson:"refills"`
+	ConsumptionHours  float64 `json:"consumptionHours" bson:"consumptionHours"`
+	RefillHours       float64 `json:"refillHours" bson:"refillHours"`
+	IdleHours         float64 `json:"idleHours" bson:"idleHours"`
+	HourlyConsumption float64 `json:"hourlyConsumption" bson:"hourlyConsumption"`
+	DailyConsumption  float64 `json:"dailyConsumption" bson:"dailyConsumption"`
+}
+
+// filterNoise removes the sensor jitter from the level history with a dead-band of the
+// same width up and down. The filtered level only moves once the reading is more than the
+// band away from it and then follows it, so slow changes add up until they count and the
+// liters moved either way are kept. The filter starts over after each maintenance gap.
+func filterNoise(levels []WaterLevel, capacity float64) []WaterLevel {
+	band := capacity * noiseBandFraction
+	if band < 1 {
+		band = 1
+	}
+
+	filtered := make([]WaterLevel, len(levels))
+	for i, entry := range levels {
+		filtered[i] = entry
+		if i == 0 || entry.Gap {
+			continue
+		}
+		previous := filtered[i-1].Level
+		switch {
+		case entry.Level > previous+band:
+			filtered[i].Level = entry.Level - band
+		case entry.Level < previous-band:
+			filtered[i].Level = entry.Level + band
+		default:
+			filtered[i].Level = previous
+		}
+	}
+	return filtered
+}
+
+// classifyStep labels the change between two consecutive levels filtered by filterNoise
+func classifyStep(delta float64) string {
+	if delta > 0 {
+		return EventRefill
+	} else if delta < 0 {
+		return EventConsumption
+	}
+	return EventIdle
+}
+
+// refillSource guesses where the water of a refill came from
+func refillSource(event WaterEvent, pumpRuns []PumpRun) string {
+	for _, run := range pumpRuns {
+		end := time.Now()
+		if run.End != nil {
+			end = *run.End
+		}
+		if run.Start.Before(*event.End) && end.After(*event.Start) {
+			return RefillPump
+		}
+	}
+
+	litersPerMinute := event.Rate / 60
+	if litersPerMinute >= truckRefillRate {
+		return RefillTruck
+	} else if litersPerMinute < rainRefillRate {
+		return RefillRain
+	}
+	return RefillMunicipal
+}
+
+// detectEvents splits the level history into consumption, refill and idle periods
+func detectEvents(levels []WaterLevel, settings Settings, pumpRuns []PumpRun) []WaterEvent {
+	// No change is counted across a maintenance period
+	events := []WaterEvent{}
+	for _, segment := range splitAtGaps(levels) {
+		events = append(events, detectSegmentEvents(segment, settings, pumpRuns)...)
+	}
+	return events
+}
+
+// detectSegmentEvents detects the events of a run of readings without gaps
+func detectSegmentEvents(levels []WaterLevel, settings Settings, pumpRuns []PumpRun) []WaterEvent {
+	events := []WaterEvent{}
+	if len(levels) < 2 {
+		return events
+	}
+
+	// Take the ultrasonic jitter out before looking at the steps
+	smoothed := filterNoise(levels, settings.Capacity)
+
+	var current *WaterEvent
+	for i := 0; i < len(smoothed)-1; i++ {
+		delta := smoothed[i+1].Level - smoothed[i].Level
+		kind := classifyStep(delta)
+
+		if current != nil && current.Type == kind {
+			current.End = smoothed[i+1].Timestamp
+			current.Liters += delta
+			continue
+		}
+
+		if current != nil {
+			events = append(events, *current)
+		}
+		current = &WaterEvent{
+			Type:   kind,
+			Start:  smoothed[i].Timestamp,
+			End:    smoothed[i+1].Timestamp,
+			Liters: delta,
+		}
+	}
+	events = append(events, *current)
+	events = mergePauses(events)
+
+	for i := range events {
+		if events[i].Liters < 0 {
+			events[i].Liters = -events[i].Liters
+		}
+		events[i].Minutes = events[i].End.Sub(*events[i].Start).Minutes()
+		if events[i].Minutes > 0 {
+			events[i].Rate = events[i].Liters / (events[i].Minutes / 60)
+		}
+		if events[i].Type == EventRefill {
+			events[i].Source = refillSource(events[i], pumpRuns)
+		}
+	}
+
+	return events
+}
+
+// mergePauses joins the events of the same type separated by a short idle period, a slow
+// refill or consumption only moves the filtered level now and then
+func mergePauses(events []WaterEvent) []WaterEvent {
+	merged := []WaterEvent{}
+	for _, event := range events {
+		n := len(merged)
+		if event.Type != EventIdle && n >= 2 && merged[n-2].Type == event.Type && merged[n-1].Type == EventIdle &&
+			merged[n-1].End.Sub(*merged[n-1].Start).Minutes() <= eventPauseMinutes {
+			merged[n-2].End = event.End
+			merged[n-2].Liters += event.Liters
+			merged = merged[:n-1]
+			continue
+		}
+		merged = append(merged, event)
+	}
+	return merged
+}
+
+// summarizeEvents totals the liters and time spent in each type of event
+func summarizeEvents(events []WaterEvent) EventSummary {
+	var summary EventSummary
+	for _, event := range events {
+		switch event.Type {
+		case EventConsumption:
+			summary.ConsumedLiters += event.Liters
+			summary.ConsumptionHours += event.Minutes / 60
+		case EventRefill:
+			summary.RefilledLiters += event.Liters
+			summary.RefillHours += event.Minutes / 60
+			summary.Refills++
+		case EventIdle:
+			summary.IdleHours += event.Minutes / 60
+		}
+	}
+	if hours := summary.ConsumptionHours + summary.IdleHours; hours > 0 {
+		summary.HourlyConsumption = summary.ConsumedLiters / hours
+		summary.DailyConsumption = summary.HourlyConsumption * 24
+	}
+	return summary
+}
+
+// getTankEvents detects the events in the level history of a tank between from and to
+func getTankEvents(tank Tank, from string, to string) ([]WaterEvent, error) {
+	levels, err := getLevelHistory(tank, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var pumpRuns []PumpRun
+	for _, pump := range getTankPumps(tank) {
+		states, err := getActuatorValues(pump.DeviceID, pump.Actuator.ID)
+		if err != nil {
+			fmt.Println("Error retrieving actuator values:", err)
+			continue
+		}
+		pumpRuns = append(pumpRuns, getPumpRuns(states, time.Now())...)
+	}
+
+	return detectEvents(levels, tank.Meta.Settings, pumpRuns), nil
+}
+
+// GetTankEventsHandler returns the consumption, refill and idle periods of a tank
+func GetTankEventsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, err := getTankEvents(tank, r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		fmt.Println("Error detecting events:", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Optionally keep a single type of event
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		filtered := []WaterEvent{}
+		for _, event := range events {
+			if event.Type == eventType {
+				filtered = append(filtered, event)
+			}
+		}
+		events = filtered
+	}
+
+	log.Printf("[%s] Fetched tank events: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, events)
+}
@@ -0,0 +1,360 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Longest expression accepted, expressions are typed by users
+const maxExpressionLength = 500
+
+// Deepest nesting of an expression
+const maxExpressionDepth = 32
+
+// expression is a parsed arithmetic expression over named variables. Only numbers,
+// variables, + - * / % ^, parentheses and the functions below are understood.
+type expression struct {
+	root      exprNode
+	variables []string
+}
+
+type exprNode interface {
+	eval(lookup func(name string) (float64, error)) (float64, error)
+}
+
+type numberNode float64
+
+type variableNode string
+
+type unaryNode struct {
+	x exprNode
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+// Functions usable in expressions, with their number of arguments (-1 for any)
+var exprFunctions = map[string]int{
+	"abs":   1,
+	"sqrt":  1,
+	"round": 1,
+	"floor": 1,
+	"ceil":  1,
+	"min":   -1,
+	"max":   -1,
+	"clamp": 3,
+}
+
+func (n numberNode) eval(lookup func(string) (float64, error)) (float64, error) {
+	return float64(n), nil
+}
+
+func (n variableNode) eval(lookup func(string) (float64, error)) (float64, error) {
+	return lookup(string(n))
+}
+
+func (n unaryNode) eval(lookup func(string) (float64, error)) (float64, error) {
+	x, err := n.x.eval(lookup)
+	return -x, err
+}
+
+func (n binaryNode) eval(lookup func(string) (float64, error)) (float64, error) {
+	left, err := n.left.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	right, err := n.right.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	case '/':
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return left / right, nil
+	case '%':
+		if right == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Mod(left, right), nil
+	case '^':
+		return math.Pow(left, right), nil
+	}
+	return 0, fmt.Errorf("unknown operator %c", n.op)
+}
+
+func (n callNode) eval(lookup func(string) (float64, error)) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(lookup)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+
+	switch n.name {
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "sqrt":
+		if args[0] < 0 {
+			return 0, fmt.Errorf("square root of a negative number")
+		}
+		return math.Sqrt(args[0]), nil
+	case "round":
+		return math.Round(args[0]), nil
+	case "floor":
+		return math.Floor(args[0]), nil
+	case "ceil":
+		return math.Ceil(args[0]), nil
+	case "min":
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	case "max":
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	case "clamp":
+		return math.Max(args[1], math.Min(args[2], args[0])), nil
+	}
+	return 0, fmt.Errorf("unknown function %s", n.name)
+}
+
+// evaluate computes the expression, looking up its variables by name
+func (e *expression) evaluate(lookup func(name string) (float64, error)) (float64, error) {
+	value, err := e.root.eval(lookup)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("the result is not a number")
+	}
+	return value, nil
+}
+
+type exprParser struct {
+	src       string
+	pos       int
+	depth     int
+	variables map[string]bool
+}
+
+// parseExpression parses an arithmetic expression such as "(capacity - liters) / capacity * 100"
+func parseExpression(src string) (*expression, error) {
+	if len(src) > maxExpressionLength {
+		return nil, fmt.Errorf("expression longer than %d characters", maxExpressionLength)
+	}
+
+	p := &exprParser{src: src, variables: make(map[string]bool)}
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos], p.pos+1)
+	}
+
+	e := &expression{root: root}
+	for name := range p.variables {
+		e.variables = append(e.variables, name)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next character after the spaces, 0 at the end
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{x: x}, nil
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+	return p.parsePower()
+}
+
+// parsePower parses exponents, which group to the right
+func (p *exprParser) parsePower() (exprNode, error) {
+	base, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return binaryNode{op: '^', left: base, right: exponent}, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression nested too deeply")
+	}
+
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos+1)
+		}
+		p.pos++
+		return x, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return numberNode(value), nil
+	case isIdentifierStart(c):
+		start := p.pos
+		for p.pos < len(p.src) && isIdentifierPart(p.src[p.pos]) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() == '(' {
+			return p.parseCall(strings.ToLower(name))
+		}
+		p.variables[name] = true
+		return variableNode(name), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos+1)
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	arity, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	p.pos++
+
+	call := callNode{name: name}
+	if p.peek() != ')' {
+		for {
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("missing ) at position %d", p.pos+1)
+	}
+	p.pos++
+
+	if (arity >= 0 && len(call.args) != arity) || len(call.args) == 0 {
+		return nil, fmt.Errorf("wrong number of arguments to %s", name)
+	}
+	return call, nil
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Dots separate the tank and the variable in references to other tanks
+func isIdentifierPart(c byte) bool {
+	return isIdentifierStart(c) || c >= '0' && c <= '9' || c == '.'
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testLookup(name string) (float64, error) {
+	values := map[string]float64{
+		"liters":            750,
+		"capacity":          1000,
+		"sensor_1":          2,
+		"tank.tank2.liters": 300,
+	}
+	if value, ok := values[name]; ok {
+		return value, nil
+	}
+	return 0, fmt.Errorf("unknown variable %s", name)
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       float64
+		err        string
+	}{
+		{"multiplication before addition", "2 + 3 * 4", 14, ""},
+		{"parentheses", "(2 + 3) * 4", 20, ""},
+		{"subtraction is left associative", "10 - 4 - 3", 3, ""},
+		{"division is left associative", "100 / 10 / 2", 5, ""},
+		{"modulo", "10 % 4", 2, ""},
+		{"power is right associative", "2 ^ 3 ^ 2", 512, ""},
+		{"power before multiplication", "2 * 3 ^ 2", 18, ""},
+		{"unary minus", "-3 + 5", 2, ""},
+		{"unary minus after power", "-2 ^ 2", -4, ""},
+		{"negative exponent", "2 ^ -1", 0.5, ""},
+		{"double unary minus", "--4", 4, ""},
+		{"unary plus", "+4", 4, ""},
+		{"variables", "liters / capacity * 100", 75, ""},
+		{"sensor by id", "sensor_1 * 3", 6, ""},
+		{"other tank", "liters - tank.tank2.liters", 450, ""},
+		{"functions", "max(1, 5, 3) + min(4, 2) + abs(-1) + round(2.5)", 11, ""},
+		{"clamp", "clamp(15, 0, 10)", 10, ""},
+		{"sqrt", "sqrt(16)", 4, ""},
+		{"division by zero", "1 / 0", 0, "division by zero"},
+		{"modulo by zero", "1 % 0", 0, "division by zero"},
+		{"variable division by zero", "liters / (capacity - 1000)", 0, "division by zero"},
+		{"square root of a negative number", "sqrt(-1)", 0, "square root"},
+		{"unknown variable", "volume * 2", 0, "unknown variable volume"},
+		{"not a number", "(-8) ^ 0.5", 0, "not a number"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parseExpression(test.expression)
+			if err != nil {
+				t.Fatalf("parseExpression(%q): %v", test.expression, err)
+			}
+			got, err := e.evaluate(testLookup)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("evaluate(%q) = %v, %v, want an error containing %q", test.expression, got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("evaluate(%q): %v", test.expression, err)
+			}
+			if got != test.want {
+				t.Errorf("evaluate(%q) = %v, want %v", test.expression, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		err        string
+	}{
+		{"empty", "", "unexpected end"},
+		{"missing operand", "1 +", "unexpected end"},
+		{"missing parenthesis", "(1 + 2", "missing )"},
+		{"extra parenthesis", "1 + 2)", "unexpected"},
+		{"unknown character", "1 $ 2", "unexpected"},
+		{"invalid number", "1.2.3", "invalid number"},
+		{"unknown function", "foo(1)", "unknown function foo"},
+		{"too few arguments", "clamp(1, 2)", "wrong number of arguments to clamp"},
+		{"too many arguments", "abs(1, 2)", "wrong number of arguments to abs"},
+		{"no arguments", "max()", "wrong number of arguments to max"},
+		{"too long", strings.Repeat("1+", maxExpressionLength/2) + "1", "longer than"},
+		{"too deep", strings.Repeat("(", maxExpressionDepth+1) + "1" + strings.Repeat(")", maxExpressionDepth+1), "nested too deeply"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseExpression(test.expression)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("parseExpression(%q) = %v, want an error containing %q", test.expression, err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseExpressionLimits(t *testing.T) {
+	longest := strings.Repeat("1+", maxExpressionLength/2-1) + "11"
+	if _, err := parseExpression(longest); err != nil {
+		t.Errorf("expression of %d characters: %v", maxExpressionLength, err)
+	}
+
+	deepest := strings.Repeat("(", maxExpressionDepth-1) + "1" + strings.Repeat(")", maxExpressionDepth-1)
+	if _, err := parseExpression(deepest); err != nil {
+		t.Errorf("expression nested %d times: %v", maxExpressionDepth-1, err)
+	}
+}
+
+func TestExpressionVariables(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       []string
+	}{
+		{"liters / capacity * 100", []string{"capacity", "liters"}},
+		{"liters - tank.tank2.liters", []string{"liters", "tank.tank2.liters"}},
+		{"max(tank.a.percent, tank.b.percent) + tank.a.percent", []string{"tank.a.percent", "tank.b.percent"}},
+		{"round(2.5)", nil},
+	}
+
+	for _, test := range tests {
+		e, err := parseExpression(test.expression)
+		if err != nil {
+			t.Fatalf("parseExpression(%q): %v", test.expression, err)
+		}
+		got := e.variables
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("variables of %q = %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
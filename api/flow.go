@@ -0,0 +1,390 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Sensor kind of the flow meters on the outlet of a tank
+const KindFlowMeter = "FlowMeter"
+
+const (
+	FlowSourceTotalizer = "totalizer"
+	FlowSourceRate      = "rate"
+)
+
+const (
+	FlowOk           = "ok"
+	FlowPossibleLeak = "possible-leak"
+	FlowSensorDrift  = "sensor-drift"
+)
+
+// Mismatch between metered and level-derived consumption tolerated by default, in percent
+const defaultFlowMismatchPercent = 15.0
+
+// Smallest mismatch reported, in liters, below it the level sensor noise dominates
+const minFlowMismatchLiters = 50.0
+
+// Flow rates further apart than this are not integrated into a volume
+const maxFlowGap = time.Hour
+
+// Days of flow totals returned when no range is given
+const defaultFlowDays = 7
+
+// Liters per unit of the totalizer units
+var flowTotalUnits = map[string]float64{
+	"l":      1,
+	"liters": 1,
+	"litres": 1,
+	"m3":     1000,
+	"m³":     1000,
+	"gal":    3.785,
+}
+
+// Liters per minute of one unit of the rate units
+var flowRateUnits = map[string]float64{
+	"l/s":   60,
+	"l/min": 1,
+	"l/h":   1.0 / 60,
+	"m3/h":  1000.0 / 60,
+	"m³/h":  1000.0 / 60,
+	"gpm":   3.785,
+}
+
+// FlowSettings configures the flow meter of a tank. Counters without a volume unit,
+// like pulse counters, are scaled by LitersPerUnit. Rollover is the value after which
+// the counter restarts from zero.
+type FlowSettings struct {
+	LitersPerUnit   float64 `json:"litersPerUnit" bson:"litersPerUnit"`
+	Rollover        float64 `json:"rollover" bson:"rollover"`
+	MismatchPercent float64 `json:"mismatchPercent" bson:"mismatchPercent"`
+	NotifyMismatch  bool    `json:"notifyMismatch" bson:"notifyMismatch"`
+}
+
+type FlowDay struct {
+	Date        string  `json:"date" bson:"date"`
+	Liters      float64 `json:"liters" bson:"liters"`
+	LevelLiters float64 `json:"levelLiters" bson:"levelLiters"`
+	Difference  float64 `json:"difference" bson:"difference"`
+}
+
+// FlowSummary compares the metered outflow of a tank with the consumption derived from
+// its level. More water leaving the tank than metered points to a leak before the meter,
+// more metered than the level shows points to drift of one of the sensors.
+type FlowSummary struct {
+	Source            string    `json:"source" bson:"source"`
+	TotalLiters       float64   `json:"totalLiters" bson:"totalLiters"`
+	RateLitersPerMin  *float64  `json:"rateLitersPerMin" bson:"rateLitersPerMin"`
+	LevelLiters       float64   `json:"levelLiters" bson:"levelLiters"`
+	Difference        float64   `json:"difference" bson:"difference"`
+	DifferencePercent float64   `json:"differencePercent" bson:"differencePercent"`
+	Status            string    `json:"status" bson:"status"`
+	Days              []FlowDay `json:"days" bson:"days"`
+}
+
+// Date of the last mismatch notification and time of the last check, by tank
+var flowNotified = make(map[string]string)
+var flowCheckedAt = make(map[string]time.Time)
+var flowLock sync.Mutex
+
+func (s FlowSettings) mismatchPercent() float64 {
+	if s.MismatchPercent > 0 {
+		return s.MismatchPercent
+	}
+	return defaultFlowMismatchPercent
+}
+
+// totalizerScale returns the liters per unit of a totalizer
+func (s FlowSettings) totalizerScale(unit string) float64 {
+	if scale, ok := flowTotalUnits[strings.ToLower(unit)]; ok {
+		return scale
+	}
+	if s.LitersPerUnit > 0 {
+		return s.LitersPerUnit
+	}
+	return 1
+}
+
+// isFlowRate tells whether a flow meter sensor reports a rate rather than a running total
+func isFlowRate(sensor SensorData) bool {
+	_, ok := flowRateUnits[strings.ToLower(sensor.Meta.Unit)]
+	return ok
+}
+
+// flowIncrements turns the readings of a totalizer into the volume metered since the previous
+// reading. A counter that goes down wrapped around at the rollover, or was reset when it was not near it.
+func flowIncrements(history []HistoryPoint, rollover float64, scale float64) []HistoryPoint {
+	increments := []HistoryPoint{}
+	for i := 1; i < len(history); i++ {
+		previous, current := history[i-1].Value, history[i].Value
+		delta := current - previous
+		if delta < 0 {
+			if rollover > 0 && previous > rollover/2 {
+				delta = rollover - previous + current
+			} else {
+				delta = current
+			}
+		}
+		increments = append(increments, HistoryPoint{Time: history[i].Time, Value: delta * scale})
+	}
+	return increments
+}
+
+// rateIncrements integrates flow rates in liters per minute into volumes between readings
+func rateIncrements(history []HistoryPoint) []HistoryPoint {
+	increments := []HistoryPoint{}
+	for i := 1; i < len(history); i++ {
+		gap := history[i].Time.Sub(history[i-1].Time)
+		if gap <= 0 || gap > maxFlowGap {
+			continue
+		}
+		liters := (history[i-1].Value + history[i].Value) / 2 * gap.Minutes()
+		increments = append(increments, HistoryPoint{Time: history[i].Time, Value: liters})
+	}
+	return increments
+}
+
+// getFlowIncrements returns the metered volumes of a tank, preferring a totalizer over a rate
+// sensor, and the latest flow rate. The source is empty when the tank has no flow meter.
+func getFlowIncrements(tank Tank, from string, to string) ([]HistoryPoint, string, *float64, error) {
+	var totalizer, rate *SensorData
+	for i, sensor := range tank.Sensors {
+		if sensor.Meta.Kind != KindFlowMeter {
+			continue
+		}
+		if isFlowRate(sensor) {
+			if rate == nil {
+				rate = &tank.Sensors[i]
+			}
+		} else if totalizer == nil {
+			totalizer = &tank.Sensors[i]
+		}
+	}
+
+	var currentRate *float64
+	if rate != nil {
+		if value, ok := numericValue(rate.Value); ok {
+			value *= flowRateUnits[strings.ToLower(rate.Meta.Unit)]
+			currentRate = &value
+		}
+	}
+
+	settings := tank.Meta.FlowSettings
+	switch {
+	case totalizer != nil:
+		values, err := getSensorValues(tank.ID, totalizer.ID, from, to)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		history := sensorHistoryPoints(values)
+		sort.SliceStable(history, func(i, j int) bool {
+			return history[i].Time.Before(history[j].Time)
+		})
+		increments := flowIncrements(history, settings.Rollover, settings.totalizerScale(totalizer.Meta.Unit))
+
+		// Without a rate sensor the rate is the one of the last two readings
+		if currentRate == nil && len(increments) > 0 {
+			last := increments[len(increments)-1]
+			minutes := last.Time.Sub(history[len(history)-2].Time).Minutes()
+			if minutes > 0 {
+				value := last.Value / minutes
+				currentRate = &value
+			}
+		}
+		return increments, FlowSourceTotalizer, currentRate, nil
+	case rate != nil:
+		values, err := getSensorValues(tank.ID, rate.ID, from, to)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		scale := flowRateUnits[strings.ToLower(rate.Meta.Unit)]
+		history := sensorHistoryPoints(values)
+		for i := range history {
+			history[i].Value *= scale
+		}
+		sort.SliceStable(history, func(i, j int) bool {
+			return history[i].Time.Before(history[j].Time)
+		})
+		return rateIncrements(history), FlowSourceRate, currentRate, nil
+	}
+	return nil, "", nil, nil
+}
+
+// getFlowSummary reconciles the metered outflow with the level-derived consumption day by day,
+// only the days with readings of both sensors are compared. Nil when the tank has no flow meter.
+func getFlowSummary(tank Tank, levels []WaterLevel, from time.Time, to time.Time) (*FlowSummary, error) {
+	increments, source, rate, err := getFlowIncrements(tank, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil || source == "" {
+		return nil, err
+	}
+
+	loc := tankLocation(tank)
+	rollups, err := getRollups(levels, tank.Meta.Settings, IntervalDay, from, to, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	metered := make(map[int64]float64)
+	readings := make(map[int64]bool)
+	for _, increment := range increments {
+		day := bucketStart(increment.Time, IntervalDay, loc).Unix()
+		metered[day] += increment.Value
+		readings[day] = true
+	}
+
+	summary := FlowSummary{
+		Source:           source,
+		RateLitersPerMin: rate,
+		Days:             []FlowDay{},
+	}
+	var comparedFlow float64
+	for _, rollup := range rollups {
+		liters := metered[rollup.Start.Unix()]
+		day := FlowDay{
+			Date:        rollup.Start.Format("2006-01-02"),
+			Liters:      math.Round(liters),
+			LevelLiters: math.Round(rollup.ConsumedLiters),
+		}
+		day.Difference = day.LevelLiters - day.Liters
+		summary.Days = append(summary.Days, day)
+		summary.TotalLiters += liters
+
+		if rollup.Readings > 0 && readings[rollup.Start.Unix()] {
+			comparedFlow += liters
+			summary.LevelLiters += rollup.ConsumedLiters
+		}
+	}
+
+	summary.TotalLiters = math.Round(summary.TotalLiters)
+	summary.LevelLiters = math.Round(summary.LevelLiters)
+	summary.Difference = summary.LevelLiters - math.Round(comparedFlow)
+	if comparedFlow > 0 {
+		summary.DifferencePercent = math.Round(summary.Difference/comparedFlow*1000) / 10
+	}
+
+	tolerance := math.Max(minFlowMismatchLiters, comparedFlow*tank.Meta.FlowSettings.mismatchPercent()/100)
+	switch {
+	case summary.Difference > tolerance:
+		summary.Status = FlowPossibleLeak
+	case summary.Difference < -tolerance:
+		summary.Status = FlowSensorDrift
+	default:
+		summary.Status = FlowOk
+	}
+	return &summary, nil
+}
+
+// checkFlow compares the metered and level-derived consumption of the last day every hour,
+// and notifies once a day when they do not match
+func checkFlow(tank Tank) {
+	settings := tank.Meta.FlowSettings
+	if !settings.NotifyMismatch || tank.Meta.Settings.Capacity <= 0 {
+		return
+	}
+	if _, ok := findSensor(tank.Sensors, KindFlowMeter); !ok {
+		return
+	}
+
+	now := time.Now()
+	date := now.In(tankLocation(tank)).Format("2006-01-02")
+
+	flowLock.Lock()
+	last, ok := flowCheckedAt[tank.ID]
+	if flowNotified[tank.ID] == date || (ok && now.Sub(last) < time.Hour) {
+		flowLock.Unlock()
+		return
+	}
+	flowCheckedAt[tank.ID] = now
+	flowLock.Unlock()
+
+	from := now.Add(-24 * time.Hour)
+	levels, err := getLevelHistory(tank, from.Format(time.RFC3339), "")
+	if err != nil {
+		fmt.Println("Error retrieving water level history:", err)
+		return
+	}
+	summary, err := getFlowSummary(tank, levels, from, now)
+	if err != nil {
+		fmt.Println("Error reconciling flow meter:", err)
+		return
+	}
+	if summary == nil || summary.Status == FlowOk {
+		return
+	}
+
+	flowLock.Lock()
+	flowNotified[tank.ID] = date
+	flowLock.Unlock()
+
+	var title, body string
+	if summary.Status == FlowPossibleLeak {
+		title = fmt.Sprintf("Possible leak at %s", tank.Name)
+		body = fmt.Sprintf("The level of %s dropped by %d liters more than its flow meter measured over the last day. Check the tank and the pipes before the meter for leaks.",
+			tank.Name, int(summary.Difference))
+	} else {
+		title = fmt.Sprintf("Flow meter of %s does not match its level", tank.Name)
+		body = fmt.Sprintf("The flow meter of %s measured %d liters more than the level dropped over the last day. One of the sensors may be drifting.",
+			tank.Name, int(-summary.Difference))
+	}
+	notifyTank(tank, title, body, PriorityMedium)
+}
+
+// GetFlowHandler returns the daily metered outflow of a tank reconciled with its level
+func GetFlowHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	loc := tankLocation(tank)
+	to := time.Now()
+	from := to.AddDate(0, 0, -defaultFlowDays)
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+	from = bucketStart(from, IntervalDay, loc)
+
+	levels, err := getLevelHistory(tank, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		fmt.Println("Error retrieving water level history:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	summary, err := getFlowSummary(tank, levels, from, to)
+	if err != nil {
+		fmt.Println("Error reconciling flow meter:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if summary == nil {
+		http.Error(w, "no flow meter on this tank", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("[%s] Fetched flow meter totals: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, summary)
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Days of history used to learn the consumption profile
+const forecastHistoryDays = 28
+
+// Furthest point the level is projected to, in hours
+const forecastHorizonHours = 24 * 60
+
+// Smoothing factor of the seasonal consumption profile
+const forecastAlpha = 0.3
+
+// z-score of the 80% prediction interval
+const forecastZ = 1.28
+
+// Reserve level used when neither the forecast settings nor the sensor alerts define one
+const defaultReservePercent = 20.0
+
+// Readings further apart than this leave a gap in the hourly consumption
+const maxForecastGap = 2 * time.Hour
+
+// ForecastSettings configures the time-to-empty forecast of a tank
+type ForecastSettings struct {
+	ReservePercent float64 `json:"reservePercent" bson:"reservePercent"`
+	NotifyHours    float64 `json:"notifyHours" bson:"notifyHours"`
+	Disabled       bool    `json:"disabled" bson:"disabled"`
+}
+
+type ForecastPoint struct {
+	Expected      *time.Time `json:"expected" bson:"expected"`
+	Low           *time.Time `json:"low" bson:"low"`
+	High          *time.Time `json:"high" bson:"high"`
+	ExpectedHours float64    `json:"expectedHours" bson:"expectedHours"`
+	LowHours      float64    `json:"lowHours" bson:"lowHours"`
+	HighHours     float64    `json:"highHours" bson:"highHours"`
+}
+
+type Forecast struct {
+	Method       string         `json:"method" bson:"method"`
+	HourlyRate   float64        `json:"hourlyRate" bson:"hourlyRate"`
+	ReserveLevel float64        `json:"reserveLevel" bson:"reserveLevel"`
+	Empty        *ForecastPoint `json:"empty" bson:"empty"`
+	Reserve      *ForecastPoint `json:"reserve" bson:"reserve"`
+}
+
+type hourlyConsumption struct {
+	Hour   time.Time
+	Liters float64
+}
+
+// Consumption profiles reused by the fleet summary and the alerts, by tank
+type cachedForecast struct {
+	Profile consumptionProfile
+	At      time.Time
+}
+
+var forecastCache = make(map[string]cachedForecast)
+var forecastCacheLock sync.Mutex
+
+// Consumption profiles older than this are learnt again
+const forecastCacheAge = time.Hour
+
+// Last time the forecast was checked and last time a running-out notification was sent, by tank
+var forecastCheckedAt = make(map[string]time.Time)
+var forecastNotifiedAt = make(map[string]time.Time)
+var forecastLock sync.Mutex
+
+// getHourlyConsumption totals the liters consumed in each hour, leaving out refills and gaps
+func getHourlyConsumption(levels []WaterLevel, settings Settings) []hourlyConsumption {
+	buckets := make(map[time.Time]float64)
+	var order []time.Time
+
+	levels = filterNoise(levels, settings.Capacity)
+	for i := 0; i < len(levels)-1; i++ {
+		if levels[i+1].Gap || levels[i+1].Timestamp.Sub(*levels[i].Timestamp) > maxForecastGap {
+			continue
+		}
+		hour := levels[i+1].Timestamp.Truncate(time.Hour)
+		if _, ok := buckets[hour]; !ok {
+			buckets[hour] = 0
+			order = append(order, hour)
+		}
+
+		delta := levels[i+1].Level - levels[i].Level
+		if classifyStep(delta) == EventConsumption {
+			buckets[hour] += -delta
+		}
+	}
+
+	hours := make([]hourlyConsumption, len(order))
+	for i, hour := range order {
+		hours[i] = hourlyConsumption{Hour: hour, Liters: buckets[hour]}
+	}
+	return hours
+}
+
+// consumptionProfile learns the expected consumption per hour of the week (or of the day
+// when there is less than a week of history) with exponential smoothing
+type consumptionProfile struct {
+	Weekly bool
+	Season map[int]float64
+	Mean   float64
+	Sigma  float64
+	loc    *time.Location
+}
+
+func (p consumptionProfile) key(t time.Time) int {
+	local := t.In(p.loc)
+	if p.Weekly {
+		return int(local.Weekday())*24 + local.Hour()
+	}
+	return local.Hour()
+}
+
+func (p consumptionProfile) expected(t time.Time) float64 {
+	if value, ok := p.Season[p.key(t)]; ok {
+		return value
+	}
+	return p.Mean
+}
+
+func learnConsumptionProfile(hours []hourlyConsumption, loc *time.Location) consumptionProfile {
+	profile := consumptionProfile{
+		Season: make(map[int]float64),
+		loc:    loc,
+	}
+	if len(hours) == 0 {
+		return profile
+	}
+
+	profile.Weekly = hours[len(hours)-1].Hour.Sub(hours[0].Hour) >= 7*24*time.Hour
+
+	var total float64
+	for _, hour := range hours {
+		total += hour.Liters
+		key := profile.key(hour.Hour)
+		if previous, ok := profile.Season[key]; ok {
+			profile.Season[key] = forecastAlpha*hour.Liters + (1-forecastAlpha)*previous
+		} else {
+			profile.Season[key] = hour.Liters
+		}
+	}
+	profile.Mean = total / float64(len(hours))
+
+	var squares float64
+	for _, hour := range hours {
+		residual := hour.Liters - profile.expected(hour.Hour)
+		squares += residual * residual
+	}
+	profile.Sigma = math.Sqrt(squares / float64(len(hours)))
+
+	return profile
+}
+
+// reserveLevel returns the liters below which the tank is considered to be on its reserve
+func reserveLevel(tank Tank) float64 {
+	percent := tank.Meta.ForecastSettings.ReservePercent
+	if percent <= 0 {
+		if sensor, ok := levelSensor(tank); ok && sensor.Meta.CriticalMin > 0 {
+			percent = sensor.Meta.CriticalMin
+		} else {
+			percent = defaultReservePercent
+		}
+	}
+	return tank.Meta.Settings.Capacity * percent / 100
+}
+
+// projectLevel walks the profile forward from now and returns when the level reaches the target
+func projectLevel(profile consumptionProfile, current float64, target float64, now time.Time) *ForecastPoint {
+	point := &ForecastPoint{}
+	if current <= target {
+		point.Expected = &now
+		point.Low = &now
+		point.High = &now
+		return point
+	}
+
+	var cumulative float64
+	for n := 1; n <= forecastHorizonHours; n++ {
+		t := now.Add(time.Duration(n) * time.Hour)
+		cumulative += profile.expected(t)
+		spread := forecastZ * profile.Sigma * math.Sqrt(float64(n))
+
+		hours := float64(n)
+		at := t
+		if point.Low == nil && current-(cumulative+spread) <= target {
+			point.Low = &at
+			point.LowHours = hours
+		}
+		if point.Expected == nil && current-cumulative <= target {
+			point.Expected = &at
+			point.ExpectedHours = hours
+		}
+		if point.High == nil && current-math.Max(cumulative-spread, 0) <= target {
+			point.High = &at
+			point.HighHours = hours
+			break
+		}
+	}
+
+	// The target is not reached within the horizon
+	if point.Expected == nil {
+		return nil
+	}
+	return point
+}
+
+// getTankProfile learns the consumption profile of the tank from its recent history
+func getTankProfile(tank Tank) (consumptionProfile, error) {
+	from := time.Now().AddDate(0, 0, -forecastHistoryDays).Format(time.RFC3339)
+	levels, err := getLevelHistory(tank, from, "")
+	if err != nil {
+		return consumptionProfile{}, err
+	}
+	return learnConsumptionProfile(getHourlyConsumption(levels, tank.Meta.Settings), tankLocation(tank)), nil
+}
+
+// getForecast projects when the tank will be empty and when it will reach its reserve
+func getForecast(tank Tank, current float64) (Forecast, error) {
+	profile, err := getTankProfile(tank)
+	if err != nil {
+		return Forecast{ReserveLevel: reserveLevel(tank)}, err
+	}
+	return projectForecast(tank, profile, current), nil
+}
+
+// projectForecast projects the current level forward with the consumption profile
+func projectForecast(tank Tank, profile consumptionProfile, current float64) Forecast {
+	forecast := Forecast{
+		ReserveLevel: reserveLevel(tank),
+	}
+
+	forecast.HourlyRate = profile.Mean
+	if profile.Weekly {
+		forecast.Method = "hour-of-week"
+	} else {
+		forecast.Method = "hour-of-day"
+	}
+	if profile.Mean <= 0 {
+		return forecast
+	}
+
+	now := time.Now()
+	forecast.Empty = projectLevel(profile, current, 0, now)
+	forecast.Reserve = projectLevel(profile, current, forecast.ReserveLevel, now)
+
+	return forecast
+}
+
+// getCachedForecast projects the current level with the consumption profile of the tank,
+// the profile is learnt again once it is an hour old
+func getCachedForecast(tank Tank, current float64) (Forecast, error) {
+	forecastCacheLock.Lock()
+	cached, ok := forecastCache[tank.ID]
+	forecastCacheLock.Unlock()
+	if ok && time.Since(cached.At) < forecastCacheAge {
+		return projectForecast(tank, cached.Profile, current), nil
+	}
+
+	profile, err := getTankProfile(tank)
+	if err != nil {
+		return Forecast{ReserveLevel: reserveLevel(tank)}, err
+	}
+
+	forecastCacheLock.Lock()
+	forecastCache[tank.ID] = cachedForecast{Profile: profile, At: time.Now()}
+	forecastCacheLock.Unlock()
+
+	return projectForecast(tank, profile, current), nil
+}
+
+// checkForecast warns ahead of time when the tank is expected to reach its reserve
+func checkForecast(tank Tank) {
+	settings := tank.Meta.ForecastSettings
+	if settings.Disabled || tank.Meta.Settings.Capacity <= 0 {
+		return
+	}
+
+	notifyHours := settings.NotifyHours
+	if notifyHours <= 0 {
+		notifyHours = 48
+	}
+
+	// Forecast at most once an hour and warn at most once a day
+	now := time.Now()
+	forecastLock.Lock()
+	checked, checkedOk := forecastCheckedAt[tank.ID]
+	notified, notifiedOk := forecastNotifiedAt[tank.ID]
+	if (checkedOk && now.Sub(checked) < time.Hour) || (notifiedOk && now.Sub(notified) < 24*time.Hour) {
+		forecastLock.Unlock()
+		return
+	}
+	forecastCheckedAt[tank.ID] = now
+	forecastLock.Unlock()
+
+	sensor, found := levelSensor(tank)
+	if !found {
+		return
+	}
+	distance, valid := numericValue(sensor.Value)
+	if !valid {
+		return
+	}
+	current := currentLiters(tank, distance)
+
+	forecast, err := getCachedForecast(tank, current)
+	if err != nil {
+		fmt.Println("Error forecasting water level:", err)
+		return
+	}
+
+	// Already on reserve, the low level alerts take over
+	if forecast.Reserve == nil || forecast.Reserve.ExpectedHours <= 0 || forecast.Reserve.ExpectedHours > notifyHours {
+		return
+	}
+
+	forecastLock.Lock()
+	forecastNotifiedAt[tank.ID] = now
+	forecastLock.Unlock()
+
+	loc := tankLocation(tank)
+	title := fmt.Sprintf("%s is running out %s", tank.Name, forecast.Reserve.Expected.In(loc).Format("Monday"))
+	body := fmt.Sprintf("At the usual consumption %s will reach its reserve around %s (between %s and %s).",
+		tank.Name,
+		forecast.Reserve.Expected.In(loc).Format("Monday 15:04"),
+		forecast.Reserve.Low.In(loc).Format("Monday 15:04"),
+		forecastBound(forecast.Reserve.High, loc))
+	notifyTank(tank, title, body, PriorityMedium)
+}
+
+func forecastBound(t *time.Time, loc *time.Location) string {
+	if t == nil {
+		return "later"
+	}
+	return t.In(loc).Format("Monday 15:04")
+}
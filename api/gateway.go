@@ -169,6 +169,17 @@ func updateGatewayProfile(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	// The technicians unlock tanks in maintenance mode, only a signed in gateway user lists them
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(body, &fields); err != nil {
+		http.Error(w, "invalid gateway profile", http.StatusBadRequest)
+		return
+	}
+	if _, ok := fields["technicians"]; ok && requestUser(r) == "" {
+		http.Error(w, "sign in to the gateway to change the technicians", http.StatusUnauthorized)
+		return
+	}
 	
 	// Send a POST request to localhost/device/meta
 	client := http.DefaultClient
@@ -0,0 +1,578 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Prefix of the ID of the virtual tank of a group
+const groupTankPrefix = "group-"
+
+// Height of the virtual tank, its level sensor reports the empty part of the group in percent
+const groupTankHeight = 100.0
+
+// TankGroup is a set of interconnected tanks acting as one reservoir,
+// the thresholds are percentages of the total capacity
+type TankGroup struct {
+	ID          string   `json:"id" bson:"id"`
+	Name        string   `json:"name" bson:"name"`
+	TankIDs     []string `json:"tankIDs" bson:"tankIDs"`
+	LowPercent  float64  `json:"lowPercent" bson:"lowPercent"`
+	HighPercent float64  `json:"highPercent" bson:"highPercent"`
+}
+
+type GroupStatus struct {
+	TankGroup
+	Capacity float64       `json:"capacity"`
+	Liters   float64       `json:"liters"`
+	Percent  float64       `json:"percent"`
+	Alerts   []string      `json:"alerts"`
+	Tanks    []TankSummary `json:"tanks"`
+	Missing  []string      `json:"missingLevel"`
+}
+
+// Level of the last group alert ("low" or "high"), by group
+var groupNotified = make(map[string]string)
+var groupNotifiedLock sync.Mutex
+
+// Minutes between two checks of the groups of a tank
+const groupCheckMinutes = 5
+
+// Last time the groups of a tank were checked, by tank
+var groupCheckedAt = make(map[string]time.Time)
+
+// getTankGroups returns the groups stored in the gateway profile
+func getTankGroups() ([]TankGroup, error) {
+	var gateway struct {
+		TankGroups []TankGroup `json:"tankGroups"`
+	}
+	if err := getGatewayMeta(&gateway); err != nil {
+		return nil, err
+	}
+	if gateway.TankGroups == nil {
+		return []TankGroup{}, nil
+	}
+	return gateway.TankGroups, nil
+}
+
+func saveTankGroups(groups []TankGroup) error {
+	return postGatewayMeta(map[string]interface{}{"tankGroups": groups})
+}
+
+// getGroupStatus aggregates the members of the group from the device list
+func getGroupStatus(group TankGroup, devices map[string]Tank, now time.Time) GroupStatus {
+	status := GroupStatus{
+		TankGroup: group,
+		Alerts:    []string{},
+		Tanks:     []TankSummary{},
+		Missing:   []string{},
+	}
+
+	for _, tankID := range group.TankIDs {
+		tank, ok := devices[tankID]
+		if !ok {
+			continue
+		}
+		summary := summarizeTank(tank, devices, defaultOfflineMinutes*time.Minute, now)
+		summary.updateStatus()
+		status.Tanks = append(status.Tanks, summary)
+
+		// A member without a reading would count as empty and drag the group level down
+		sensor, ok := levelSensor(tank)
+		if _, read := numericValue(sensor.Value); !ok || !read {
+			status.Missing = append(status.Missing, tankID)
+			continue
+		}
+		status.Capacity += summary.Capacity
+		status.Liters += summary.Liters
+	}
+
+	if status.Capacity > 0 {
+		status.Percent = status.Liters / status.Capacity * 100
+		if group.LowPercent > 0 && status.Percent <= group.LowPercent {
+			status.Alerts = append(status.Alerts, AlertLowLevel)
+		} else if group.HighPercent > 0 && status.Percent >= group.HighPercent {
+			status.Alerts = append(status.Alerts, AlertHighLevel)
+		}
+	}
+
+	return status
+}
+
+// groupTank presents the group as a virtual tank with the shape of a gateway device
+func groupTank(status GroupStatus, devices map[string]Tank) Tank {
+	tank := Tank{
+		ID:        groupTankPrefix + status.ID,
+		Name:      status.Name,
+		Sensors:   []SensorData{},
+		Actuators: []ActuatorData{},
+	}
+	tank.Meta.Settings = Settings{
+		Height:   groupTankHeight,
+		Capacity: status.Capacity,
+	}
+
+	var latest *time.Time
+	var temperatures []float64
+	var pollutant *float64
+	for _, tankID := range status.TankIDs {
+		member, ok := devices[tankID]
+		if !ok {
+			continue
+		}
+		if tank.Created.IsZero() || member.Created.Before(tank.Created) {
+			tank.Created = member.Created
+		}
+		if member.Modified.After(tank.Modified) {
+			tank.Modified = member.Modified
+		}
+		if tank.Meta.Location.Address == "" {
+			tank.Meta.Location = member.Meta.Location
+		}
+		if seen := lastSeen(member); seen != nil && (latest == nil || seen.After(*latest)) {
+			latest = seen
+		}
+
+		for _, sensor := range member.Sensors {
+			value, ok := numericValue(sensor.Value)
+			if !ok {
+				continue
+			}
+			switch sensor.Meta.Kind {
+			case "WaterThermometer":
+				temperatures = append(temperatures, value)
+			case "WaterPollutantSensor":
+				// The group is as good as its worst tank
+				if pollutant == nil || value > *pollutant {
+					v := value
+					pollutant = &v
+				}
+			}
+		}
+		for _, actuator := range member.Actuators {
+			if actuator.ActuatorMeta.Kind == "Motor" {
+				tank.Actuators = append(tank.Actuators, actuator)
+			}
+		}
+	}
+
+	// The level sensor reads the distance to the water of a 100 cm tall tank holding the whole group
+	tank.Sensors = append(tank.Sensors, SensorData{
+		ID:   "waterlevel",
+		Name: "Water level",
+		Time: latest,
+		Meta: SensorMeta{
+			Kind:        "WaterLevel",
+			Unit:        "cm",
+			CriticalMin: status.LowPercent,
+			CriticalMax: status.HighPercent,
+		},
+		Value: groupTankHeight - status.Percent,
+	})
+
+	if len(temperatures) > 0 {
+		var sum float64
+		for _, temperature := range temperatures {
+			sum += temperature
+		}
+		tank.Sensors = append(tank.Sensors, SensorData{
+			ID:    "watertemperature",
+			Name:  "Water temperature",
+			Time:  latest,
+			Meta:  SensorMeta{Kind: "WaterThermometer", Unit: "°C"},
+			Value: sum / float64(len(temperatures)),
+		})
+	}
+	if pollutant != nil {
+		tank.Sensors = append(tank.Sensors, SensorData{
+			ID:    "waterquality",
+			Name:  "Water quality",
+			Time:  latest,
+			Meta:  SensorMeta{Kind: "WaterPollutantSensor", Unit: "ppm"},
+			Value: *pollutant,
+		})
+	}
+
+	return tank
+}
+
+// sumLevels adds up the level histories of the tanks of a group, at each reading of a tank
+// the others count with their last level. A gap in any tank is a gap of the group.
+func sumLevels(histories [][]WaterLevel) []WaterLevel {
+	type reading struct {
+		tank  int
+		entry WaterLevel
+	}
+	var readings []reading
+	current := make([]float64, len(histories))
+	for i, levels := range histories {
+		if len(levels) == 0 {
+			continue
+		}
+		// Until its first reading a tank counts with it
+		current[i] = levels[0].Level
+		for _, entry := range levels {
+			readings = append(readings, reading{tank: i, entry: entry})
+		}
+	}
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].entry.Timestamp.Before(*readings[j].entry.Timestamp)
+	})
+
+	var sum []WaterLevel
+	for i := 0; i < len(readings); {
+		// Readings taken at the same time are applied together
+		at := readings[i].entry.Timestamp
+		gap := false
+		for ; i < len(readings) && readings[i].entry.Timestamp.Equal(*at); i++ {
+			current[readings[i].tank] = readings[i].entry.Level
+			gap = gap || readings[i].entry.Gap
+		}
+
+		var total float64
+		for _, level := range current {
+			total += level
+		}
+		sum = append(sum, WaterLevel{Level: total, Timestamp: at, Gap: gap})
+	}
+	return sum
+}
+
+// getGroupAnalytics detects the consumption of the group on the summed level of its tanks,
+// water moving from one tank to another is neither consumed nor refilled
+func getGroupAnalytics(status GroupStatus, devices map[string]Tank, from string, to string) Analytics {
+	var analytics Analytics
+	var histories [][]WaterLevel
+	for _, tankID := range status.TankIDs {
+		member, ok := devices[tankID]
+		if !ok {
+			continue
+		}
+
+		levels, err := getLevelHistory(member, from, to)
+		if err != nil {
+			fmt.Println("Error retrieving water level history:", err)
+			continue
+		}
+		histories = append(histories, levels)
+	}
+
+	levels := sumLevels(histories)
+	events := detectEvents(levels, Settings{Capacity: status.Capacity}, nil)
+	analytics.Events = summarizeEvents(events)
+
+	// The trend and averages are computed like the ones of a tank
+	var consumption []Consumption
+	for _, segment := range splitAtGaps(levels) {
+		consumption = append(consumption, getConsumption(getMovingAverage(segment, 2))...)
+	}
+	if len(consumption) > 2 {
+		analytics.Trend = getTrend(consumption)
+		analytics.Average.Daily = getConsumptionAverage(consumption, "days")
+		analytics.Average.Hourly = getConsumptionAverage(consumption, "hrs")
+		analytics.DurationLeft = getDurationLeft(consumption, status.Liters)
+	}
+	return analytics
+}
+
+// checkGroups alerts when a group containing the tank crosses its thresholds
+func checkGroups(tank Tank) {
+	now := time.Now()
+	groupNotifiedLock.Lock()
+	if last, ok := groupCheckedAt[tank.ID]; ok && now.Sub(last) < groupCheckMinutes*time.Minute {
+		groupNotifiedLock.Unlock()
+		return
+	}
+	groupCheckedAt[tank.ID] = now
+	groupNotifiedLock.Unlock()
+
+	groups, err := getTankGroups()
+	if err != nil || len(groups) == 0 {
+		return
+	}
+
+	var memberOf []TankGroup
+	for _, group := range groups {
+		for _, tankID := range group.TankIDs {
+			if tankID == tank.ID {
+				memberOf = append(memberOf, group)
+				break
+			}
+		}
+	}
+	if len(memberOf) == 0 {
+		return
+	}
+
+	devices, err := getTanks()
+	if err != nil {
+		fmt.Println("Error retrieving tanks:", err)
+		return
+	}
+	byID := make(map[string]Tank)
+	for _, device := range devices {
+		byID[device.ID] = device
+	}
+
+	for _, group := range memberOf {
+		status := getGroupStatus(group, byID, now)
+
+		level := ""
+		if len(status.Alerts) > 0 {
+			level = status.Alerts[0]
+		}
+
+		groupNotifiedLock.Lock()
+		previous := groupNotified[group.ID]
+		groupNotified[group.ID] = level
+		groupNotifiedLock.Unlock()
+
+		if level == "" || level == previous {
+			continue
+		}
+
+		var title string
+		if level == AlertLowLevel {
+			title = fmt.Sprintf("%s is almost empty", group.Name)
+		} else {
+			title = fmt.Sprintf("%s is almost filled", group.Name)
+		}
+		body := fmt.Sprintf("Water level for the %s tanks is at %d%% (%d of %d liters)",
+			group.Name, int(status.Percent), int(status.Liters), int(status.Capacity))
+		notifyTank(tank, title, body, PriorityHigh)
+	}
+}
+
+// loadGroup returns the group of the request with the devices of the gateway
+func loadGroup(groupID string) (TankGroup, map[string]Tank, error) {
+	groups, err := getTankGroups()
+	if err != nil {
+		return TankGroup{}, nil, err
+	}
+
+	for _, group := range groups {
+		if group.ID == groupID {
+			devices, err := getTanks()
+			if err != nil {
+				return group, nil, err
+			}
+			byID := make(map[string]Tank)
+			for _, device := range devices {
+				byID[device.ID] = device
+			}
+			return group, byID, nil
+		}
+	}
+	return TankGroup{}, nil, nil
+}
+
+// decodeGroup reads and checks a group from the request body
+func decodeGroup(r *http.Request) (TankGroup, error) {
+	var group TankGroup
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return group, err
+	}
+	if err = json.Unmarshal(body, &group); err != nil {
+		return group, err
+	}
+	if group.Name == "" || len(group.TankIDs) == 0 {
+		return group, fmt.Errorf("name and tankIDs are required")
+	}
+	if group.LowPercent < 0 || group.HighPercent < 0 || (group.HighPercent > 0 && group.LowPercent >= group.HighPercent) {
+		return group, fmt.Errorf("lowPercent must be below highPercent")
+	}
+	return group, nil
+}
+
+// GetGroupsHandler lists the tank groups with their aggregated level
+func GetGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	groups, err := getTankGroups()
+	if err != nil {
+		fmt.Println("Error retrieving tank groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	devices, err := getTanks()
+	if err != nil {
+		fmt.Println("Error requesting devices:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	byID := make(map[string]Tank)
+	for _, device := range devices {
+		byID[device.ID] = device
+	}
+
+	now := time.Now()
+	statuses := []GroupStatus{}
+	for _, group := range groups {
+		statuses = append(statuses, getGroupStatus(group, byID, now))
+	}
+
+	log.Printf("[%s] Fetched tank groups: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, statuses)
+}
+
+// PostGroupHandler creates a tank group
+func PostGroupHandler(w http.ResponseWriter, r *http.Request) {
+	group, err := decodeGroup(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groups, err := getTankGroups()
+	if err != nil {
+		fmt.Println("Error retrieving tank groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	group.ID = newID()
+	if err = saveTankGroups(append(groups, group)); err != nil {
+		fmt.Println("Error storing tank groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Tank group created: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, group)
+}
+
+// GetGroupHandler returns the group as a virtual tank, in the same shape as /tanks/{tankID}
+func GetGroupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["groupID"]
+
+	group, devices, err := loadGroup(groupID)
+	if err != nil {
+		fmt.Println("Error retrieving tank group:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if group.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := getGroupStatus(group, devices, time.Now())
+
+	log.Printf("[%s] Fetched tank group %s: %s %s", time.Now().Format(time.RFC3339), groupID, r.Method, r.URL.Path)
+
+	writeJSON(w, groupTank(status, devices))
+}
+
+// GetGroupAnalyticsHandler returns the summed consumption analytics of the tanks of a group
+func GetGroupAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["groupID"]
+
+	group, devices, err := loadGroup(groupID)
+	if err != nil {
+		fmt.Println("Error retrieving tank group:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if group.ID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := getGroupStatus(group, devices, time.Now())
+	analytics := getGroupAnalytics(status, devices, r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+
+	log.Printf("[%s] Fetched tank group analytics: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, analytics)
+}
+
+// UpdateGroupHandler replaces the name, tanks and thresholds of a group
+func UpdateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["groupID"]
+
+	update, err := decodeGroup(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groups, err := getTankGroups()
+	if err != nil {
+		fmt.Println("Error retrieving tank groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	found := false
+	for i := range groups {
+		if groups[i].ID == groupID {
+			update.ID = groupID
+			groups[i] = update
+			found = true
+			break
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err = saveTankGroups(groups); err != nil {
+		fmt.Println("Error storing tank groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Tank group updated: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, update)
+}
+
+// DeleteGroupHandler removes a tank group, the tanks themselves are kept
+func DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	groupID := vars["groupID"]
+
+	groups, err := getTankGroups()
+	if err != nil {
+		fmt.Println("Error retrieving tank groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	remaining := []TankGroup{}
+	for _, group := range groups {
+		if group.ID != groupID {
+			remaining = append(remaining, group)
+		}
+	}
+	if len(remaining) == len(groups) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err = saveTankGroups(remaining); err != nil {
+		fmt.Println("Error storing tank groups:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Tank group deleted: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Tank group deleted",
+	})
+}
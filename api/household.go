@@ -0,0 +1,335 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WHO guidance on domestic water: about 20 liters per person per day for basic access
+// and 50 liters or more for intermediate access covering basic hygiene
+const (
+	whoMinimumPerPerson = 20.0
+	whoTargetPerPerson  = 50.0
+)
+
+// Days of daily usage reported when no range is given
+const defaultHouseholdDays = 7
+
+// Typical daily drinking water of livestock, in liters per animal
+var livestockLitersPerDay = map[string]float64{
+	"cattle":  40,
+	"dairy":   80,
+	"goat":    5,
+	"sheep":   5,
+	"pig":     15,
+	"camel":   30,
+	"donkey":  20,
+	"poultry": 0.3,
+}
+
+// Watering of a garden without a configured rate, in liters per square meter per day
+const defaultGardenLitersPerM2 = 4.0
+
+const (
+	UsageBelowMinimum = "below-minimum"
+	UsageBelowTarget  = "below-target"
+	UsageOk           = "ok"
+	UsageUnknown      = "unknown"
+)
+
+type Livestock struct {
+	Kind         string  `json:"kind" bson:"kind"`
+	Count        int     `json:"count" bson:"count"`
+	LitersPerDay float64 `json:"litersPerDay" bson:"litersPerDay"`
+}
+
+type Garden struct {
+	Name              string  `json:"name" bson:"name"`
+	AreaM2            float64 `json:"areaM2" bson:"areaM2"`
+	LitersPerM2PerDay float64 `json:"litersPerM2PerDay" bson:"litersPerM2PerDay"`
+}
+
+// Household describes who draws water from a tank, the per-person figures leave out
+// the allowance of the livestock and gardens
+type Household struct {
+	People           int         `json:"people" bson:"people"`
+	Livestock        []Livestock `json:"livestock" bson:"livestock"`
+	Gardens          []Garden    `json:"gardens" bson:"gardens"`
+	MinimumPerPerson float64     `json:"minimumPerPerson" bson:"minimumPerPerson"`
+	TargetPerPerson  float64     `json:"targetPerPerson" bson:"targetPerPerson"`
+	DailyQuota       float64     `json:"dailyQuota" bson:"dailyQuota"`
+	NotifyQuota      bool        `json:"notifyQuota" bson:"notifyQuota"`
+}
+
+type DailyUsage struct {
+	Date           string  `json:"date" bson:"date"`
+	ConsumedLiters float64 `json:"consumedLiters" bson:"consumedLiters"`
+	PerPerson      float64 `json:"perPerson" bson:"perPerson"`
+	Quota          float64 `json:"quota" bson:"quota"`
+	Exceeded       bool    `json:"exceeded" bson:"exceeded"`
+}
+
+// HouseholdUsage is the per-person usage of a tank against the targets
+type HouseholdUsage struct {
+	People           int     `json:"people" bson:"people"`
+	LivestockLiters  float64 `json:"livestockLiters" bson:"livestockLiters"`
+	GardenLiters     float64 `json:"gardenLiters" bson:"gardenLiters"`
+	PerPersonPerDay  float64 `json:"perPersonPerDay" bson:"perPersonPerDay"`
+	MinimumPerPerson float64 `json:"minimumPerPerson" bson:"minimumPerPerson"`
+	TargetPerPerson  float64 `json:"targetPerPerson" bson:"targetPerPerson"`
+	Status           string  `json:"status" bson:"status"`
+	DailyQuota       float64 `json:"dailyQuota" bson:"dailyQuota"`
+}
+
+type HouseholdReport struct {
+	HouseholdUsage
+	Today DailyUsage   `json:"today" bson:"today"`
+	Days  []DailyUsage `json:"days" bson:"days"`
+}
+
+// Date of the last quota notification, by tank
+var quotaNotified = make(map[string]string)
+var quotaCheckedAt = make(map[string]time.Time)
+var quotaLock sync.Mutex
+
+func (h Household) configured() bool {
+	return h.People > 0
+}
+
+// livestockLiters is the daily allowance of the animals
+func (h Household) livestockLiters() float64 {
+	var total float64
+	for _, animals := range h.Livestock {
+		rate := animals.LitersPerDay
+		if rate <= 0 {
+			rate = livestockLitersPerDay[animals.Kind]
+		}
+		total += rate * float64(animals.Count)
+	}
+	return total
+}
+
+// gardenLiters is the daily watering allowance of the gardens
+func (h Household) gardenLiters() float64 {
+	var total float64
+	for _, garden := range h.Gardens {
+		rate := garden.LitersPerM2PerDay
+		if rate <= 0 {
+			rate = defaultGardenLitersPerM2
+		}
+		total += rate * garden.AreaM2
+	}
+	return total
+}
+
+// quota is the daily budget of the tank, by default the target of each person plus the allowances
+func (h Household) quota() float64 {
+	if h.DailyQuota > 0 {
+		return h.DailyQuota
+	}
+	return float64(h.People)*h.targets().TargetPerPerson + h.livestockLiters() + h.gardenLiters()
+}
+
+func (h Household) targets() HouseholdUsage {
+	usage := HouseholdUsage{
+		MinimumPerPerson: h.MinimumPerPerson,
+		TargetPerPerson:  h.TargetPerPerson,
+	}
+	if usage.MinimumPerPerson <= 0 {
+		usage.MinimumPerPerson = whoMinimumPerPerson
+	}
+	if usage.TargetPerPerson <= 0 {
+		usage.TargetPerPerson = whoTargetPerPerson
+	}
+	return usage
+}
+
+// perPerson splits the liters of a day between the people once the allowances are taken out
+func (h Household) perPerson(liters float64) float64 {
+	if h.People <= 0 {
+		return 0
+	}
+	domestic := liters - h.livestockLiters() - h.gardenLiters()
+	if domestic < 0 {
+		domestic = 0
+	}
+	return domestic / float64(h.People)
+}
+
+// getHouseholdUsage rates the daily consumption of a tank against the per-person targets,
+// the status is unknown when no consumption was measured rather than below the minimum
+func getHouseholdUsage(h Household, dailyConsumption float64, measured bool) *HouseholdUsage {
+	if !h.configured() {
+		return nil
+	}
+
+	usage := h.targets()
+	usage.People = h.People
+	usage.LivestockLiters = h.livestockLiters()
+	usage.GardenLiters = h.gardenLiters()
+	usage.PerPersonPerDay = h.perPerson(dailyConsumption)
+	usage.DailyQuota = h.quota()
+
+	switch {
+	case !measured:
+		usage.Status = UsageUnknown
+	case usage.PerPersonPerDay < usage.MinimumPerPerson:
+		usage.Status = UsageBelowMinimum
+	case usage.PerPersonPerDay < usage.TargetPerPerson:
+		usage.Status = UsageBelowTarget
+	default:
+		usage.Status = UsageOk
+	}
+	return &usage
+}
+
+// dailyUsage returns the consumption of a day against the quota
+func (h Household) dailyUsage(rollup Rollup) DailyUsage {
+	quota := h.quota()
+	return DailyUsage{
+		Date:           rollup.Start.Format("2006-01-02"),
+		ConsumedLiters: rollup.ConsumedLiters,
+		PerPerson:      h.perPerson(rollup.ConsumedLiters),
+		Quota:          quota,
+		Exceeded:       quota > 0 && rollup.ConsumedLiters > quota,
+	}
+}
+
+// getHouseholdReport rates the usage of each day between from and to, and of today
+func getHouseholdReport(tank Tank, from time.Time, to time.Time) (HouseholdReport, error) {
+	h := tank.Meta.Household
+	loc := tankLocation(tank)
+	report := HouseholdReport{Days: []DailyUsage{}}
+
+	from = bucketStart(from, IntervalDay, loc)
+	levels, err := getLevelHistory(tank, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return report, err
+	}
+	rollups, err := getRollups(levels, tank.Meta.Settings, IntervalDay, from, to, loc)
+	if err != nil {
+		return report, err
+	}
+
+	// Days without readings are left out of the average
+	var total float64
+	var days int
+	today := bucketStart(time.Now(), IntervalDay, loc)
+	for _, rollup := range rollups {
+		usage := h.dailyUsage(rollup)
+		report.Days = append(report.Days, usage)
+		if rollup.Start.Equal(today) {
+			report.Today = usage
+			continue
+		}
+		if rollup.Readings > 0 {
+			total += rollup.ConsumedLiters
+			days++
+		}
+	}
+
+	var average float64
+	if days > 0 {
+		average = total / float64(days)
+	}
+	if usage := getHouseholdUsage(h, average, days > 0); usage != nil {
+		report.HouseholdUsage = *usage
+	}
+	return report, nil
+}
+
+// checkDailyQuota notifies once a day when the consumption of today goes over the quota
+func checkDailyQuota(tank Tank) {
+	h := tank.Meta.Household
+	if !h.configured() || !h.NotifyQuota || tank.Meta.Settings.Capacity <= 0 {
+		return
+	}
+
+	loc := tankLocation(tank)
+	now := time.Now()
+	date := now.In(loc).Format("2006-01-02")
+
+	quotaLock.Lock()
+	last, ok := quotaCheckedAt[tank.ID]
+	if quotaNotified[tank.ID] == date || (ok && now.Sub(last) < 15*time.Minute) {
+		quotaLock.Unlock()
+		return
+	}
+	quotaCheckedAt[tank.ID] = now
+	quotaLock.Unlock()
+
+	start := bucketStart(now, IntervalDay, loc)
+	levels, err := getLevelHistory(tank, start.Format(time.RFC3339), "")
+	if err != nil {
+		fmt.Println("Error retrieving water level history:", err)
+		return
+	}
+	rollups, err := getRollups(levels, tank.Meta.Settings, IntervalDay, start, now, loc)
+	if err != nil || len(rollups) == 0 {
+		return
+	}
+
+	usage := h.dailyUsage(rollups[0])
+	if !usage.Exceeded {
+		return
+	}
+
+	quotaLock.Lock()
+	quotaNotified[tank.ID] = date
+	quotaLock.Unlock()
+
+	title := fmt.Sprintf("%s is over today's water quota", tank.Name)
+	body := fmt.Sprintf("%d liters have been used from %s today, above the daily quota of %d liters (%d liters per person).",
+		int(usage.ConsumedLiters), tank.Name, int(usage.Quota), int(usage.PerPerson))
+	notifyTank(tank, title, body, PriorityMedium)
+}
+
+// GetHouseholdHandler returns the per-person usage and the daily quota tracking of a tank
+func GetHouseholdHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !tank.Meta.Household.configured() {
+		http.Error(w, "no household configured for this tank", http.StatusNotFound)
+		return
+	}
+
+	loc := tankLocation(tank)
+	to := time.Now()
+	from := to.AddDate(0, 0, -defaultHouseholdDays)
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := getHouseholdReport(tank, from, to)
+	if err != nil {
+		fmt.Println("Error computing household usage:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched household usage: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, report)
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Days of history inspected for night-time flow
+const leakHistoryDays = 14
+
+// Consecutive nights with a constant drain needed before a leak is reported
+const defaultLeakNights = 3
+
+// Length of the learnt quiet window in hours
+const quietWindowHours = 4
+
+// Readings needed in a quiet window to measure the drain
+const minQuietReadings = 3
+
+// Leak records kept in the tank meta
+const leakHistorySize = 50
+
+// LeakSettings configures the night-time leak detector of a tank,
+// the quiet window is learnt from the consumption history unless both hours are set
+type LeakSettings struct {
+	QuietStart  *int    `json:"quietStart" bson:"quietStart"`
+	QuietEnd    *int    `json:"quietEnd" bson:"quietEnd"`
+	MinLeakRate float64 `json:"minLeakRate" bson:"minLeakRate"`
+	Nights      int     `json:"nights" bson:"nights"`
+	Disabled    bool    `json:"disabled" bson:"disabled"`
+}
+
+type NightFlow struct {
+	Date      string  `json:"date" bson:"date"`
+	DrainRate float64 `json:"drainRate" bson:"drainRate"`
+	Readings  int     `json:"readings" bson:"readings"`
+	Refilled  bool    `json:"refilled" bson:"refilled"`
+}
+
+type LeakRecord struct {
+	Detected     time.Time `json:"detected" bson:"detected"`
+	DrainRate    float64   `json:"drainRate" bson:"drainRate"`
+	LitersPerDay float64   `json:"litersPerDay" bson:"litersPerDay"`
+	Nights       int       `json:"nights" bson:"nights"`
+}
+
+type LeakReport struct {
+	QuietStart   int          `json:"quietStart"`
+	QuietEnd     int          `json:"quietEnd"`
+	Learnt       bool         `json:"learnt"`
+	Threshold    float64      `json:"threshold"`
+	Leak         bool         `json:"leak"`
+	DrainRate    float64      `json:"drainRate"`
+	LitersPerDay float64      `json:"litersPerDay"`
+	Compared     int          `json:"compared"`
+	Nights       []NightFlow  `json:"nights"`
+	History      []LeakRecord `json:"history"`
+}
+
+// Last time the leak detector ran, by tank
+var leakCheckedAt = make(map[string]time.Time)
+var leakCheckedAtLock sync.Mutex
+
+// Timezone used for tanks that do not configure one
+const defaultTimezone = "Africa/Nairobi"
+
+// tankLocation returns the timezone used to split the tank history into days and hours,
+// set per tank as an IANA name in the "timezone" meta field
+func tankLocation(tank Tank) *time.Location {
+	if tank.Meta.Timezone != "" {
+		loc, err := time.LoadLocation(tank.Meta.Timezone)
+		if err == nil {
+			return loc
+		}
+		fmt.Println("Invalid tank timezone:", tank.Meta.Timezone)
+	}
+
+	loc, err := time.LoadLocation(defaultTimezone)
+	if err != nil {
+		return time.FixedZone("EAT", 3*60*60)
+	}
+	return loc
+}
+
+// slopePerHour fits a line through the levels and returns its slope in liters per hour
+func slopePerHour(levels []WaterLevel) float64 {
+	if len(levels) < 2 {
+		return 0
+	}
+	origin := *levels[0].Timestamp
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(levels))
+	for _, entry := range levels {
+		x := entry.Timestamp.Sub(origin).Hours()
+		sumX += x
+		sumY += entry.Level
+		sumXY += x * entry.Level
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// inWindow checks if the hour falls in the window, which may wrap past midnight
+func inWindow(hour int, start int, end int) bool {
+	if start <= end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+// learnQuietWindow finds the hours of the day with the lowest consumption
+func learnQuietWindow(events []WaterEvent, loc *time.Location) int {
+	var perHour [24]float64
+	for _, event := range events {
+		if event.Type != EventConsumption || event.Minutes <= 0 {
+			continue
+		}
+
+		// The liters are spread over the hours the event covers, in proportion to the time in each
+		rate := event.Liters / event.Minutes
+		for start := event.Start.In(loc); start.Before(*event.End); {
+			end := time.Date(start.Year(), start.Month(), start.Day(), start.Hour()+1, 0, 0, 0, loc)
+			if end.After(*event.End) {
+				end = event.End.In(loc)
+			}
+			perHour[start.Hour()] += rate * end.Sub(start).Minutes()
+			start = end
+		}
+	}
+
+	best := 1
+	bestTotal := -1.0
+	for start := 0; start < 24; start++ {
+		total := 0.0
+		for i := 0; i < quietWindowHours; i++ {
+			total += perHour[(start+i)%24]
+		}
+		if bestTotal < 0 || total < bestTotal {
+			best = start
+			bestTotal = total
+		}
+	}
+	return best
+}
+
+// getNightFlows measures the drain rate during the quiet window of each night
+func getNightFlows(levels []WaterLevel, settings Settings, loc *time.Location, start int, end int) []NightFlow {
+	nights := make(map[string][]WaterLevel)
+	var order []string
+	for _, entry := range levels {
+		local := entry.Timestamp.In(loc)
+		if !inWindow(local.Hour(), start, end) {
+			continue
+		}
+		// A window wrapping past midnight belongs to the night it started in
+		if start > end && local.Hour() < end {
+			local = local.AddDate(0, 0, -1)
+		}
+		date := local.Format("2006-01-02")
+		if _, ok := nights[date]; !ok {
+			order = append(order, date)
+		}
+		nights[date] = append(nights[date], entry)
+	}
+
+	flows := []NightFlow{}
+	for _, date := range order {
+		readings := nights[date]
+		flow := NightFlow{Date: date, Readings: len(readings)}
+		if len(readings) < minQuietReadings {
+			continue
+		}
+		interrupted := false
+		filtered := filterNoise(readings, settings.Capacity)
+		for i := 0; i < len(readings)-1; i++ {
+			// Nights interrupted by a maintenance period are not measured
+			if readings[i+1].Gap {
+				interrupted = true
+				break
+			}
+			if classifyStep(filtered[i+1].Level-filtered[i].Level) == EventRefill {
+				flow.Refilled = true
+				break
+			}
+		}
+		if interrupted {
+			continue
+		}
+		flow.DrainRate = -slopePerHour(readings)
+		flows = append(flows, flow)
+	}
+	return flows
+}
+
+// validHour tells whether an hour of the day is set and within 0 to 23
+func validHour(hour *int) bool {
+	return hour != nil && *hour >= 0 && *hour <= 23
+}
+
+// getLeakReport analyses the night-time flow of the tank over the last days
+func getLeakReport(tank Tank) (LeakReport, error) {
+	settings := tank.Meta.LeakSettings
+	loc := tankLocation(tank)
+
+	report := LeakReport{
+		History: tank.Meta.LeakHistory,
+		Nights:  []NightFlow{},
+	}
+	if report.History == nil {
+		report.History = []LeakRecord{}
+	}
+
+	from := time.Now().AddDate(0, 0, -leakHistoryDays).Format(time.RFC3339)
+	levels, err := getLevelHistory(tank, from, "")
+	if err != nil {
+		return report, err
+	}
+
+	// Hours outside 0 to 23 are ignored and the window is learnt instead
+	if validHour(settings.QuietStart) && validHour(settings.QuietEnd) {
+		report.QuietStart = *settings.QuietStart
+		report.QuietEnd = *settings.QuietEnd
+	} else {
+		report.QuietStart = learnQuietWindow(detectEvents(levels, tank.Meta.Settings, nil), loc)
+		report.QuietEnd = (report.QuietStart + quietWindowHours) % 24
+		report.Learnt = true
+	}
+
+	report.Threshold = settings.MinLeakRate
+	if report.Threshold <= 0 {
+		// Half a liter per thousand liters of capacity every hour, at least one liter
+		report.Threshold = tank.Meta.Settings.Capacity * 0.0005
+		if report.Threshold < 1 {
+			report.Threshold = 1
+		}
+	}
+
+	nights := settings.Nights
+	if nights <= 0 {
+		nights = defaultLeakNights
+	}
+
+	report.Nights = getNightFlows(levels, tank.Meta.Settings, loc, report.QuietStart, report.QuietEnd)
+
+	// Only the latest nights without a refill are compared
+	var recent []float64
+	for i := len(report.Nights) - 1; i >= 0 && len(recent) < nights; i-- {
+		if !report.Nights[i].Refilled {
+			recent = append(recent, report.Nights[i].DrainRate)
+		}
+	}
+
+	report.Compared = len(recent)
+	if len(recent) == nights {
+		report.Leak = true
+		for _, rate := range recent {
+			if rate < report.Threshold {
+				report.Leak = false
+				break
+			}
+		}
+		report.DrainRate = median(recent)
+		report.LitersPerDay = report.DrainRate * 24
+	}
+
+	return report, nil
+}
+
+// checkLeak runs the leak detector at most once an hour and records new leaks
+func checkLeak(tank Tank) {
+	if tank.Meta.LeakSettings.Disabled || tank.Meta.Settings.Capacity <= 0 {
+		return
+	}
+
+	now := time.Now()
+	leakCheckedAtLock.Lock()
+	if last, ok := leakCheckedAt[tank.ID]; ok && now.Sub(last) < time.Hour {
+		leakCheckedAtLock.Unlock()
+		return
+	}
+	leakCheckedAt[tank.ID] = now
+	leakCheckedAtLock.Unlock()
+
+	report, err := getLeakReport(tank)
+	if err != nil {
+		fmt.Println("Error detecting leaks:", err)
+		return
+	}
+	if !report.Leak {
+		return
+	}
+
+	// Report a persisting leak once a day
+	history := tank.Meta.LeakHistory
+	if len(history) > 0 && now.Sub(history[len(history)-1].Detected) < 24*time.Hour {
+		return
+	}
+
+	record := LeakRecord{
+		Detected:     now,
+		DrainRate:    report.DrainRate,
+		LitersPerDay: report.LitersPerDay,
+		Nights:       report.Compared,
+	}
+	history = append(history, record)
+	if len(history) > leakHistorySize {
+		history = history[len(history)-leakHistorySize:]
+	}
+
+	if err := postTankMeta(tank.ID, map[string]interface{}{"leakHistory": history}); err != nil {
+		fmt.Println("Error storing leak history:", err)
+	}
+
+	title := fmt.Sprintf("Possible leak in %s", tank.Name)
+	body := fmt.Sprintf("%s loses %.1f L/h during quiet hours, about %d liters per day. Check pipes, taps and floats for leaks.",
+		tank.Name, report.DrainRate, int(report.LitersPerDay))
+	notifyTank(tank, title, body, PriorityHigh)
+}
+
+// GetLeakHandler returns the night-time flow analysis and the leak history of a tank
+func GetLeakHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	report, err := getLeakReport(tank)
+	if err != nil {
+		fmt.Println("Error detecting leaks:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched leak report: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, report)
+}
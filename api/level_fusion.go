@@ -0,0 +1,444 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How the readings of several level sensors on a tank are combined
+const (
+	FusionPrimary = "primary"
+	FusionAverage = "average"
+	FusionMedian  = "median"
+)
+
+// Status of a level sensor within the fusion
+const (
+	LevelSensorOk         = "ok"
+	LevelSensorNoValue    = "no-value"
+	LevelSensorStale      = "stale"
+	LevelSensorOutOfRange = "out-of-range"
+	LevelSensorDisagrees  = "disagrees"
+)
+
+// Spread between the level sensors tolerated by default, in percent of the tank height
+const defaultFusionTolerancePercent = 5.0
+
+// A level sensor that has not reported for this long is left out while another one reports
+const defaultFusionStaleMinutes = 60
+
+// Readings of different sensors closer than this form one sample of the fused history
+const fusionSampleWindow = time.Minute
+
+// LevelFusionSettings configures how a tank with several WaterLevel sensors reads its level.
+// The primary strategy uses the primary sensor, the first one unless PrimaryID is set, and
+// falls back to the others while it is faulty.
+type LevelFusionSettings struct {
+	Strategy         string  `json:"strategy" bson:"strategy"`
+	PrimaryID        string  `json:"primaryID" bson:"primaryID"`
+	TolerancePercent float64 `json:"tolerancePercent" bson:"tolerancePercent"`
+	StaleMinutes     int     `json:"staleMinutes" bson:"staleMinutes"`
+	NotifyFaults     bool    `json:"notifyFaults" bson:"notifyFaults"`
+}
+
+// LevelSensorStatus is the reading of one level sensor and how the fusion treated it
+type LevelSensorStatus struct {
+	SensorID  string     `json:"sensorID"`
+	Name      string     `json:"name"`
+	Primary   bool       `json:"primary"`
+	Distance  *float64   `json:"distance"`
+	Liters    *float64   `json:"liters"`
+	Time      *time.Time `json:"time"`
+	Deviation float64    `json:"deviation"`
+	Status    string     `json:"status"`
+	Used      bool       `json:"used"`
+}
+
+// LevelFusion is the level of a tank combined from its level sensors. The spread is the
+// difference between the highest and lowest distance of the sensors that report.
+type LevelFusion struct {
+	Strategy  string              `json:"strategy"`
+	SensorID  string              `json:"sensorID"`
+	Distance  float64             `json:"distance"`
+	Liters    float64             `json:"liters"`
+	Time      *time.Time          `json:"time"`
+	Spread    float64             `json:"spread"`
+	Tolerance float64             `json:"tolerance"`
+	Agree     bool                `json:"agree"`
+	Faults    []string            `json:"faults"`
+	Sensors   []LevelSensorStatus `json:"sensors"`
+}
+
+// levelReading is the latest distance of a level sensor at some point in time
+type levelReading struct {
+	sensor SensorData
+	value  float64
+	ok     bool
+	time   *time.Time
+}
+
+// Date of the last fault notification, by tank
+var levelFaultNotified = make(map[string]string)
+var levelFaultLock sync.Mutex
+
+func (s LevelFusionSettings) strategy() string {
+	switch s.Strategy {
+	case FusionAverage, FusionMedian:
+		return s.Strategy
+	}
+	return FusionPrimary
+}
+
+// tolerance returns the tolerated spread in the units of the level sensors, 0 when the
+// height of the tank is not set
+func (s LevelFusionSettings) tolerance(settings Settings) float64 {
+	percent := s.TolerancePercent
+	if percent <= 0 {
+		percent = defaultFusionTolerancePercent
+	}
+	return settings.Height * percent / 100
+}
+
+func (s LevelFusionSettings) staleAfter() time.Duration {
+	if s.StaleMinutes > 0 {
+		return time.Duration(s.StaleMinutes) * time.Minute
+	}
+	return defaultFusionStaleMinutes * time.Minute
+}
+
+// levelSensors returns the WaterLevel sensors of a tank, the primary one first
+func levelSensors(tank Tank) []SensorData {
+	sensors := []SensorData{}
+	for _, sensor := range tank.Sensors {
+		if sensor.Meta.Kind != "WaterLevel" {
+			continue
+		}
+		if sensor.ID == tank.Meta.LevelFusion.PrimaryID {
+			sensors = append([]SensorData{sensor}, sensors...)
+		} else {
+			sensors = append(sensors, sensor)
+		}
+	}
+	return sensors
+}
+
+// inRange tells whether a distance can be read in the tank, with the tolerance as margin
+func inRange(settings Settings, distance float64, tolerance float64) bool {
+	if distance < 0 {
+		return false
+	}
+	return settings.Height <= 0 || distance <= settings.Offset+settings.Height+tolerance
+}
+
+// fuseReadings combines the readings of the level sensors of a tank, the primary one first.
+// Stale and out of range readings are left out while other sensors report. With three sensors
+// or more, the ones too far from the median are left out, two sensors that disagree are both
+// suspects. It returns the fused distance, the time of the latest reading used and the status
+// of each sensor, not ok when no sensor reports.
+func fuseReadings(tank Tank, readings []levelReading, now time.Time) (float64, *time.Time, []LevelSensorStatus, bool) {
+	settings := tank.Meta.LevelFusion
+	tolerance := settings.tolerance(tank.Meta.Settings)
+
+	statuses := make([]LevelSensorStatus, len(readings))
+	candidates := []int{}
+	for i, reading := range readings {
+		statuses[i] = LevelSensorStatus{
+			SensorID: reading.sensor.ID,
+			Name:     reading.sensor.Name,
+			Primary:  i == 0,
+			Time:     reading.time,
+			Status:   LevelSensorOk,
+		}
+		switch {
+		case !reading.ok:
+			statuses[i].Status = LevelSensorNoValue
+			continue
+		case !inRange(tank.Meta.Settings, reading.value, tolerance):
+			statuses[i].Status = LevelSensorOutOfRange
+		case len(readings) > 1 && (reading.time == nil || now.Sub(*reading.time) > settings.staleAfter()):
+			statuses[i].Status = LevelSensorStale
+		}
+		distance := reading.value
+		liters := toLiters(tank.Meta.Settings, distance)
+		statuses[i].Distance = &distance
+		statuses[i].Liters = &liters
+		if statuses[i].Status == LevelSensorOk {
+			candidates = append(candidates, i)
+		}
+	}
+
+	// A faulty reading is still better than none
+	if len(candidates) == 0 {
+		for i, status := range statuses {
+			if status.Distance != nil {
+				candidates = append(candidates, i)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil, statuses, false
+	}
+
+	values := []float64{}
+	for _, i := range candidates {
+		values = append(values, readings[i].value)
+	}
+	middle := median(values)
+	if tolerance > 0 && len(candidates) >= 3 {
+		agreeing := []int{}
+		for _, i := range candidates {
+			if math.Abs(readings[i].value-middle) > tolerance {
+				statuses[i].Status = LevelSensorDisagrees
+			} else {
+				agreeing = append(agreeing, i)
+			}
+		}
+		if len(agreeing) > 0 {
+			candidates = agreeing
+		}
+	} else if tolerance > 0 && len(candidates) == 2 && math.Abs(readings[candidates[0]].value-readings[candidates[1]].value) > tolerance {
+		statuses[candidates[0]].Status = LevelSensorDisagrees
+		statuses[candidates[1]].Status = LevelSensorDisagrees
+	}
+
+	values = values[:0]
+	var latest *time.Time
+	for _, i := range candidates {
+		values = append(values, readings[i].value)
+		statuses[i].Used = true
+		if t := readings[i].time; t != nil && (latest == nil || t.After(*latest)) {
+			latest = t
+		}
+	}
+
+	var distance float64
+	switch settings.strategy() {
+	case FusionAverage:
+		for _, value := range values {
+			distance += value
+		}
+		distance /= float64(len(values))
+	case FusionMedian:
+		distance = median(values)
+	default:
+		// The primary sensor, or the first one that can stand in for it
+		for i := range statuses {
+			statuses[i].Used = i == candidates[0]
+		}
+		distance = values[0]
+		latest = readings[candidates[0]].time
+	}
+
+	for i := range statuses {
+		if statuses[i].Distance != nil {
+			statuses[i].Deviation = math.Round((*statuses[i].Distance-distance)*100) / 100
+		}
+	}
+	return distance, latest, statuses, true
+}
+
+// currentReadings returns the current readings of the level sensors of a tank
+func currentReadings(sensors []SensorData) []levelReading {
+	readings := make([]levelReading, len(sensors))
+	for i, sensor := range sensors {
+		value, ok := numericValue(sensor.Value)
+		readings[i] = levelReading{sensor: sensor, value: value, ok: ok, time: sensor.Time}
+	}
+	return readings
+}
+
+// getLevelFusion combines the current readings of the level sensors of a tank, not ok when
+// the tank has no level sensor reporting
+func getLevelFusion(tank Tank) (LevelFusion, bool) {
+	sensors := levelSensors(tank)
+	if len(sensors) == 0 {
+		return LevelFusion{}, false
+	}
+
+	distance, latest, statuses, ok := fuseReadings(tank, currentReadings(sensors), time.Now())
+	fusion := LevelFusion{
+		Strategy:  tank.Meta.LevelFusion.strategy(),
+		SensorID:  sensors[0].ID,
+		Distance:  distance,
+		Liters:    currentLiters(tank, distance),
+		Time:      latest,
+		Tolerance: tank.Meta.LevelFusion.tolerance(tank.Meta.Settings),
+		Agree:     true,
+		Faults:    []string{},
+		Sensors:   statuses,
+	}
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, status := range statuses {
+		if status.Status != LevelSensorOk && status.Status != LevelSensorNoValue {
+			fusion.Faults = append(fusion.Faults, status.SensorID)
+		}
+		if status.Status == LevelSensorDisagrees {
+			fusion.Agree = false
+		}
+		if status.Distance != nil && status.Status != LevelSensorOutOfRange {
+			low = math.Min(low, *status.Distance)
+			high = math.Max(high, *status.Distance)
+		}
+	}
+	if high >= low {
+		fusion.Spread = high - low
+	}
+	return fusion, ok
+}
+
+// levelSensor returns the level sensor of a tank. With several level sensors it is the primary
+// one carrying the fused distance and the time of the readings used.
+func levelSensor(tank Tank) (SensorData, bool) {
+	sensors := levelSensors(tank)
+	if len(sensors) <= 1 {
+		return findSensor(tank.Sensors, "WaterLevel")
+	}
+
+	fusion, ok := getLevelFusion(tank)
+	if !ok {
+		return sensors[0], true
+	}
+	sensor := sensors[0]
+	sensor.Value = fusion.Distance
+	sensor.Time = fusion.Time
+	return sensor, true
+}
+
+// getLevelDistances returns the level history of a tank between from and to as distances,
+// fused when the tank has several level sensors and corrected for the temperature
+func getLevelDistances(tank Tank, from string, to string) ([]HistoryPoint, error) {
+	sensors := levelSensors(tank)
+	if len(sensors) == 0 {
+		return nil, fmt.Errorf("WaterLevel sensor not found")
+	}
+
+	// Distances are corrected for the temperature when the tank is compensated
+	compensation, err := getCompensationSeries(tank, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	type sample struct {
+		sensor int
+		point  HistoryPoint
+	}
+	samples := []sample{}
+	for i, sensor := range sensors {
+		values, err := getSensorValues(tank.ID, sensor.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, point := range sensorHistoryPoints(values) {
+			samples = append(samples, sample{sensor: i, point: point})
+		}
+	}
+
+	history := []HistoryPoint{}
+	if len(sensors) == 1 {
+		for _, s := range samples {
+			history = append(history, HistoryPoint{Time: s.point.Time, Value: compensation.distance(s.point.Time, s.point.Value)})
+		}
+		return history, nil
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].point.Time.Before(samples[j].point.Time)
+	})
+
+	// Each sample fuses the latest reading of every sensor at its time
+	readings := make([]levelReading, len(sensors))
+	for i, sensor := range sensors {
+		readings[i] = levelReading{sensor: sensor}
+	}
+	var last time.Time
+	for _, s := range samples {
+		at := s.point.Time
+		readings[s.sensor].value = s.point.Value
+		readings[s.sensor].ok = true
+		readings[s.sensor].time = &at
+
+		if len(history) > 0 && at.Sub(last) < fusionSampleWindow {
+			continue
+		}
+		distance, _, _, ok := fuseReadings(tank, readings, at)
+		if !ok {
+			continue
+		}
+		history = append(history, HistoryPoint{Time: at, Value: compensation.distance(at, distance)})
+		last = at
+	}
+	return history, nil
+}
+
+// checkLevelSensors notifies once a day when a redundant level sensor of a tank looks faulty
+func checkLevelSensors(tank Tank) {
+	if !tank.Meta.LevelFusion.NotifyFaults || len(levelSensors(tank)) < 2 {
+		return
+	}
+	fusion, ok := getLevelFusion(tank)
+	if !ok || len(fusion.Faults) == 0 {
+		return
+	}
+
+	date := time.Now().In(tankLocation(tank)).Format("2006-01-02")
+	levelFaultLock.Lock()
+	if levelFaultNotified[tank.ID] == date {
+		levelFaultLock.Unlock()
+		return
+	}
+	levelFaultNotified[tank.ID] = date
+	levelFaultLock.Unlock()
+
+	problems := []string{}
+	for _, status := range fusion.Sensors {
+		switch status.Status {
+		case LevelSensorStale:
+			problems = append(problems, fmt.Sprintf("%s stopped reporting", status.Name))
+		case LevelSensorOutOfRange:
+			problems = append(problems, fmt.Sprintf("%s reads outside the tank", status.Name))
+		case LevelSensorDisagrees:
+			problems = append(problems, fmt.Sprintf("%s is %.1f away from the level", status.Name, math.Abs(status.Deviation)))
+		}
+	}
+
+	title := fmt.Sprintf("Level sensor fault at %s", tank.Name)
+	body := fmt.Sprintf("%s. The level of %s is read from the other sensors meanwhile, check the sensors.",
+		strings.Join(problems, ", "), tank.Name)
+	if !fusion.Agree && len(fusion.Faults) == len(levelSensors(tank)) {
+		body = fmt.Sprintf("The level sensors of %s disagree by %.1f: %s. Check which one is faulty.",
+			tank.Name, fusion.Spread, strings.Join(problems, ", "))
+	}
+	notifyTank(tank, title, body, PriorityMedium)
+}
+
+// GetLevelSensorsHandler returns the level sensors of a tank with their fused level
+func GetLevelSensorsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	fusion, ok := getLevelFusion(tank)
+	if !ok && len(fusion.Sensors) == 0 {
+		http.Error(w, "no WaterLevel sensor on this tank", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("[%s] Fetched level sensors: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, fusion)
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Number of past maintenance periods kept in the tank meta
+const maintenanceLogSize = 50
+
+// MaintenanceMode locks a tank while a technician works on it,
+// actuator commands are blocked and alerts are suppressed until it is disabled or expires
+type MaintenanceMode struct {
+	Enabled   bool       `json:"enabled" bson:"enabled"`
+	Active    bool       `json:"active" bson:"active"`
+	Reason    string     `json:"reason" bson:"reason"`
+	EnabledBy string     `json:"enabledBy" bson:"enabledBy"`
+	Since     *time.Time `json:"since" bson:"since"`
+	Until     *time.Time `json:"until" bson:"until"`
+}
+
+type MaintenancePeriod struct {
+	Reason    string     `json:"reason" bson:"reason"`
+	EnabledBy string     `json:"enabledBy" bson:"enabledBy"`
+	Since     *time.Time `json:"since" bson:"since"`
+	Until     *time.Time `json:"until" bson:"until"`
+}
+
+// isActive reports whether the maintenance mode is enabled and has not expired
+func (m MaintenanceMode) isActive(now time.Time) bool {
+	return m.Enabled && (m.Until == nil || now.Before(*m.Until))
+}
+
+// getMaintenancePeriods returns the past maintenance periods of the tank including the current one
+func getMaintenancePeriods(tank Tank, now time.Time) []MaintenancePeriod {
+	periods := tank.Meta.MaintenanceLog
+	mode := tank.Meta.MaintenanceMode
+	if mode.Enabled && mode.Since != nil {
+		until := mode.Until
+		if until == nil || until.After(now) {
+			until = &now
+		}
+		periods = append(periods, MaintenancePeriod{
+			Reason:    mode.Reason,
+			EnabledBy: mode.EnabledBy,
+			Since:     mode.Since,
+			Until:     until,
+		})
+	}
+	return periods
+}
+
+// excludeMaintenancePeriods drops the level entries recorded while the tank was in maintenance mode,
+// the first entry after a period is marked as a gap
+func excludeMaintenancePeriods(levels []WaterLevel, tank Tank) []WaterLevel {
+	periods := getMaintenancePeriods(tank, time.Now())
+	if len(periods) == 0 {
+		return levels
+	}
+
+	var filtered []WaterLevel
+	dropped := false
+	for _, entry := range levels {
+		inMaintenance := false
+		for _, period := range periods {
+			if period.Since != nil && period.Until != nil && !entry.Timestamp.Before(*period.Since) && !entry.Timestamp.After(*period.Until) {
+				inMaintenance = true
+				break
+			}
+		}
+		if inMaintenance {
+			dropped = true
+			continue
+		}
+		if dropped && len(filtered) > 0 {
+			entry.Gap = true
+		}
+		dropped = false
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+// splitAtGaps splits the level history into the runs of readings between maintenance periods
+func splitAtGaps(levels []WaterLevel) [][]WaterLevel {
+	var segments [][]WaterLevel
+	start := 0
+	for i := 1; i < len(levels); i++ {
+		if levels[i].Gap {
+			segments = append(segments, levels[start:i])
+			start = i
+		}
+	}
+	if start < len(levels) {
+		segments = append(segments, levels[start:])
+	}
+	return segments
+}
+
+// requestUser returns the gateway user signed in on the request, the token of the request
+// (Authorization header or Token cookie) is checked against the gateway
+func requestUser(r *http.Request) string {
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if auth == "" {
+		cookie, err := r.Cookie("Token")
+		if err != nil || cookie.Value == "" {
+			return ""
+		}
+		auth = "Bearer " + cookie.Value
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/auth/profile", nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("Authorization", auth)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("Error verifying user:", err)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	var profile struct {
+		Username string `json:"username"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		fmt.Println("Error unmarshaling user profile:", err)
+		return ""
+	}
+	return profile.Username
+}
+
+// isTechnician checks whether the signed in user is listed as a technician in the gateway
+// profile, nobody is one while no technicians are listed
+func isTechnician(user string) bool {
+	if user == "" {
+		return false
+	}
+
+	resp, err := http.Get("http://localhost/device/meta")
+	if err != nil {
+		fmt.Println("Error obtaining gateway profile:", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println("Error reading response body:", err)
+		return false
+	}
+
+	var gateway struct {
+		Technicians []string `json:"technicians"`
+	}
+	if err = json.Unmarshal(body, &gateway); err != nil {
+		fmt.Println("Error unmarshaling gateway:", err)
+		return false
+	}
+
+	for _, technician := range gateway.Technicians {
+		if technician == user {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeTechnician answers 401 or 403 unless the request comes from a technician and
+// returns the signed in user
+func authorizeTechnician(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := requestUser(r)
+	if user == "" {
+		http.Error(w, "sign in to the gateway first", http.StatusUnauthorized)
+		return "", false
+	}
+	if !isTechnician(user) {
+		http.Error(w, "only technicians can change the maintenance mode", http.StatusForbidden)
+		return "", false
+	}
+	return user, true
+}
+
+// getLockedTank returns the tank in maintenance mode that owns the device, if any
+func getLockedTank(deviceID string) (Tank, bool) {
+	tanks, err := getTanks()
+	if err != nil {
+		fmt.Println("Error retrieving tanks:", err)
+		return Tank{}, false
+	}
+
+	now := time.Now()
+	for _, tank := range tanks {
+		if tank.ID != deviceID && tank.Meta.ActuatorID != deviceID {
+			continue
+		}
+		if tank.Meta.MaintenanceMode.isActive(now) {
+			return tank, true
+		}
+	}
+	return Tank{}, false
+}
+
+// TankInMaintenance reports whether alerts for the tank should be suppressed
+func TankInMaintenance(tank Tank) bool {
+	return tank.Meta.MaintenanceMode.isActive(time.Now())
+}
+
+// GetMaintenanceModeHandler returns the maintenance mode of a tank and its past maintenance periods
+func GetMaintenanceModeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	mode := tank.Meta.MaintenanceMode
+	mode.Active = mode.isActive(time.Now())
+
+	response := struct {
+		MaintenanceMode MaintenanceMode     `json:"maintenanceMode"`
+		History         []MaintenancePeriod `json:"history"`
+	}{
+		MaintenanceMode: mode,
+		History:         tank.Meta.MaintenanceLog,
+	}
+
+	log.Printf("[%s] Fetched maintenance mode: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, response)
+}
+
+// PostMaintenanceModeHandler puts a tank in maintenance mode, with an optional expiry
+func PostMaintenanceModeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	user, ok := authorizeTechnician(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Reason  string     `json:"reason"`
+		Until   *time.Time `json:"until"`
+		Minutes float64    `json:"minutes"`
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &request); err != nil {
+			fmt.Println("Error unmarshaling maintenance mode:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	fields := map[string]interface{}{}
+
+	// Keep the previous period before it is replaced
+	if tank.Meta.MaintenanceMode.Enabled {
+		fields["maintenanceLog"] = trimMaintenanceLog(getMaintenancePeriods(tank, now))
+	}
+
+	mode := MaintenanceMode{
+		Enabled:   true,
+		Reason:    request.Reason,
+		EnabledBy: user,
+		Since:     &now,
+		Until:     request.Until,
+	}
+	if mode.Until == nil && request.Minutes > 0 {
+		until := now.Add(time.Duration(request.Minutes * float64(time.Minute)))
+		mode.Until = &until
+	}
+	fields["maintenanceMode"] = mode
+
+	if err = postTankMeta(tankID, fields); err != nil {
+		fmt.Println("Error storing maintenance mode:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	mode.Active = mode.isActive(now)
+
+	log.Printf("[%s] Maintenance mode enabled by %q: %s %s", time.Now().Format(time.RFC3339), user, r.Method, r.URL.Path)
+
+	writeJSON(w, mode)
+}
+
+// DeleteMaintenanceModeHandler takes a tank out of maintenance mode
+func DeleteMaintenanceModeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	user, ok := authorizeTechnician(w, r)
+	if !ok {
+		return
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !tank.Meta.MaintenanceMode.Enabled {
+		writeJSON(w, map[string]string{
+			"message": "Tank is not in maintenance mode",
+		})
+		return
+	}
+
+	fields := map[string]interface{}{
+		"maintenanceLog":  trimMaintenanceLog(getMaintenancePeriods(tank, time.Now())),
+		"maintenanceMode": MaintenanceMode{},
+	}
+	if err = postTankMeta(tankID, fields); err != nil {
+		fmt.Println("Error storing maintenance mode:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Maintenance mode disabled by %q: %s %s", time.Now().Format(time.RFC3339), user, r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Maintenance mode disabled",
+	})
+}
+
+func trimMaintenanceLog(periods []MaintenancePeriod) []MaintenancePeriod {
+	if len(periods) > maintenanceLogSize {
+		return periods[len(periods)-maintenanceLogSize:]
+	}
+	return periods
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// GetTank fetches a tank once for all the checks run on its update
+func GetTank(tankID string) (Tank, error) {
+	return getTank(tankID)
+}
+
+// VirtualSensorUpdate tells whether the last update of a tank was caused by storing the
+// value of a virtual sensor, its level alerts already ran for the reading before it
+func VirtualSensorUpdate(tank Tank) bool {
+	return virtualSensorUpdate(tank)
+}
+
+// HandleTankUpdate runs the checks that are evaluated each time a tank publishes new values,
+// main skips the updates caused by storing a virtual sensor value
+func HandleTankUpdate(tank Tank) {
+	// Virtual sensors keep recording during maintenance, only their alerts are suppressed
+	evaluateVirtualSensors(tank)
+	evaluateDependentVirtualSensors(tank)
+
+	// Alerts are suppressed while a technician works on the tank
+	if tank.Meta.MaintenanceMode.isActive(time.Now()) {
+		fmt.Println("Tank in maintenance mode, alerts suppressed:", tank.Name)
+		return
+	}
+
+	// Bursts are checked first as they are the most urgent
+	checkBurst(tank)
+	checkPumpMaintenance(tank)
+	checkTankMaintenance(tank)
+	checkPumpPerformance(tank)
+	checkLeak(tank)
+	checkLevelSensors(tank)
+	checkDiagnostics(tank)
+	checkFlow(tank)
+	checkWaterQuality(tank)
+	checkTemperatureSafety(tank)
+	checkForecast(tank)
+	checkBudget(tank)
+	recordDeliveries(tank)
+	checkDosing(tank)
+	checkDailyQuota(tank)
+	checkGroups(tank)
+}
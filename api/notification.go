@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	PriorityLow      = "low"
+	PriorityMedium   = "medium"
+	PriorityHigh     = "high"
+	PriorityCritical = "critical"
+)
+
+// getGatewayTokens returns the push notification tokens stored in the gateway profile
+func getGatewayTokens() []string {
+	resp, err := http.Get("http://localhost/device/meta")
+	if err != nil {
+		log.Println("Error obtaining gateway profile:", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading response body:", err)
+		return nil
+	}
+
+	var gateway Gateway
+	if err = json.Unmarshal(body, &gateway); err != nil {
+		// The token may be stored as a single string
+		var temp struct {
+			Token string `json:"token"`
+		}
+		if err = json.Unmarshal(body, &temp); err != nil || temp.Token == "" {
+			return nil
+		}
+		return []string{temp.Token}
+	}
+
+	return gateway.Token
+}
+
+// notifyTank pushes a notification to all registered apps and stores it in the tank messages
+func notifyTank(tank Tank, title string, body string, priority string) {
+	for _, token := range getGatewayTokens() {
+		if err := sendPushNotification(token, title, body); err != nil {
+			fmt.Println("Error sending push notification:", err)
+		}
+	}
+
+	message := Message{
+		ID:       int(time.Now().Unix()),
+		TankName: tank.Name,
+		Date:     time.Now().Add(3 * time.Hour).Format("2006-01-02 15:04:05"),
+		Priority: priority,
+		Message:  body,
+	}
+
+	// Reload the tank so that messages added since it was fetched are kept
+	current, err := getTank(tank.ID)
+	if err != nil {
+		fmt.Println("Error retrieving tank messages:", err)
+		return
+	}
+
+	notifications := current.Meta.Notifications
+	notifications.Messages = append([]Message{message}, notifications.Messages...)
+
+	err = postTankMeta(tank.ID, map[string]interface{}{"notifications": notifications})
+	if err != nil {
+		fmt.Println("Error storing tank notification:", err)
+		return
+	}
+
+	log.Printf("[%s] Notification sent for %s: %s", time.Now().Format(time.RFC3339), tank.Name, title)
+}
@@ -275,6 +275,13 @@ func TankStatePostHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     tankID := vars["tankID"]
 
+    // Actuation is blocked while the tank is in maintenance mode, except for technicians
+    if lockedTank, locked := getLockedTank(tankID); locked && !isTechnician(requestUser(r)) {
+        fmt.Println("Actuator blocked, tank in maintenance mode:", lockedTank.Name)
+        http.Error(w, fmt.Sprintf("%s is in maintenance mode", lockedTank.Name), http.StatusLocked)
+        return
+    }
+
     // Send a GET request to localhost/devices/tankID/actuators
     resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s/actuators", tankID))
     if err != nil {
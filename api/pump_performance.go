@@ -0,0 +1,214 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fraction of the baseline fill rate below which a pump is reported as degraded
+const defaultMinFillRateFraction = 0.7
+
+// Completed runs needed before a baseline fill rate is trusted
+const minBaselineRuns = 3
+
+// Runs shorter than this do not move the level enough to measure a fill rate
+const minFillRateMinutes = 2.0
+
+type PumpSettings struct {
+	MinFillRateFraction float64 `json:"minFillRateFraction" bson:"minFillRateFraction"`
+}
+
+type FillRateSample struct {
+	Start           *time.Time `json:"start" bson:"start"`
+	LitersPerMinute float64    `json:"litersPerMinute" bson:"litersPerMinute"`
+}
+
+type PumpPerformance struct {
+	ActuatorID        string           `json:"actuatorID" bson:"actuatorID"`
+	Name              string           `json:"name" bson:"name"`
+	Running           bool             `json:"running" bson:"running"`
+	FillRate          float64          `json:"fillRate" bson:"fillRate"`
+	BaselineFillRate  float64          `json:"baselineFillRate" bson:"baselineFillRate"`
+	RateRatio         float64          `json:"rateRatio" bson:"rateRatio"`
+	Degraded          bool             `json:"degraded" bson:"degraded"`
+	TimeToFullMinutes float64          `json:"timeToFullMinutes" bson:"timeToFullMinutes"`
+	History           []FillRateSample `json:"history" bson:"history"`
+}
+
+// Minutes between two fill rate checks of a tank
+const pumpPerformanceCheckMinutes = 5
+
+// Last time the fill rate of the pumps was checked, by tank
+var pumpPerformanceCheckedAt = make(map[string]time.Time)
+var pumpPerformanceCheckedAtLock sync.Mutex
+
+// The start of the run for which a degraded pump was last reported is kept in the tank meta
+// by actuator, so that a restart does not report the same run again
+var fillRateNotifiedLock sync.Mutex
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// getPumpPerformance derives the fill rate of a pump from the level change of each run
+func getPumpPerformance(runtime PumpRuntime, tank Tank, currentLevel float64, settings PumpSettings) PumpPerformance {
+	performance := PumpPerformance{
+		ActuatorID: runtime.ActuatorID,
+		Name:       runtime.Name,
+		History:    []FillRateSample{},
+	}
+
+	fraction := settings.MinFillRateFraction
+	if fraction <= 0 {
+		fraction = defaultMinFillRateFraction
+	}
+
+	var completed []float64
+	activeMeasured := false
+	for _, run := range runtime.Runs {
+		if run.Minutes < minFillRateMinutes || run.Liters <= 0 {
+			continue
+		}
+		rate := run.Liters / run.Minutes
+		performance.History = append(performance.History, FillRateSample{
+			Start:           run.Start,
+			LitersPerMinute: rate,
+		})
+		if run.Running {
+			activeMeasured = true
+		} else {
+			completed = append(completed, rate)
+		}
+	}
+
+	if len(runtime.Runs) > 0 {
+		performance.Running = runtime.Runs[len(runtime.Runs)-1].Running
+	}
+	if len(performance.History) == 0 {
+		return performance
+	}
+
+	performance.FillRate = performance.History[len(performance.History)-1].LitersPerMinute
+
+	// The latest run is compared against the runs before it
+	baselineRuns := completed
+	if !performance.Running && len(baselineRuns) > 0 {
+		baselineRuns = baselineRuns[:len(baselineRuns)-1]
+	}
+	if len(baselineRuns) >= minBaselineRuns {
+		performance.BaselineFillRate = median(baselineRuns)
+		performance.RateRatio = performance.FillRate / performance.BaselineFillRate
+		performance.Degraded = performance.RateRatio < fraction
+	}
+
+	// The time to full is only known once the active run is long enough to measure, the
+	// rate of an earlier run does not tell how fast the pump fills now
+	if activeMeasured && performance.FillRate > 0 && tank.Meta.Settings.Capacity > currentLevel {
+		performance.TimeToFullMinutes = (tank.Meta.Settings.Capacity - currentLevel) / performance.FillRate
+	}
+
+	return performance
+}
+
+// getTankPumpPerformance computes the fill rate analytics of every pump of the tank from
+// the given level history, the last level being the current one
+func getTankPumpPerformance(tank Tank, levels []WaterLevel) ([]PumpPerformance, error) {
+	runtimes, err := getTankPumpRuntimes(tank, levels)
+	if err != nil {
+		return nil, err
+	}
+
+	var currentLevel float64
+	if len(levels) > 0 {
+		currentLevel = levels[len(levels)-1].Level
+	}
+
+	performances := []PumpPerformance{}
+	for _, runtime := range runtimes {
+		performances = append(performances, getPumpPerformance(runtime, tank, currentLevel, tank.Meta.PumpSettings))
+	}
+
+	return performances, nil
+}
+
+// checkPumpPerformance alerts once per run when a pump fills slower than its baseline
+func checkPumpPerformance(tank Tank) {
+	now := time.Now()
+	pumpPerformanceCheckedAtLock.Lock()
+	if last, ok := pumpPerformanceCheckedAt[tank.ID]; ok && now.Sub(last) < pumpPerformanceCheckMinutes*time.Minute {
+		pumpPerformanceCheckedAtLock.Unlock()
+		return
+	}
+	pumpPerformanceCheckedAt[tank.ID] = now
+	pumpPerformanceCheckedAtLock.Unlock()
+
+	if len(getTankPumps(tank)) == 0 {
+		return
+	}
+
+	levels := getPumpLevelHistory(tank)
+	if len(levels) == 0 {
+		return
+	}
+
+	performances, err := getTankPumpPerformance(tank, levels)
+	if err != nil {
+		fmt.Println("Error computing pump performance:", err)
+		return
+	}
+
+	for _, performance := range performances {
+		if !performance.Degraded {
+			continue
+		}
+
+		runStart := performance.History[len(performance.History)-1].Start
+		notify, err := recordFillRateNotified(tank.ID, performance.ActuatorID, *runStart)
+		if err != nil {
+			fmt.Println("Error recording pump fill rate alert:", err)
+		}
+		if !notify {
+			continue
+		}
+
+		title := fmt.Sprintf("%s pump is filling slowly", tank.Name)
+		body := fmt.Sprintf("%s fills %s at %.1f L/min, %d%% of its usual %.1f L/min. Check for a clogged intake or a worn pump.",
+			performance.Name, tank.Name, performance.FillRate, int(performance.RateRatio*100), performance.BaselineFillRate)
+		notifyTank(tank, title, body, PriorityMedium)
+	}
+}
+
+// recordFillRateNotified stores the run a degraded pump is reported for, false when that run
+// was already reported
+func recordFillRateNotified(tankID string, actuatorID string, runStart time.Time) (bool, error) {
+	fillRateNotifiedLock.Lock()
+	defer fillRateNotifiedLock.Unlock()
+
+	var meta struct {
+		FillRateNotified map[string]time.Time `json:"fillRateNotified"`
+	}
+	if err := getTankMeta(tankID, &meta); err != nil {
+		return false, err
+	}
+	if last, ok := meta.FillRateNotified[actuatorID]; ok && last.Equal(runStart) {
+		return false, nil
+	}
+	if meta.FillRateNotified == nil {
+		meta.FillRateNotified = make(map[string]time.Time)
+	}
+	meta.FillRateNotified[actuatorID] = runStart
+
+	// The alert is still sent when it cannot be stored, it may be repeated after a restart
+	return true, postTankMeta(tankID, map[string]interface{}{"fillRateNotified": meta.FillRateNotified})
+}
@@ -0,0 +1,542 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Runs shorter than this are counted as short cycles
+const shortCycleMinutes = 5.0
+
+// Number of recent runs inspected to decide if the pump is short-cycling
+const shortCycleWindow = 10
+
+// Short cycles within the window that flag the pump as short-cycling
+const shortCycleLimit = 3
+
+// Days of level history used to measure the liters of each run
+const pumpLevelHistoryDays = 30
+
+// PumpRun is an on/off cycle of a pump. Liters is the net change of the level during the
+// run, what the pump delivered less what was drawn from the tank meanwhile.
+type PumpRun struct {
+	Start   *time.Time `json:"start" bson:"start"`
+	End     *time.Time `json:"end" bson:"end"`
+	Minutes float64    `json:"minutes" bson:"minutes"`
+	Liters  float64    `json:"liters" bson:"liters"`
+	Running bool       `json:"running" bson:"running"`
+}
+
+type PumpRuntime struct {
+	DeviceID            string    `json:"deviceID" bson:"deviceID"`
+	ActuatorID          string    `json:"actuatorID" bson:"actuatorID"`
+	Name                string    `json:"name" bson:"name"`
+	RunHours            float64   `json:"runHours" bson:"runHours"`
+	Starts              int       `json:"starts" bson:"starts"`
+	AverageCycleMinutes float64   `json:"averageCycleMinutes" bson:"averageCycleMinutes"`
+	ShortCycles         int       `json:"shortCycles" bson:"shortCycles"`
+	ShortCycling        bool      `json:"shortCycling" bson:"shortCycling"`
+	LitersPerRun        float64   `json:"litersPerRun" bson:"litersPerRun"`
+	Runs                []PumpRun `json:"runs" bson:"runs"`
+}
+
+// Last time the pump maintenance schedules were checked, by tank
+var pumpMaintenanceCheckedAt = make(map[string]time.Time)
+var pumpMaintenanceCheckedAtLock sync.Mutex
+
+// PumpMaintenance is a service schedule for a pump, due after a number of run hours or calendar days
+type PumpMaintenance struct {
+	ID                  string     `json:"id" bson:"id"`
+	ActuatorID          string     `json:"actuatorID" bson:"actuatorID"`
+	Task                string     `json:"task" bson:"task"`
+	IntervalHours       float64    `json:"intervalHours" bson:"intervalHours"`
+	IntervalDays        int        `json:"intervalDays" bson:"intervalDays"`
+	LastService         *time.Time `json:"lastService" bson:"lastService"`
+	LastServiceRunHours float64    `json:"lastServiceRunHours" bson:"lastServiceRunHours"`
+	AcknowledgedBy      string     `json:"acknowledgedBy" bson:"acknowledgedBy"`
+	Notified            bool       `json:"notified" bson:"notified"`
+}
+
+type PumpMaintenanceStatus struct {
+	PumpMaintenance
+	RunHours       float64 `json:"runHours"`
+	HoursRemaining float64 `json:"hoursRemaining"`
+	DaysRemaining  float64 `json:"daysRemaining"`
+	Due            bool    `json:"due"`
+}
+
+type pumpRef struct {
+	DeviceID string
+	Actuator ActuatorData
+}
+
+// getTankPumps returns the Motor actuators on the tank and on its linked actuator device
+func getTankPumps(tank Tank) []pumpRef {
+	var pumps []pumpRef
+	for _, actuator := range tank.Actuators {
+		if actuator.ActuatorMeta.Kind == "Motor" {
+			pumps = append(pumps, pumpRef{DeviceID: tank.ID, Actuator: actuator})
+		}
+	}
+
+	if tank.Meta.ActuatorID != "" && tank.Meta.ActuatorID != tank.ID {
+		device, err := getTank(tank.Meta.ActuatorID)
+		if err != nil {
+			fmt.Println("Error retrieving actuator device:", err)
+			return pumps
+		}
+		for _, actuator := range device.Actuators {
+			if actuator.ActuatorMeta.Kind == "Motor" {
+				pumps = append(pumps, pumpRef{DeviceID: device.ID, Actuator: actuator})
+			}
+		}
+	}
+
+	return pumps
+}
+
+// getPumpRuns splits the actuator history into on/off cycles
+func getPumpRuns(states []SensorData, now time.Time) []PumpRun {
+	var runs []PumpRun
+	var start *time.Time
+
+	for _, state := range states {
+		value, ok := numericValue(state.Value)
+		if !ok || state.Time == nil {
+			continue
+		}
+
+		if value > 0 && start == nil {
+			start = state.Time
+		} else if value == 0 && start != nil {
+			end := state.Time
+			runs = append(runs, PumpRun{
+				Start:   start,
+				End:     end,
+				Minutes: end.Sub(*start).Minutes(),
+			})
+			start = nil
+		}
+	}
+
+	// The pump is still running
+	if start != nil {
+		runs = append(runs, PumpRun{
+			Start:   start,
+			Minutes: now.Sub(*start).Minutes(),
+			Running: true,
+		})
+	}
+
+	return runs
+}
+
+// getPumpRuntime computes the runtime accounting for a single pump
+func getPumpRuntime(pump pumpRef, levels []WaterLevel, now time.Time) (PumpRuntime, error) {
+	runtime := PumpRuntime{
+		DeviceID:   pump.DeviceID,
+		ActuatorID: pump.Actuator.ID,
+		Name:       pump.Actuator.Name,
+	}
+
+	states, err := getActuatorValues(pump.DeviceID, pump.Actuator.ID)
+	if err != nil {
+		return runtime, err
+	}
+
+	runs := getPumpRuns(states, now)
+
+	var totalMinutes, totalLiters float64
+	var measuredRuns int
+	for i := range runs {
+		totalMinutes += runs[i].Minutes
+
+		end := now
+		if runs[i].End != nil {
+			end = *runs[i].End
+		}
+		// Runs before the level history are counted without their liters
+		if len(levels) == 0 || runs[i].Start.Before(*levels[0].Timestamp) {
+			continue
+		}
+		startLevel, ok1 := levelAt(levels, *runs[i].Start)
+		endLevel, ok2 := levelAt(levels, end)
+		if ok1 && ok2 {
+			runs[i].Liters = endLevel - startLevel
+			totalLiters += runs[i].Liters
+			measuredRuns++
+		}
+	}
+
+	runtime.Runs = runs
+	runtime.Starts = len(runs)
+	runtime.RunHours = totalMinutes / 60
+	if len(runs) > 0 {
+		runtime.AverageCycleMinutes = totalMinutes / float64(len(runs))
+	}
+	if measuredRuns > 0 {
+		runtime.LitersPerRun = totalLiters / float64(measuredRuns)
+	}
+
+	recentShortCycles := 0
+	for i, run := range runs {
+		if run.Running || run.Minutes >= shortCycleMinutes {
+			continue
+		}
+		runtime.ShortCycles++
+		if i >= len(runs)-shortCycleWindow {
+			recentShortCycles++
+		}
+	}
+	runtime.ShortCycling = recentShortCycles >= shortCycleLimit
+
+	return runtime, nil
+}
+
+// getPumpLevelHistory returns the level history over which the liters of the runs are measured
+func getPumpLevelHistory(tank Tank) []WaterLevel {
+	from := time.Now().AddDate(0, 0, -pumpLevelHistoryDays).Format(time.RFC3339)
+	levels, err := getLevelHistory(tank, from, "")
+	if err != nil {
+		// Runtime is still meaningful without the liters pumped
+		fmt.Println("Error retrieving water level history:", err)
+	}
+	return levels
+}
+
+// getTankPumpRuntimes computes the runtime accounting for every pump of the tank, the
+// liters of the runs are measured on the given levels
+func getTankPumpRuntimes(tank Tank, levels []WaterLevel) ([]PumpRuntime, error) {
+	now := time.Now()
+
+	var runtimes []PumpRuntime
+	for _, pump := range getTankPumps(tank) {
+		runtime, err := getPumpRuntime(pump, levels, now)
+		if err != nil {
+			return nil, err
+		}
+		runtimes = append(runtimes, runtime)
+	}
+
+	return runtimes, nil
+}
+
+// getMaintenanceStatus evaluates a schedule against the current run hours of its pump
+func getMaintenanceStatus(schedule PumpMaintenance, runHours float64, now time.Time) PumpMaintenanceStatus {
+	status := PumpMaintenanceStatus{
+		PumpMaintenance: schedule,
+		RunHours:        runHours,
+	}
+
+	if schedule.IntervalHours > 0 {
+		status.HoursRemaining = schedule.IntervalHours - (runHours - schedule.LastServiceRunHours)
+		if status.HoursRemaining <= 0 {
+			status.Due = true
+		}
+	}
+
+	if schedule.IntervalDays > 0 && schedule.LastService != nil {
+		due := schedule.LastService.AddDate(0, 0, schedule.IntervalDays)
+		status.DaysRemaining = due.Sub(now).Hours() / 24
+		if status.DaysRemaining <= 0 {
+			status.Due = true
+		}
+	}
+
+	return status
+}
+
+// getPumpMaintenanceStatuses evaluates all the pump maintenance schedules of a tank
+func getPumpMaintenanceStatuses(tank Tank) ([]PumpMaintenanceStatus, error) {
+	runHours := make(map[string]float64)
+	if len(tank.Meta.PumpMaintenance) > 0 {
+		// Only the run hours are needed, not the liters
+		runtimes, err := getTankPumpRuntimes(tank, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, runtime := range runtimes {
+			runHours[runtime.ActuatorID] = runtime.RunHours
+		}
+	}
+
+	now := time.Now()
+	statuses := []PumpMaintenanceStatus{}
+	for _, schedule := range tank.Meta.PumpMaintenance {
+		statuses = append(statuses, getMaintenanceStatus(schedule, runHours[schedule.ActuatorID], now))
+	}
+
+	return statuses, nil
+}
+
+// checkPumpMaintenance sends a reminder for every schedule that became due
+func checkPumpMaintenance(tank Tank) {
+	if len(tank.Meta.PumpMaintenance) == 0 {
+		return
+	}
+
+	now := time.Now()
+	pumpMaintenanceCheckedAtLock.Lock()
+	if last, ok := pumpMaintenanceCheckedAt[tank.ID]; ok && now.Sub(last) < time.Hour {
+		pumpMaintenanceCheckedAtLock.Unlock()
+		return
+	}
+	pumpMaintenanceCheckedAt[tank.ID] = now
+	pumpMaintenanceCheckedAtLock.Unlock()
+
+	statuses, err := getPumpMaintenanceStatuses(tank)
+	if err != nil {
+		fmt.Println("Error evaluating pump maintenance:", err)
+		return
+	}
+
+	changed := false
+	schedules := tank.Meta.PumpMaintenance
+	for i, status := range statuses {
+		if !status.Due || status.Notified {
+			continue
+		}
+
+		title := fmt.Sprintf("%s pump maintenance due", tank.Name)
+		body := fmt.Sprintf("%s is due for %s after %.1f run hours", tank.Name, status.Task, status.RunHours)
+		notifyTank(tank, title, body, PriorityMedium)
+
+		schedules[i].Notified = true
+		changed = true
+	}
+
+	if changed {
+		if err := postTankMeta(tank.ID, map[string]interface{}{"pumpMaintenance": schedules}); err != nil {
+			fmt.Println("Error updating pump maintenance:", err)
+		}
+	}
+}
+
+// GetPumpRuntimeHandler returns run hours, starts, cycle length and liters pumped for each pump of a tank
+func GetPumpRuntimeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	runtimes, err := getTankPumpRuntimes(tank, getPumpLevelHistory(tank))
+	if err != nil {
+		fmt.Println("Error computing pump runtime:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched pump runtime: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, runtimes)
+}
+
+// GetPumpMaintenanceHandler lists the pump maintenance schedules of a tank with their due status
+func GetPumpMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	statuses, err := getPumpMaintenanceStatuses(tank)
+	if err != nil {
+		fmt.Println("Error evaluating pump maintenance:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched pump maintenance: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, statuses)
+}
+
+// PostPumpMaintenanceHandler adds a maintenance schedule to a pump of the tank
+func PostPumpMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var schedule PumpMaintenance
+	if err = json.Unmarshal(body, &schedule); err != nil {
+		fmt.Println("Error unmarshaling pump maintenance:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if schedule.Task == "" || (schedule.IntervalHours <= 0 && schedule.IntervalDays <= 0) {
+		http.Error(w, "task and a positive intervalHours or intervalDays are required", http.StatusBadRequest)
+		return
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	pumps := getTankPumps(tank)
+	if schedule.ActuatorID == "" && len(pumps) > 0 {
+		schedule.ActuatorID = pumps[0].Actuator.ID
+	}
+
+	// Count the interval from now unless the last service is known
+	if schedule.LastService == nil {
+		now := time.Now()
+		schedule.LastService = &now
+
+		runtimes, err := getTankPumpRuntimes(tank, nil)
+		if err != nil {
+			fmt.Println("Error computing pump runtime:", err)
+		}
+		for _, runtime := range runtimes {
+			if runtime.ActuatorID == schedule.ActuatorID {
+				schedule.LastServiceRunHours = runtime.RunHours
+			}
+		}
+	}
+
+	schedule.ID = newID()
+	schedule.Notified = false
+
+	schedules := append(tank.Meta.PumpMaintenance, schedule)
+	if err = postTankMeta(tankID, map[string]interface{}{"pumpMaintenance": schedules}); err != nil {
+		fmt.Println("Error storing pump maintenance:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Pump maintenance schedule added: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, schedule)
+}
+
+// AckPumpMaintenanceHandler marks a maintenance schedule as serviced and restarts its interval
+func AckPumpMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+	scheduleID := vars["scheduleID"]
+
+	var ack struct {
+		User string `json:"user"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &ack); err != nil {
+			fmt.Println("Error unmarshaling acknowledgement:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	statuses, err := getPumpMaintenanceStatuses(tank)
+	if err != nil {
+		fmt.Println("Error evaluating pump maintenance:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	schedules := tank.Meta.PumpMaintenance
+	found := false
+	now := time.Now()
+	for i := range schedules {
+		if schedules[i].ID == scheduleID {
+			schedules[i].LastService = &now
+			schedules[i].LastServiceRunHours = statuses[i].RunHours
+			schedules[i].AcknowledgedBy = ack.User
+			schedules[i].Notified = false
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err = postTankMeta(tankID, map[string]interface{}{"pumpMaintenance": schedules}); err != nil {
+		fmt.Println("Error storing pump maintenance:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Pump maintenance acknowledged: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Pump maintenance acknowledged",
+	})
+}
+
+// DeletePumpMaintenanceHandler removes a maintenance schedule
+func DeletePumpMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+	scheduleID := vars["scheduleID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	schedules := []PumpMaintenance{}
+	for _, schedule := range tank.Meta.PumpMaintenance {
+		if schedule.ID != scheduleID {
+			schedules = append(schedules, schedule)
+		}
+	}
+
+	if len(schedules) == len(tank.Meta.PumpMaintenance) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err = postTankMeta(tankID, map[string]interface{}{"pumpMaintenance": schedules}); err != nil {
+		fmt.Println("Error storing pump maintenance:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Pump maintenance schedule deleted: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Pump maintenance schedule deleted",
+	})
+}
@@ -0,0 +1,374 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Profile applied to tanks without one, the bands the app always used
+const defaultQualityProfile = "default"
+
+// Label of readings of zero or below, which the TDS probes report when out of the water
+const qualityUnknown = "Unknown"
+
+// QualityBand covers the TDS values from Min up to, but not including, Max,
+// a zero Max leaves the band open ended. Readings in an alert band raise a notification.
+type QualityBand struct {
+	Label string  `json:"label" bson:"label"`
+	Min   float64 `json:"min" bson:"min"`
+	Max   float64 `json:"max" bson:"max"`
+	Alert bool    `json:"alert" bson:"alert"`
+}
+
+// QualityProfile is a named set of TDS bands for a region or a use of the water
+type QualityProfile struct {
+	ID      string        `json:"id" bson:"id"`
+	Name    string        `json:"name" bson:"name"`
+	Use     string        `json:"use" bson:"use"`
+	Unit    string        `json:"unit" bson:"unit"`
+	Bands   []QualityBand `json:"bands" bson:"bands"`
+	Builtin bool          `json:"builtin" bson:"builtin"`
+}
+
+type QualityResult struct {
+	Label   string       `json:"label"`
+	Alert   bool         `json:"alert"`
+	Band    *QualityBand `json:"band"`
+	Profile string       `json:"profile"`
+}
+
+// Profiles shipped with the backend, they cannot be edited
+var builtinQualityProfiles = []QualityProfile{
+	{
+		ID:   defaultQualityProfile,
+		Name: "Default",
+		Use:  "drinking",
+		Unit: "ppm",
+		Bands: []QualityBand{
+			{Label: "Excellent", Min: 0, Max: 300},
+			{Label: "Good", Min: 300, Max: 900},
+			{Label: "Poor", Min: 900, Alert: true},
+		},
+	},
+	{
+		// WHO palatability of drinking water by TDS
+		ID:   "drinking-who",
+		Name: "Drinking water (WHO)",
+		Use:  "drinking",
+		Unit: "ppm",
+		Bands: []QualityBand{
+			{Label: "Excellent", Min: 0, Max: 300},
+			{Label: "Good", Min: 300, Max: 600},
+			{Label: "Fair", Min: 600, Max: 900},
+			{Label: "Poor", Min: 900, Max: 1200, Alert: true},
+			{Label: "Unacceptable", Min: 1200, Alert: true},
+		},
+	},
+	{
+		// FAO guidelines for livestock drinking water by TDS
+		ID:   "livestock",
+		Name: "Livestock",
+		Use:  "livestock",
+		Unit: "ppm",
+		Bands: []QualityBand{
+			{Label: "Excellent", Min: 0, Max: 1000},
+			{Label: "Very satisfactory", Min: 1000, Max: 3000},
+			{Label: "Satisfactory", Min: 3000, Max: 5000},
+			{Label: "Limited use", Min: 5000, Max: 7000, Alert: true},
+			{Label: "Unsuitable", Min: 7000, Alert: true},
+		},
+	},
+	{
+		// FAO restriction on use of irrigation water by TDS
+		ID:   "irrigation",
+		Name: "Irrigation",
+		Use:  "irrigation",
+		Unit: "ppm",
+		Bands: []QualityBand{
+			{Label: "No restriction", Min: 0, Max: 450},
+			{Label: "Slight to moderate restriction", Min: 450, Max: 2000},
+			{Label: "Severe restriction", Min: 2000, Alert: true},
+		},
+	},
+}
+
+// Label of the last water quality alert, by tank
+var qualityNotified = make(map[string]string)
+var qualityNotifiedLock sync.Mutex
+
+// classify returns the band of the profile containing the value
+func (p QualityProfile) classify(value float64) QualityResult {
+	result := QualityResult{Label: qualityUnknown, Profile: p.ID}
+	if value <= 0 {
+		return result
+	}
+	for i, band := range p.Bands {
+		if value >= band.Min && (band.Max <= 0 || value < band.Max) {
+			result.Label = band.Label
+			result.Alert = band.Alert
+			result.Band = &p.Bands[i]
+			break
+		}
+	}
+	return result
+}
+
+// tdsLimit derives the TDS limit of the water quality index from the alert bands of the
+// profile, the index falls from the first alert band to 0 at the next one. With a single
+// alert band it falls over the same proportion as the guideline.
+func (p QualityProfile) tdsLimit(guideline QualityLimit) QualityLimit {
+	var alerts []float64
+	for _, band := range p.Bands {
+		if band.Alert && band.Min > 0 {
+			alerts = append(alerts, band.Min)
+		}
+	}
+	if len(alerts) == 0 {
+		return QualityLimit{}
+	}
+	sort.Float64s(alerts)
+
+	limit := QualityLimit{Max: alerts[0], ZeroMax: alerts[0] * guideline.ZeroMax / guideline.Max}
+	if len(alerts) > 1 {
+		limit.ZeroMax = alerts[1]
+	}
+	return limit
+}
+
+// validate checks that the bands are labelled and do not overlap
+func (p QualityProfile) validate() error {
+	if p.ID == "" || p.Name == "" {
+		return fmt.Errorf("id and name are required")
+	}
+	if len(p.Bands) == 0 {
+		return fmt.Errorf("at least one band is required")
+	}
+	for i, band := range p.Bands {
+		if band.Label == "" {
+			return fmt.Errorf("every band needs a label")
+		}
+		if band.Max > 0 && band.Max <= band.Min {
+			return fmt.Errorf("band %s: max must be above min", band.Label)
+		}
+		if i > 0 {
+			previous := p.Bands[i-1]
+			if previous.Max <= 0 || band.Min < previous.Max {
+				return fmt.Errorf("bands must be sorted and must not overlap")
+			}
+		}
+	}
+	return nil
+}
+
+// getCustomQualityProfiles returns the profiles stored in the gateway profile
+func getCustomQualityProfiles() ([]QualityProfile, error) {
+	var gateway struct {
+		QualityProfiles []QualityProfile `json:"qualityProfiles"`
+	}
+	if err := getGatewayMeta(&gateway); err != nil {
+		return nil, err
+	}
+	if gateway.QualityProfiles == nil {
+		return []QualityProfile{}, nil
+	}
+	return gateway.QualityProfiles, nil
+}
+
+// getQualityProfiles returns the built-in profiles followed by the custom ones
+func getQualityProfiles() []QualityProfile {
+	profiles := []QualityProfile{}
+	for _, builtin := range builtinQualityProfiles {
+		profile, _ := builtinQualityProfile(builtin.ID)
+		profiles = append(profiles, profile)
+	}
+
+	custom, err := getCustomQualityProfiles()
+	if err != nil {
+		fmt.Println("Error retrieving quality profiles:", err)
+		return profiles
+	}
+	return append(profiles, custom...)
+}
+
+// findQualityProfile returns the profile with the ID, falling back to the default profile
+func findQualityProfile(profiles []QualityProfile, profileID string) QualityProfile {
+	if profileID == "" {
+		profileID = defaultQualityProfile
+	}
+	for _, profile := range profiles {
+		if profile.ID == profileID {
+			return profile
+		}
+	}
+	profile, _ := builtinQualityProfile(defaultQualityProfile)
+	return profile
+}
+
+// builtinQualityProfile returns the built-in profile with the ID, an empty ID is the default profile
+func builtinQualityProfile(profileID string) (QualityProfile, bool) {
+	if profileID == "" {
+		profileID = defaultQualityProfile
+	}
+	for _, profile := range builtinQualityProfiles {
+		if profile.ID == profileID {
+			profile.Builtin = true
+			return profile, true
+		}
+	}
+	return QualityProfile{}, false
+}
+
+// tankQualityProfile returns the profile assigned to the tank, the gateway is only asked for custom profiles
+func tankQualityProfile(tank Tank) QualityProfile {
+	if profile, ok := builtinQualityProfile(tank.Meta.QualityProfile); ok {
+		return profile
+	}
+	return findQualityProfile(getQualityProfiles(), tank.Meta.QualityProfile)
+}
+
+// checkWaterQuality notifies when the TDS enters an alert band of the tank profile
+func checkWaterQuality(tank Tank) {
+	sensor, ok := findSensor(tank.Sensors, "WaterPollutantSensor")
+	if !ok {
+		return
+	}
+	value, ok := numericValue(sensor.Value)
+	if !ok {
+		return
+	}
+
+	result := tankQualityProfile(tank).classify(value)
+
+	label := ""
+	if result.Alert {
+		label = result.Label
+	}
+	qualityNotifiedLock.Lock()
+	previous := qualityNotified[tank.ID]
+	qualityNotified[tank.ID] = label
+	qualityNotifiedLock.Unlock()
+
+	if label == "" || label == previous {
+		return
+	}
+
+	title := fmt.Sprintf("Water quality in %s is %s", tank.Name, result.Label)
+	body := fmt.Sprintf("The TDS of %s is %d ppm, in the %s band of the %s profile.",
+		tank.Name, int(value), result.Label, result.Profile)
+	notifyTank(tank, title, body, PriorityHigh)
+}
+
+// GetQualityProfilesHandler lists the built-in and custom water quality profiles
+func GetQualityProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] Fetched quality profiles: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, getQualityProfiles())
+}
+
+// PostQualityProfileHandler creates or replaces a custom water quality profile
+func PostQualityProfileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var profile QualityProfile
+	if err = json.Unmarshal(body, &profile); err != nil {
+		fmt.Println("Error unmarshaling quality profile:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if profileID, ok := vars["profileID"]; ok {
+		profile.ID = profileID
+	}
+	if profile.Unit == "" {
+		profile.Unit = "ppm"
+	}
+	profile.Builtin = false
+
+	if err = profile.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := builtinQualityProfile(profile.ID); ok {
+		http.Error(w, "built-in profiles cannot be changed", http.StatusForbidden)
+		return
+	}
+
+	profiles, err := getCustomQualityProfiles()
+	if err != nil {
+		fmt.Println("Error retrieving quality profiles:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	replaced := false
+	for i := range profiles {
+		if profiles[i].ID == profile.ID {
+			profiles[i] = profile
+			replaced = true
+		}
+	}
+	if !replaced {
+		profiles = append(profiles, profile)
+	}
+
+	if err = postGatewayMeta(map[string]interface{}{"qualityProfiles": profiles}); err != nil {
+		fmt.Println("Error storing quality profiles:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Quality profile saved: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, profile)
+}
+
+// DeleteQualityProfileHandler removes a custom water quality profile,
+// tanks still assigned to it fall back to the default profile
+func DeleteQualityProfileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	profileID := vars["profileID"]
+
+	profiles, err := getCustomQualityProfiles()
+	if err != nil {
+		fmt.Println("Error retrieving quality profiles:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	remaining := []QualityProfile{}
+	for _, profile := range profiles {
+		if profile.ID != profileID {
+			remaining = append(remaining, profile)
+		}
+	}
+	if len(remaining) == len(profiles) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err = postGatewayMeta(map[string]interface{}{"qualityProfiles": remaining}); err != nil {
+		fmt.Println("Error storing quality profiles:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Quality profile deleted: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Quality profile deleted",
+	})
+}
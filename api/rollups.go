@@ -0,0 +1,204 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	IntervalHour  = "hour"
+	IntervalDay   = "day"
+	IntervalWeek  = "week"
+	IntervalMonth = "month"
+)
+
+// Most buckets returned by a single rollup request
+const maxRollupBuckets = 5000
+
+// Window used when the request has no from date
+const defaultRollupDays = 30
+
+// Rollup is the consumption and level of a tank over one bucket,
+// the level fields are null when the bucket has no readings
+type Rollup struct {
+	Start          time.Time `json:"start" bson:"start"`
+	End            time.Time `json:"end" bson:"end"`
+	ConsumedLiters float64   `json:"consumedLiters" bson:"consumedLiters"`
+	RefilledLiters float64   `json:"refilledLiters" bson:"refilledLiters"`
+	MinLevel       *float64  `json:"minLevel" bson:"minLevel"`
+	MaxLevel       *float64  `json:"maxLevel" bson:"maxLevel"`
+	AvgLevel       *float64  `json:"avgLevel" bson:"avgLevel"`
+	Readings       int       `json:"readings" bson:"readings"`
+}
+
+// bucketStart aligns t to the start of its bucket in the given timezone,
+// weeks start on Monday
+func bucketStart(t time.Time, interval string, loc *time.Location) time.Time {
+	local := t.In(loc)
+	switch interval {
+	case IntervalHour:
+		return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, loc)
+	case IntervalWeek:
+		offset := (int(local.Weekday()) + 6) % 7
+		return time.Date(local.Year(), local.Month(), local.Day()-offset, 0, 0, 0, 0, loc)
+	case IntervalMonth:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+	}
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+}
+
+// nextBucket returns the start of the bucket following start,
+// calendar arithmetic keeps days aligned across daylight saving changes
+func nextBucket(start time.Time, interval string) time.Time {
+	switch interval {
+	case IntervalHour:
+		return start.Add(time.Hour)
+	case IntervalWeek:
+		return start.AddDate(0, 0, 7)
+	case IntervalMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+func validInterval(interval string) bool {
+	switch interval {
+	case IntervalHour, IntervalDay, IntervalWeek, IntervalMonth:
+		return true
+	}
+	return false
+}
+
+// getRollups buckets the level history between from and to, including the buckets without readings
+func getRollups(levels []WaterLevel, settings Settings, interval string, from time.Time, to time.Time, loc *time.Location) ([]Rollup, error) {
+	rollups := []Rollup{}
+	index := make(map[int64]int)
+
+	for start := bucketStart(from, interval, loc); start.Before(to); start = nextBucket(start, interval) {
+		if len(rollups) >= maxRollupBuckets {
+			return nil, fmt.Errorf("too many buckets, use a larger interval or a shorter range")
+		}
+		index[start.Unix()] = len(rollups)
+		rollups = append(rollups, Rollup{Start: start, End: nextBucket(start, interval)})
+	}
+
+	sums := make([]float64, len(rollups))
+	filtered := filterNoise(levels, settings.Capacity)
+	for i, entry := range levels {
+		position, ok := index[bucketStart(*entry.Timestamp, interval, loc).Unix()]
+		if !ok {
+			continue
+		}
+		rollup := &rollups[position]
+
+		level := entry.Level
+		if rollup.Readings == 0 {
+			rollup.MinLevel = &level
+			maxLevel := level
+			rollup.MaxLevel = &maxLevel
+		} else if level < *rollup.MinLevel {
+			*rollup.MinLevel = level
+		} else if level > *rollup.MaxLevel {
+			*rollup.MaxLevel = level
+		}
+		sums[position] += level
+		rollup.Readings++
+
+		// The step from the previous reading counts in the bucket of the reading that ends it
+		if i == 0 || entry.Gap {
+			continue
+		}
+		delta := filtered[i].Level - filtered[i-1].Level
+		switch classifyStep(delta) {
+		case EventConsumption:
+			rollup.ConsumedLiters += -delta
+		case EventRefill:
+			rollup.RefilledLiters += delta
+		}
+	}
+
+	for i := range rollups {
+		if rollups[i].Readings > 0 {
+			avg := sums[i] / float64(rollups[i].Readings)
+			rollups[i].AvgLevel = &avg
+		}
+	}
+
+	return rollups, nil
+}
+
+// GetRollupsHandler returns the consumption, refills and level of a tank per hour, day, week or month
+func GetRollupsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = IntervalDay
+	}
+	if !validInterval(interval) {
+		http.Error(w, "interval must be hour, day, week or month", http.StatusBadRequest)
+		return
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	loc := tankLocation(tank)
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -defaultRollupDays)
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Align the requested range to whole buckets
+	from = bucketStart(from, interval, loc)
+	if end := bucketStart(to, interval, loc); end.Before(to) {
+		to = nextBucket(end, interval)
+	}
+
+	levels, err := getLevelHistory(tank, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		fmt.Println("Error retrieving water level history:", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rollups, err := getRollups(levels, tank.Meta.Settings, interval, from, to, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[%s] Fetched tank rollups: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, rollups)
+}
+
+// parseTime reads a date given as RFC3339 or as a plain date in the tank timezone
+func parseTime(value string, loc *time.Location) (time.Time, error) {
+	// A "+" in the query string is decoded as a space
+	value = strings.ReplaceAll(value, " ", "+")
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
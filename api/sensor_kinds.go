@@ -0,0 +1,477 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// What the critical_min and critical_max of a sensor are compared with
+const (
+	AlertsPercent = "percent"
+	AlertsValue   = "value"
+)
+
+// SensorKind describes how the readings of a kind of sensor are served. The value is
+// transformed before it is classified, like the distance of a level sensor to liters.
+type SensorKind struct {
+	Kind   string   `json:"kind"`
+	Slugs  []string `json:"slugs"`
+	Name   string   `json:"name"`
+	Unit   string   `json:"unit"`
+	Alerts string   `json:"alerts"`
+
+	// Level readings are distances, fused when a tank has several level sensors and
+	// corrected for the temperature before they are transformed
+	level     bool
+	fused     bool
+	transform func(tank Tank, value float64) float64
+	classify  func(tank Tank) func(value float64) (string, *QualityBand)
+}
+
+// SensorReading is the current value of a sensor
+type SensorReading struct {
+	SensorID    string       `json:"sensorID"`
+	Kind        string       `json:"kind"`
+	Unit        string       `json:"unit"`
+	Value       float64      `json:"value"`
+	Raw         interface{}  `json:"raw"`
+	Label       string       `json:"label,omitempty"`
+	Band        *QualityBand `json:"band,omitempty"`
+	Time        *time.Time   `json:"time"`
+	CriticalMin float64      `json:"critical_min"`
+	CriticalMax float64      `json:"critical_max"`
+
+	Compensation *LevelCompensation `json:"compensation,omitempty"`
+}
+
+// SensorPoint is a value of a sensor history
+type SensorPoint struct {
+	Time  time.Time    `json:"time"`
+	Value float64      `json:"value"`
+	Label string       `json:"label,omitempty"`
+	Band  *QualityBand `json:"band,omitempty"`
+}
+
+// Sensor kinds served by the /tanks/{tankID}/sensors/{kindOrID} routes
+var sensorKinds = []SensorKind{
+	{
+		Kind: "WaterLevel", Slugs: []string{"waterlevel", "water-level"},
+		Name: "Water level", Unit: "L", Alerts: AlertsPercent,
+		level: true,
+		transform: func(tank Tank, value float64) float64 {
+			return toLiters(tank.Meta.Settings, value)
+		},
+	},
+	{
+		Kind: "WaterThermometer", Slugs: []string{"water-temperature", "temperature"},
+		Name: "Water temperature", Unit: "°C", Alerts: AlertsValue,
+	},
+	{
+		Kind: KindAirThermometer, Slugs: []string{"air-temperature"},
+		Name: "Air temperature", Unit: "°C", Alerts: AlertsValue,
+	},
+	{
+		Kind: KindTDS, Slugs: []string{"water-quality", "tds"},
+		Name: "Total dissolved solids", Unit: "ppm", Alerts: AlertsValue,
+		classify: classifyTDS,
+	},
+	{
+		Kind: KindPH, Slugs: []string{"ph"},
+		Name: "pH", Unit: "pH", Alerts: AlertsValue,
+		classify: classifyParameter(KindPH),
+	},
+	{
+		Kind: KindTurbidity, Slugs: []string{"turbidity"},
+		Name: "Turbidity", Unit: "NTU", Alerts: AlertsValue,
+		classify: classifyParameter(KindTurbidity),
+	},
+	{
+		Kind: KindChlorine, Slugs: []string{"chlorine"},
+		Name: "Free chlorine", Unit: "mg/L", Alerts: AlertsValue,
+		classify: classifyParameter(KindChlorine),
+	},
+	{
+		Kind: KindORP, Slugs: []string{"orp"},
+		Name: "Oxidation reduction potential", Unit: "mV", Alerts: AlertsValue,
+		classify: classifyParameter(KindORP),
+	},
+	{
+		Kind: KindConductivity, Slugs: []string{"conductivity"},
+		Name: "Conductivity", Unit: "µS/cm", Alerts: AlertsValue,
+		classify: classifyParameter(KindConductivity),
+	},
+	{
+		// Flow meters report either a total or a rate, the unit is the one of the sensor
+		Kind: KindFlowMeter, Slugs: []string{"flow"},
+		Name: "Flow meter", Alerts: AlertsValue,
+	},
+	{
+		// Computed from an expression, the unit is the one of the virtual sensor
+		Kind: KindVirtual, Slugs: []string{"virtual"},
+		Name: "Virtual sensor", Alerts: AlertsValue,
+	},
+	{
+		Kind: "VoltageSensor", Slugs: []string{"battery", "voltage"},
+		Name: "Battery voltage", Unit: "V", Alerts: AlertsValue,
+	},
+}
+
+// classifyTDS labels TDS readings with the bands of the quality profile of the tank
+func classifyTDS(tank Tank) func(value float64) (string, *QualityBand) {
+	profile := tankQualityProfile(tank)
+	return func(value float64) (string, *QualityBand) {
+		quality := profile.classify(value)
+		return quality.Label, quality.Band
+	}
+}
+
+// classifyParameter labels readings with the category of their water quality sub-index
+func classifyParameter(kind string) func(tank Tank) func(value float64) (string, *QualityBand) {
+	return func(tank Tank) func(value float64) (string, *QualityBand) {
+		parameter, _ := qualityParameter(kind)
+		limit := parameter.limit(tank)
+		return func(value float64) (string, *QualityBand) {
+			reading := readParameter(parameter, limit, value)
+			if !reading.Valid {
+				return qualityUnknown, nil
+			}
+			return qualityCategory(reading.Index), nil
+		}
+	}
+}
+
+// sensorKind returns the registered kind with the slug or kind name
+func sensorKind(name string) (SensorKind, bool) {
+	for _, kind := range sensorKinds {
+		if strings.EqualFold(kind.Kind, name) {
+			return kind, true
+		}
+		for _, slug := range kind.Slugs {
+			if strings.EqualFold(slug, name) {
+				return kind, true
+			}
+		}
+	}
+	return SensorKind{}, false
+}
+
+// unit returns the unit of the kind, falling back to the one of the sensor
+func (k SensorKind) unit(sensor SensorData) string {
+	if k.Unit != "" {
+		return k.Unit
+	}
+	return sensor.Meta.Unit
+}
+
+func (k SensorKind) value(tank Tank, value float64) float64 {
+	if k.transform == nil {
+		return value
+	}
+	return k.transform(tank, value)
+}
+
+// resolveSensors finds the sensors of a tank by sensor ID, registered kind or slug, or
+// by the kind stored in their meta. Sensors of unregistered kinds are served as they are.
+func resolveSensors(tank Tank, kindOrID string) (SensorKind, []SensorData) {
+	for _, sensor := range tank.Sensors {
+		if sensor.ID == kindOrID {
+			kind, ok := sensorKind(sensor.Meta.Kind)
+			if !ok {
+				kind = SensorKind{Kind: sensor.Meta.Kind, Alerts: AlertsValue}
+			}
+			return kind, []SensorData{sensor}
+		}
+	}
+
+	// Virtual sensors are also found by their key
+	for _, virtual := range tank.Meta.VirtualSensors {
+		if virtual.Key == kindOrID && virtual.SensorID != "" {
+			return resolveSensors(tank, virtual.SensorID)
+		}
+	}
+
+	kind, ok := sensorKind(kindOrID)
+	if !ok {
+		kind = SensorKind{Kind: kindOrID, Alerts: AlertsValue}
+	}
+
+	sensors := []SensorData{}
+	for _, sensor := range tank.Sensors {
+		if strings.EqualFold(sensor.Meta.Kind, kind.Kind) {
+			sensors = append(sensors, sensor)
+		}
+	}
+	return kind, sensors
+}
+
+// loadKindTank returns the tank of the request, writing the error response when it cannot
+// be read. A tank unknown to the gateway is answered with 404.
+func loadKindTank(w http.ResponseWriter, r *http.Request) (Tank, bool) {
+	tank, err := getTank(mux.Vars(r)["tankID"])
+	if errors.Is(err, errTankNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return tank, false
+	}
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return tank, false
+	}
+	return tank, true
+}
+
+// findKindSensor returns the first sensor of a tank matching kindOrID
+func findKindSensor(tank Tank, kindOrID string) (SensorKind, SensorData, bool) {
+	kind, sensors := resolveSensors(tank, kindOrID)
+	if len(sensors) == 0 {
+		return kind, SensorData{}, false
+	}
+
+	// Redundant level sensors asked for by kind are served as one
+	if kind.level && len(sensors) > 1 {
+		if sensor, ok := levelSensor(tank); ok {
+			kind.fused = true
+			return kind, sensor, true
+		}
+	}
+	return kind, sensors[0], true
+}
+
+// loadKindSensor returns the tank of the request with the first of its sensors matching
+// the kindOrID route variable, writing the error response when there is none
+func loadKindSensor(w http.ResponseWriter, r *http.Request) (Tank, SensorKind, SensorData, bool) {
+	tank, ok := loadKindTank(w, r)
+	if !ok {
+		return tank, SensorKind{}, SensorData{}, false
+	}
+
+	kindOrID := mux.Vars(r)["kindOrID"]
+	kind, sensor, ok := findKindSensor(tank, kindOrID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no %s sensor on this tank", kindOrID), http.StatusNotFound)
+		return tank, kind, sensor, false
+	}
+	return tank, kind, sensor, true
+}
+
+// getSensorReading transforms and classifies the current value of a sensor
+func getSensorReading(tank Tank, kind SensorKind, sensor SensorData) SensorReading {
+	reading := SensorReading{
+		SensorID:    sensor.ID,
+		Kind:        sensor.Meta.Kind,
+		Unit:        kind.unit(sensor),
+		Raw:         sensor.Value,
+		Time:        sensor.Time,
+		CriticalMin: sensor.Meta.CriticalMin,
+		CriticalMax: sensor.Meta.CriticalMax,
+	}
+
+	value, ok := numericValue(sensor.Value)
+	if !ok {
+		return reading
+	}
+	if kind.level {
+		value, reading.Compensation = compensateDistance(tank, value)
+	}
+	reading.Value = kind.value(tank, value)
+	if kind.classify != nil {
+		reading.Label, reading.Band = kind.classify(tank)(reading.Value)
+	}
+	return reading
+}
+
+// getSensorPoints returns the transformed history of a sensor between from and to,
+// downsampled when requested and classified after downsampling
+func getSensorPoints(tank Tank, kind SensorKind, sensor SensorData, from string, to string, options DownsampleOptions, downsampled bool) ([]SensorPoint, error) {
+	var history []HistoryPoint
+	if kind.fused {
+		fused, err := getLevelDistances(tank, from, to)
+		if err != nil {
+			return nil, err
+		}
+		history = fused
+	} else {
+		values, err := getSensorValues(tank.ID, sensor.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		history = sensorHistoryPoints(values)
+
+		var compensation *compensationSeries
+		if kind.level {
+			if compensation, err = getCompensationSeries(tank, from, to); err != nil {
+				return nil, err
+			}
+		}
+		for i := range history {
+			history[i].Value = compensation.distance(history[i].Time, history[i].Value)
+		}
+	}
+	for i := range history {
+		history[i].Value = kind.value(tank, history[i].Value)
+	}
+	if downsampled {
+		history = downsample(history, options, tankLocation(tank))
+	}
+
+	var classify func(value float64) (string, *QualityBand)
+	if kind.classify != nil {
+		classify = kind.classify(tank)
+	}
+
+	points := []SensorPoint{}
+	for _, point := range history {
+		entry := SensorPoint{Time: point.Time, Value: point.Value}
+		if classify != nil {
+			entry.Label, entry.Band = classify(point.Value)
+		}
+		points = append(points, entry)
+	}
+	return points, nil
+}
+
+// loadSensorPoints returns the history of a sensor for the from/to and downsampling options
+// of the request, writing the error response when it cannot be read
+func loadSensorPoints(w http.ResponseWriter, r *http.Request, tank Tank, kind SensorKind, sensor SensorData) ([]SensorPoint, bool) {
+	options, downsampled, err := parseDownsampleOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	points, err := getSensorPoints(tank, kind, sensor, r.URL.Query().Get("from"), r.URL.Query().Get("to"), options, downsampled)
+	if err != nil {
+		fmt.Println("Error retrieving sensor values:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return points, true
+}
+
+// sensorKindRoute serves a generic sensor handler for a fixed kind, used by the older per-kind routes
+func sensorKindRoute(kind string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		vars["kindOrID"] = kind
+		handler(w, mux.SetURLVars(r, vars))
+	}
+}
+
+// GetSensorKindsHandler lists the registered sensor kinds
+func GetSensorKindsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] Fetched sensor kinds: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, sensorKinds)
+}
+
+// GetKindSensorsHandler lists the sensors of a tank of a kind, or the sensor with an ID
+func GetKindSensorsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tank, ok := loadKindTank(w, r)
+	if !ok {
+		return
+	}
+
+	_, sensors := resolveSensors(tank, vars["kindOrID"])
+
+	log.Printf("[%s] Fetched %s sensors: %s %s", time.Now().Format(time.RFC3339), vars["kindOrID"], r.Method, r.URL.Path)
+
+	writeJSON(w, sensors)
+}
+
+// GetKindValueHandler returns the current value of a sensor with its unit and classification
+func GetKindValueHandler(w http.ResponseWriter, r *http.Request) {
+	tank, kind, sensor, ok := loadKindSensor(w, r)
+	if !ok {
+		return
+	}
+
+	log.Printf("[%s] Fetched sensor value: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, getSensorReading(tank, kind, sensor))
+}
+
+// GetKindValuesHandler returns the history of a sensor, optionally downsampled
+func GetKindValuesHandler(w http.ResponseWriter, r *http.Request) {
+	tank, kind, sensor, ok := loadKindSensor(w, r)
+	if !ok {
+		return
+	}
+
+	points, ok := loadSensorPoints(w, r, tank, kind, sensor)
+	if !ok {
+		return
+	}
+
+	log.Printf("[%s] Fetched sensor history: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, points)
+}
+
+// PostKindAlertsHandler sets the critical_min and critical_max of a sensor. They are a
+// percentage of the capacity for water level sensors and a value in the unit of the sensor otherwise.
+func PostKindAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	tank, kind, sensor, ok := loadKindSensor(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var fields map[string]interface{}
+	if err = json.Unmarshal(body, &fields); err != nil {
+		http.Error(w, "invalid alert settings", http.StatusBadRequest)
+		return
+	}
+
+	limits := make(map[string]float64)
+	for _, field := range []string{"critical_min", "critical_max"} {
+		raw, ok := fields[field]
+		if !ok {
+			continue
+		}
+		value, ok := numericValue(raw)
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s must be a number", field), http.StatusBadRequest)
+			return
+		}
+		if kind.Alerts == AlertsPercent && (value < 0 || value > 100) {
+			http.Error(w, fmt.Sprintf("%s must be a percentage between 0 and 100", field), http.StatusBadRequest)
+			return
+		}
+		limits[field] = value
+		fields[field] = value
+	}
+	if low, ok := limits["critical_min"]; ok {
+		if high, ok := limits["critical_max"]; ok && high > 0 && low > high {
+			http.Error(w, "critical_min must not be above critical_max", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err = postSensorMeta(tank.ID, sensor.ID, fields); err != nil {
+		fmt.Println("Error updating sensor meta:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Changed %s alerts: %s %s", time.Now().Format(time.RFC3339), sensor.Meta.Kind, r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Meta field updated successfully",
+	})
+}
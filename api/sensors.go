@@ -1,15 +1,8 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -22,1209 +15,147 @@ type ValueData struct {
 }
 
 type WaterLevel struct {
-	Level     float64        `json:"liters"`
+	Level     float64    `json:"liters"`
 	Timestamp *time.Time `json:"timestamp"`
+	// Gap marks the first reading after a maintenance period, the change from
+	// the reading before it is not counted as consumption or refill
+	Gap bool `json:"gap,omitempty"`
 }
 
-// WaterLevelSensorHandler handles requests to retrieve water level sensors in a specific tank
-func WaterLevelSensorHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+// The per-kind routes below keep the response format of the app, the
+// /tanks/{tankID}/sensors/{kindOrID} routes serve every kind in the same format
 
-	tankID := vars["tankID"]
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of DeviceData
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Filter the sensors based on tankID and kind = "WaterLevel" in the meta field
-	var waterLevelSensors []SensorData
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			for _, sensor := range tank.Sensors {
-				if sensor.Meta.Kind == "WaterLevel" {
-					waterLevelSensors = append(waterLevelSensors, sensor)
-				}
-			}
-			break
-		}
-	}
-
-	// Marshal the water level sensors into JSON
-	response, err := json.Marshal(waterLevelSensors)
-	if err != nil {
-		fmt.Println("Error marshaling water level sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	log.Printf("[%s] Water level fetch: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
-
-	// Write the JSON response to the response writer
-	w.Write(response)
-}
-
-// GetWaterLevelHandler handles requests to retrieve the amount of water in liters for a specific tank
+// GetWaterLevelValueHandler returns the amount of water in liters in a tank
 func GetWaterLevelValueHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	tank, kind, sensor, ok := loadKindSensor(w, r)
+	if !ok {
 		return
 	}
 
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Find the tank with the specified ID
-	var targetTank Tank
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			targetTank = tank
-			break
-		}
-	}
-
-	if targetTank.ID == "" {
-		// Tank with the specified ID not found
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	// Find the water level sensor value for the specified tank
-	var waterLevelValue interface{}
-	var timestamp *time.Time
-	for _, sensor := range targetTank.Sensors {
-		if sensor.Meta.Kind == "WaterLevel" {
-			waterLevelValue = sensor.Value
-			timestamp = sensor.Time
-			break
-		}
-	}
-
-	if waterLevelValue == nil {
-		// Water level sensor not found for the specified tank
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	// Calculate the amount of water in liters
-	tankHeight := targetTank.Meta.Settings.Height
-	tankOffset := targetTank.Meta.Settings.Offset
-	tankCapacity := targetTank.Meta.Settings.Capacity
-	sensorValue := waterLevelValue.(float64)
-
-	liters := 0.0
-
-	if tankCapacity > 0 && tankHeight > 0 {
-
-		calculatedValue := ((tankHeight - (sensorValue - tankOffset)) / tankHeight) * tankCapacity
-		liters = float64(calculatedValue)
-
-	}
-
-	response := WaterLevel{
-		Level:     liters,
-		Timestamp: timestamp,
-	}
-
-	responseJSONBytes, err := json.Marshal(response)
-
-	if err != nil {
-		fmt.Println("Error marshaling water level:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Marshal the amount of water in liters into JSON
-	// response, err := json.Marshal(map[string]int{"liters": liters})
-	if err != nil {
-		fmt.Println("Error marshaling water level value:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
+	reading := getSensorReading(tank, kind, sensor)
 
 	log.Printf("[%s] Water quantity fetched (Liters): %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
 
-	// Write the JSON response to the response writer
-	w.Write(responseJSONBytes)
+	writeJSON(w, WaterLevel{
+		Level:     reading.Value,
+		Timestamp: reading.Time,
+	})
 }
 
+// GetWaterLevelHistoryHandler returns the liters history of a tank, empty when it has no
+// water level sensor
 func GetWaterLevelHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	tankID := vars["tankID"]	
-
-	// Send a GET request to localhost/devices/tankID/sensors
-	resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors", tankID))
-	if err != nil {
-		fmt.Println("Error retrieving sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	sensorBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading sensor response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the sensor data into a slice of SensorData
-	var sensors []SensorData
-	err = json.Unmarshal(sensorBody, &sensors)
-	if err != nil {
-		fmt.Println("Error unmarshaling sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	tank, ok := loadKindTank(w, r)
+	if !ok {
 		return
 	}
 
-	// Find the water level sensor based on the sensor kind in the meta field
-	var waterLevelSensor SensorData
-	for _, sensor := range sensors {
-		if sensor.Meta.Kind == "WaterLevel" {
-			waterLevelSensor = sensor
-			break
+	points := []SensorPoint{}
+	if kind, sensor, found := findKindSensor(tank, mux.Vars(r)["kindOrID"]); found {
+		if points, ok = loadSensorPoints(w, r, tank, kind, sensor); !ok {
+			return
 		}
 	}
 
-	// Check if a water level sensor was found
-	if waterLevelSensor.ID == "" {
-		fmt.Println("Water level sensor not found")
-		// var values []SensorData
-		// w.WriteHeader(http.StatusNotFound)
-		// return
-	}	
-
-	// Send a GET request to localhost/devices/tankID/sensors/waterlevel/values
-	// resp, err = http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/values?limit=5", tankID, waterLevelSensor.ID))
-
-	baseURL := "http://localhost/devices/%s/sensors/%s/values"
-	formattedURL := fmt.Sprintf(baseURL, tankID, waterLevelSensor.ID)
-
-	// Parse the URL
-	u, err := url.Parse(formattedURL)
-	if err != nil {
-		fmt.Println("Error parsing URL:", err)
-		return
-	}
-	
-	from := strings.ReplaceAll(r.URL.Query().Get("from"), " ", "+")
-	to := strings.ReplaceAll(r.URL.Query().Get("to"), " ", "+")
-
-	q := u.Query()
-	q.Set("from", from)
-	q.Set("to", to)
-	// q.Set("limit", string(10))
-	// q.Set("sort", "asc")
-	
-	u.RawQuery = q.Encode()
-
-	// Perform the GET request
-	resp, err = http.Get(u.String())
-	if err != nil {
-		fmt.Println("Error retrieving water level values:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	valuesBody, err := io.ReadAll(resp.Body)
-
-	if err != nil {
-		fmt.Println("Error reading values response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the values data into a slice of ValueData
-	var values []SensorData
-	err = json.Unmarshal(valuesBody, &values)
-
-	// if len(values) < 5 {
-	// 	fmt.Println("LESS VALS")
-	// 	resp, err = http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/values", tankID, waterLevelSensor.ID))
-	// 	if err != nil {
-	// 		fmt.Println("Error retrieving water level values:", err)
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-	
-	// 	defer resp.Body.Close()
-	
-	// 	// Check response status code
-	// 	if resp.StatusCode != http.StatusOK {
-	// 		fmt.Println("Unexpected status code:", resp.StatusCode)
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-	
-	// 	// Check Content-Type
-	// 	contentType := resp.Header.Get("Content-Type")
-	// 	if contentType != "application/json" {
-	// 		fmt.Println("Unexpected content type:", contentType)
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-	
-	// 	// Read the response body
-	// 	valuesBody, err := ioutil.ReadAll(resp.Body)
-	// 	if err != nil {
-	// 		fmt.Println("Error reading values response body:", err)
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-		
-	// 	// Unmarshal the values data into a slice of ValueData
-	// 	err = json.Unmarshal(valuesBody, &values)
-	// 	if err != nil {
-	// 		fmt.Println("Error unmarshaling values:", err)
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-	// }
-
-	if err != nil {
-		fmt.Println("Error unmarshaling values:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Send a GET request to localhost/devices
-	resp2, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp2.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp2.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Find the tank with the specified ID
-	var targetTank Tank
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			targetTank = tank
-			break
-		}
-	}
-	// Check if tank information is available
-	if targetTank.ID == "" {
-		fmt.Println("Tank information not found")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	waterLevelEntries := []WaterLevel{}
+	for _, point := range points {
+		timestamp := point.Time
+		waterLevelEntries = append(waterLevelEntries, WaterLevel{Level: point.Value, Timestamp: &timestamp})
 	}
 
-	var waterLevelEntries []WaterLevel
-	var timestamp *time.Time
-	for _, value := range values {
-		sensorValue := value.Value
-
-		timestamp = value.Time
-		liters := 0.0
-		if targetTank.Meta.Settings.Height > 0 && targetTank.Meta.Settings.Capacity > 0 {
-			calculatedValue := ((targetTank.Meta.Settings.Height - (sensorValue.(float64) - targetTank.Meta.Settings.Offset)) / targetTank.Meta.Settings.Height) * targetTank.Meta.Settings.Capacity
-			liters = (calculatedValue)
-		}
-
-		entry := WaterLevel{
-			Level:     liters,
-			Timestamp: timestamp,
-		}
-		waterLevelEntries = append(waterLevelEntries, entry)
-	}
+	log.Printf("[%s] Water quantity history fetched: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
 
-	responseJSON := struct {
+	writeJSON(w, struct {
 		WaterLevels []WaterLevel `json:"waterLevels"`
 	}{
 		WaterLevels: waterLevelEntries,
-	}
-
-	// Marshal the response object into JSON
-	responseJSONBytes, err := json.Marshal(responseJSON)
-	if err != nil {
-		fmt.Println("Error marshaling response:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	log.Printf("[%s] Water quantity history fetched: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
-
-	// Write the JSON response to the response writer
-	w.Write(responseJSONBytes)
+	})
 }
 
-// WaterTemperatureSensorHandler handles requests to retrieve water temperature sensors in a specific tank
-func WaterTemperatureSensorHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Filter the sensors based on tankID and kind = "WaterThermometer" in the meta field
-	var waterTemperatureSensors []SensorData
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			for _, sensor := range tank.Sensors {
-				if sensor.Meta.Kind == "WaterThermometer" {
-					waterTemperatureSensors = append(waterTemperatureSensors, sensor)
-				}
-			}
-			break
-		}
-	}
-
-	// Marshal the water temperature sensors into JSON
-	response, err := json.Marshal(waterTemperatureSensors)
-	if err != nil {
-		fmt.Println("Error marshaling water temperature sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	log.Printf("[%s] Fetched water temperature sensors: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
-
-	// Write the JSON response to the response writer
-	w.Write(response)
-}
-
-// GetWaterTemperatureValueHandler handles requests to retrieve the value of the water temperature sensor for a specific tank
+// GetWaterTemperatureValueHandler returns the value of the water temperature sensor of a tank,
+// null when it has none
 func GetWaterTemperatureValueHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	tank, ok := loadKindTank(w, r)
+	if !ok {
 		return
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Find the water temperature sensor value for the specified tank ID
-	var waterTemperatureValue interface{}
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			for _, sensor := range tank.Sensors {
-				if sensor.Meta.Kind == "WaterThermometer" {
-					waterTemperatureValue = sensor.Value
-					break
-				}
-			}
-			break
-		}
-	}
-
-	// Marshal the water temperature value into JSON
-	response, err := json.Marshal(waterTemperatureValue)
-	if err != nil {
-		fmt.Println("Error marshaling water temperature value:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
+	_, sensor, _ := findKindSensor(tank, mux.Vars(r)["kindOrID"])
 
 	log.Printf("[%s] Fetched water temperature value: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
 
-	// Write the JSON response to the response writer
-	w.Write(response)
+	writeJSON(w, sensor.Value)
 }
 
-// GetWaterLevelHistoryHandler handles requests to retrieve water temperature values for a specific tank
+// GetWaterTemperatureHistoryHandler returns the water temperature history of a tank
 func GetWaterTemperatureHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices/tankID/sensors
-	resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors", tankID))
-	if err != nil {
-		fmt.Println("Error retrieving sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	sensorBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading sensor response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the sensor data into a slice of SensorData
-	var sensors []SensorData
-	err = json.Unmarshal(sensorBody, &sensors)
-	if err != nil {
-		fmt.Println("Error unmarshaling sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Find the water temperature sensor based on the sensor kind in the meta field
-	var waterTemperatureSensor SensorData
-	for _, sensor := range sensors {
-		if sensor.Meta.Kind == "WaterThermometer" {
-			waterTemperatureSensor = sensor
-			break
-		}
-	}
-
-	// Check if a water temperature sensor was found
-	if waterTemperatureSensor.ID == "" {
-		fmt.Println("Water temperature sensor not found")
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	// Send a GET request to localhost/devices/tankID/sensors/watertemperature/values
-	resp, err = http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/values", tankID, waterTemperatureSensor.ID))
-	if err != nil {
-		fmt.Println("Error retrieving water temperature values:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	tank, kind, sensor, ok := loadKindSensor(w, r)
+	if !ok {
 		return
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	valuesBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading values response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	points, ok := loadSensorPoints(w, r, tank, kind, sensor)
+	if !ok {
 		return
 	}
 
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	log.Printf("[%s] Fetch water level history: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+	log.Printf("[%s] Fetch water temperature history: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
 
-	// Write the JSON response to the response writer
-	w.Write(valuesBody)
+	writeJSON(w, points)
 }
 
-// WaterQualitySensorHandler handles requests to retrieve water quality sensors in a specific tank
-func WaterQualitySensorHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Filter the sensors based on tankID and kind = "WaterPollutantSensor" in the meta field
-	var waterQualitySensors []SensorData
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			for _, sensor := range tank.Sensors {
-				if sensor.Meta.Kind == "WaterPollutantSensor" {
-					waterQualitySensors = append(waterQualitySensors, sensor)
-				}
-			}
-			break
-		}
-	}
-
-	// Marshal the water quality sensors into JSON
-	response, err := json.Marshal(waterQualitySensors)
-	if err != nil {
-		fmt.Println("Error marshaling water quality sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	log.Printf("[%s] Fetched Water quality sensors: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
-
-	// Write the JSON response to the response writer
-	w.Write(response)
-}
-
-// GetWaterQualityValueHandler handles requests to retrieve the value of the water quality sensor for a specific tank
+// GetWaterQualityValueHandler returns the TDS of a tank classified with its quality profile
 func GetWaterQualityValueHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	tank, ok := loadKindTank(w, r)
+	if !ok {
 		return
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	// A tank without a TDS sensor is reported without data like one that has not sent a value yet
+	waterQuality := "No data available"
+	var band *QualityBand
+	kind, sensor, found := findKindSensor(tank, mux.Vars(r)["kindOrID"])
+	if found && sensor.Value != nil {
+		reading := getSensorReading(tank, kind, sensor)
+		waterQuality = reading.Label
+		band = reading.Band
 	}
 
-	// Find the water quality sensor value for the specified tank ID
-	var waterQualityValue interface{}
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			for _, sensor := range tank.Sensors {
-				if sensor.Meta.Kind == "WaterPollutantSensor" {
-					waterQualityValue = sensor.Value
-					break
-				}
-			}
-			break
-		}
-	}
-
-	// Categorize the water quality based on the value ranges
-	var waterQuality string
-	if waterQualityValue != nil {
-		value, ok := waterQualityValue.(float64)
-		if !ok {
-			fmt.Println("Error converting water quality value to float64")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		if value > 0 && value < 300 {
-			waterQuality = "Excellent"
-		} else if value >= 300 && value < 900 {
-			waterQuality = "Good"
-		} else if value >= 900 {
-			waterQuality = "Poor"
-		} else {
-			waterQuality = "Unknown"
-		}
-	} else {
-		waterQuality = "No data available"
-	}
-
-	// Create a map for the response
-	response := map[string]interface{}{
-		"waterQuality": waterQuality,
-		"tdsValue":     waterQualityValue,
-	}
-
-	// Marshal the response into JSON
-	responseBody, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error marshaling response:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
 	log.Printf("[%s] Fetched Water quality: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
 
-	// Write the JSON response to the response writer
-	w.Write(responseBody)
+	writeJSON(w, map[string]interface{}{
+		"waterQuality": waterQuality,
+		"tdsValue":     sensor.Value,
+		"band":         band,
+		"profile":      tankQualityProfile(tank),
+	})
 }
 
-// GetWaterQualityHistoryHandler handles requests to retrieve water quality values for a specific tank
+// GetWaterQualityHistoryHandler returns the TDS history of a tank classified with its quality profile
 func GetWaterQualityHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices/tankID/sensors
-	resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors", tankID))
-	if err != nil {
-		fmt.Println("Error retrieving sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	sensorBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading sensor response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the sensor data into a slice of SensorData
-	var sensors []SensorData
-	err = json.Unmarshal(sensorBody, &sensors)
-	if err != nil {
-		fmt.Println("Error unmarshaling sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	tank, kind, sensor, ok := loadKindSensor(w, r)
+	if !ok {
 		return
 	}
 
-	// Find the water quality sensor based on the sensor kind in the meta field
-	var waterQualitySensor SensorData
-	for _, sensor := range sensors {
-		if sensor.Meta.Kind == "WaterPollutantSensor" {
-			waterQualitySensor = sensor
-			break
-		}
-	}
-
-	// Check if a water quality sensor was found
-	if waterQualitySensor.ID == "" {
-		fmt.Println("Water quality sensor not found")
-		w.WriteHeader(http.StatusNotFound)
+	points, ok := loadSensorPoints(w, r, tank, kind, sensor)
+	if !ok {
 		return
 	}
 
-	// Send a GET request to localhost/devices/tankID/sensors/waterquality/values
-	resp, err = http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/values", tankID, waterQualitySensor.ID))
-	if err != nil {
-		fmt.Println("Error retrieving water quality values:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	valuesBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading values response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the values data into a slice of ValueData
-	var values []ValueData
-	err = json.Unmarshal(valuesBody, &values)
-	if err != nil {
-		fmt.Println("Error unmarshaling values:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	profile := tankQualityProfile(tank)
+	categorizedValues := []map[string]interface{}{}
+	for _, point := range points {
+		categorizedValues = append(categorizedValues, map[string]interface{}{
+			"tdsValue":     point.Value,
+			"waterQuality": point.Label,
+			"band":         point.Band,
+			"profile":      profile.ID,
+			"timestamp":    point.Time,
+		})
 	}
 
-	// Categorize the water quality values based on the value ranges
-	var categorizedValues []map[string]interface{}
-	for _, value := range values {
-		waterQuality := ""
-		v := value.Value
-
-		if v > 0 && v < 300 {
-			waterQuality = "Excellent"
-		} else if v >= 300 && v < 900 {
-			waterQuality = "Good"
-		} else if v >= 900 {
-			waterQuality = "Poor"
-		} else {
-			waterQuality = "Unknown"
-		}
-
-		categorizedValue := map[string]interface{}{
-			"tdsValue":     value.Value,
-			"waterQuality": waterQuality,
-			"timestamp":    value.Timestamp,
-		}
-
-		categorizedValues = append(categorizedValues, categorizedValue)
-	}
-
-	// Marshal the categorized values into JSON
-	response, err := json.Marshal(categorizedValues)
-	if err != nil {
-		fmt.Println("Error marshaling categorized values:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
 	log.Printf("[%s] Fetched Water quality history: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
 
-	// Write the JSON response to the response writer
-	w.Write(response)
-}
-
-func ChangeWaterLevelAlerts(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Find the tank with the specified ID
-	var targetTank Tank
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			targetTank = tank
-			break
-		}
-	}
-
-	if targetTank.ID == "" {
-		// Tank with the specified ID not found
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	// Find the water level sensor value for the specified tank
-	// sensorID := ""
-	var sensorID string
-	for _, sensor := range targetTank.Sensors {
-		if sensor.Meta.Kind == "WaterLevel" {
-			sensorID = sensor.ID
-			break
-		}
-	}
-
-	// Read the request body
-	metaBody, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		fmt.Println("Error reading request body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Send a POST request to localhost/devices/tankID/meta
-	client := http.DefaultClient
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost/devices/%s/sensors/%s/meta", tankID, sensorID), bytes.NewReader(metaBody))
-	if err != nil {
-		fmt.Println("Error creating POST request:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to text/plain
-	req.Header.Set("Content-Type", "application/json")
-
-	resp2, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error sending POST request:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp2.Body.Close()
-
-	// Check the response status code
-	if resp2.StatusCode != http.StatusOK {
-		fmt.Println("Received non-OK response:", resp2.Status)
-		// Print the response body for further analysis
-		responseBody, _ := ioutil.ReadAll(resp2.Body)
-		fmt.Println("Response body:", string(responseBody))
-		w.WriteHeader(resp2.StatusCode)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	// Write a success response
-	response := map[string]string{
-		"message": "Meta field updated successfully",
-	}
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error marshaling response:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("[%s] Changed water tank level alerts: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
-
-	w.Write(responseBytes)
-}
-
-func ChangeWaterTemperatureAlerts(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Find the tank with the specified ID
-	var targetTank Tank
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			targetTank = tank
-			break
-		}
-	}
-
-	if targetTank.ID == "" {
-		// Tank with the specified ID not found
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	// Find the water level sensor value for the specified tank
-	// sensorID := ""
-	var sensorID string
-	for _, sensor := range targetTank.Sensors {
-		if sensor.Meta.Kind == "WaterThermometer" {
-			sensorID = sensor.ID
-			break
-		}
-	}
-
-	// Read the request body
-	metaBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		fmt.Println("Error reading request body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Send a POST request to localhost/devices/tankID/meta
-	client := http.DefaultClient
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost/devices/%s/sensors/%s/meta", tankID, sensorID), bytes.NewReader(metaBody))
-	if err != nil {
-		fmt.Println("Error creating POST request:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to text/plain
-	req.Header.Set("Content-Type", "application/json")
-
-	resp2, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error sending POST request:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp2.Body.Close()
-
-	// Check the response status code
-	if resp2.StatusCode != http.StatusOK {
-		fmt.Println("Received non-OK response:", resp2.Status)
-		// Print the response body for further analysis
-		responseBody, _ := ioutil.ReadAll(resp2.Body)
-		fmt.Println("Response body:", string(responseBody))
-		w.WriteHeader(resp2.StatusCode)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	// Write a success response
-	response := map[string]string{
-		"message": "Meta field updated successfully",
-	}
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error marshaling response:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("[%s] Changed water tank temperature alerts: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
-
-	w.Write(responseBytes)
-}
-
-func ChangeWaterQualityAlerts(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	tankID := vars["tankID"]
-
-	// Send a GET request to localhost/devices
-	resp, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Find the tank with the specified ID
-	var targetTank Tank
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			targetTank = tank
-			break
-		}
-	}
-
-	if targetTank.ID == "" {
-		// Tank with the specified ID not found
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	// Find the water level sensor value for the specified tank
-	// sensorID := ""
-	var sensorID string
-	for _, sensor := range targetTank.Sensors {
-		if sensor.Meta.Kind == "WaterPollutantSensor" {
-			sensorID = sensor.ID
-			break
-		}
-	}
-
-	// Read the request body
-	metaBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		fmt.Println("Error reading request body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Send a POST request to localhost/devices/tankID/meta
-	client := http.DefaultClient
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost/devices/%s/sensors/%s/meta", tankID, sensorID), bytes.NewReader(metaBody))
-	if err != nil {
-		fmt.Println("Error creating POST request:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Set the Content-Type header to text/plain
-	req.Header.Set("Content-Type", "application/json")
-
-	resp2, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error sending POST request:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp2.Body.Close()
-
-	// Check the response status code
-	if resp2.StatusCode != http.StatusOK {
-		fmt.Println("Received non-OK response:", resp2.Status)
-		// Print the response body for further analysis
-		responseBody, _ := ioutil.ReadAll(resp2.Body)
-		fmt.Println("Response body:", string(responseBody))
-		w.WriteHeader(resp2.StatusCode)
-		return
-	}
-
-	// Set the Content-Type header to application/json
-	w.Header().Set("Content-Type", "application/json")
-
-	// Write a success response
-	response := map[string]string{
-		"message": "Meta field updated successfully",
-	}
-	responseBytes, err := json.Marshal(response)
-	if err != nil {
-		fmt.Println("Error marshaling response:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	log.Printf("[%s] Changed water tank quality alerts: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
-
-	w.Write(responseBytes)
+	writeJSON(w, categorizedValues)
 }
@@ -0,0 +1,491 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOk       = "ok"
+	StatusWarning  = "warning"
+	StatusCritical = "critical"
+	StatusOffline  = "offline"
+)
+
+const (
+	AlertLowLevel        = "low-level"
+	AlertHighLevel       = "high-level"
+	AlertBurst           = "burst"
+	AlertLeak            = "leak"
+	AlertTemperature     = "temperature"
+	AlertWaterQuality    = "water-quality"
+	AlertVirtualSensor   = "virtual-sensor"
+	AlertLevelSensor     = "level-sensor"
+	AlertFreezeRisk      = "freeze-risk"
+	AlertLegionella      = "legionella-risk"
+	AlertHeatStress      = "heat-stress"
+	AlertTankMaintenance = "maintenance-overdue"
+	AlertPumpMaintenance = "pump-maintenance"
+	AlertPumpSlowFill    = "pump-slow-fill"
+	AlertRunningOut      = "running-out"
+	AlertMaintenanceMode = "maintenance-mode"
+)
+
+// Alerts that make a tank critical rather than a warning
+var criticalAlerts = map[string]bool{
+	AlertBurst:    true,
+	AlertLowLevel: true,
+}
+
+// A tank that has not reported for this long is offline
+const defaultOfflineMinutes = 30
+
+// A leak recorded within this window is still active
+const activeLeakWindow = 48 * time.Hour
+
+type PumpState struct {
+	DeviceID   string `json:"deviceID"`
+	ActuatorID string `json:"actuatorID"`
+	Name       string `json:"name"`
+	Running    bool   `json:"running"`
+}
+
+type TankSummary struct {
+	ID           string        `json:"id"`
+	Name         string        `json:"name"`
+	Liters       float64       `json:"liters"`
+	Capacity     float64       `json:"capacity"`
+	Percent      float64       `json:"percent"`
+	Online       bool          `json:"online"`
+	LastSeen     *time.Time    `json:"lastSeen"`
+	Battery      interface{}   `json:"battery"`
+	Status       string        `json:"status"`
+	Alerts       []string      `json:"alerts"`
+	DaysLeft     *float64      `json:"daysLeft"`
+	EmptyAt      *time.Time    `json:"emptyAt"`
+	Pumps        []PumpState   `json:"pumps"`
+	Location     Location      `json:"location"`
+	QualityIndex *QualityIndex `json:"qualityIndex"`
+	OverdueTasks []OverdueTask `json:"overdueTasks"`
+}
+
+type FleetTotals struct {
+	Tanks            int            `json:"tanks"`
+	Online           int            `json:"online"`
+	Offline          int            `json:"offline"`
+	Capacity         float64        `json:"capacity"`
+	Liters           float64        `json:"liters"`
+	Percent          float64        `json:"percent"`
+	Alerts           int            `json:"alerts"`
+	PumpsRunning     int            `json:"pumpsRunning"`
+	Statuses         map[string]int `json:"statuses"`
+	ShortestDaysLeft *float64       `json:"shortestDaysLeft"`
+	OverdueTasks     int            `json:"overdueTasks"`
+}
+
+type FleetSummary struct {
+	Totals FleetTotals   `json:"totals"`
+	Tanks  []TankSummary `json:"tanks"`
+}
+
+// lastSeen returns the time of the latest sensor reading of the tank
+func lastSeen(tank Tank) *time.Time {
+	var latest *time.Time
+	for _, sensor := range tank.Sensors {
+		if sensor.Time != nil && (latest == nil || sensor.Time.After(*latest)) {
+			latest = sensor.Time
+		}
+	}
+	return latest
+}
+
+// outsideLimits checks a reading against the alert limits of its sensor, unset limits are ignored
+func outsideLimits(value float64, meta SensorMeta) bool {
+	return (meta.CriticalMin != 0 && value <= meta.CriticalMin) || (meta.CriticalMax != 0 && value >= meta.CriticalMax)
+}
+
+// summarizeTank builds the summary row of a tank from the device list. The gateway is only
+// called again for a tank assigned a custom quality profile, to read that profile.
+func summarizeTank(tank Tank, devices map[string]Tank, offlineAfter time.Duration, now time.Time) TankSummary {
+	summary := TankSummary{
+		ID:       tank.ID,
+		Name:     tank.Name,
+		Capacity: tank.Meta.Settings.Capacity,
+		Alerts:   []string{},
+		Pumps:    []PumpState{},
+		Location: tank.Meta.Location,
+	}
+
+	summary.LastSeen = lastSeen(tank)
+	summary.Online = summary.LastSeen != nil && now.Sub(*summary.LastSeen) <= offlineAfter
+
+	// The level is fused from the level sensors when the tank has several
+	if sensor, ok := levelSensor(tank); ok {
+		if value, ok := numericValue(sensor.Value); ok {
+			summary.Liters = currentLiters(tank, value)
+			if summary.Capacity > 0 {
+				summary.Percent = summary.Liters / summary.Capacity * 100
+				// Limits left at 0 are unset, as in outsideLimits
+				if sensor.Meta.CriticalMin != 0 && summary.Percent <= sensor.Meta.CriticalMin {
+					summary.Alerts = append(summary.Alerts, AlertLowLevel)
+				} else if sensor.Meta.CriticalMax != 0 && summary.Percent >= sensor.Meta.CriticalMax {
+					summary.Alerts = append(summary.Alerts, AlertHighLevel)
+				}
+			}
+		}
+	}
+	if len(levelSensors(tank)) > 1 {
+		if fusion, ok := getLevelFusion(tank); ok && len(fusion.Faults) > 0 {
+			summary.Alerts = append(summary.Alerts, AlertLevelSensor)
+		}
+	}
+
+	// TDS alerts follow the quality profile of the tank
+	qualityAlert := false
+	for _, sensor := range tank.Sensors {
+		value, ok := numericValue(sensor.Value)
+		switch sensor.Meta.Kind {
+		case "VoltageSensor":
+			summary.Battery = sensor.Value
+		case "WaterThermometer":
+			if ok && outsideLimits(value, sensor.Meta) {
+				summary.Alerts = append(summary.Alerts, AlertTemperature)
+			}
+		case KindVirtual:
+			if ok && outsideLimits(value, sensor.Meta) {
+				summary.Alerts = append(summary.Alerts, AlertVirtualSensor)
+			}
+		case "WaterPollutantSensor":
+			if ok && tankQualityProfile(tank).classify(value).Alert {
+				qualityAlert = true
+			}
+		}
+	}
+
+	// Every parameter alerts through the index as well, TDS against the profile of the tank
+	summary.QualityIndex = getQualityIndex(tank)
+	if summary.QualityIndex != nil && summary.QualityIndex.Index < 50 {
+		qualityAlert = true
+	}
+	if qualityAlert {
+		summary.Alerts = append(summary.Alerts, AlertWaterQuality)
+	}
+
+	// Temperature risks, the Legionella one needs the history and comes from the monitor
+	if !tank.Meta.TemperatureSettings.Disabled {
+		_, _, risks := currentTemperatureRisks(tank, tank.Meta.TemperatureSettings.withDefaults(tank))
+		for _, risk := range risks {
+			switch risk {
+			case RiskFreeze:
+				summary.Alerts = append(summary.Alerts, AlertFreezeRisk)
+			case RiskHeatStress:
+				summary.Alerts = append(summary.Alerts, AlertHeatStress)
+			}
+		}
+		temperatureLock.Lock()
+		if temperatureLegionella[tank.ID] {
+			summary.Alerts = append(summary.Alerts, AlertLegionella)
+		}
+		temperatureLock.Unlock()
+	}
+
+	// Pumps on the tank and on its linked actuator device
+	actuatorDevices := []Tank{tank}
+	if linked, ok := devices[tank.Meta.ActuatorID]; ok && linked.ID != tank.ID {
+		actuatorDevices = append(actuatorDevices, linked)
+	}
+	for _, device := range actuatorDevices {
+		for _, actuator := range device.Actuators {
+			if actuator.ActuatorMeta.Kind != "Motor" {
+				continue
+			}
+			value, _ := numericValue(actuator.Value)
+			summary.Pumps = append(summary.Pumps, PumpState{
+				DeviceID:   device.ID,
+				ActuatorID: actuator.ID,
+				Name:       actuator.Name,
+				Running:    value > 0,
+			})
+		}
+	}
+
+	// Alerts raised by the monitors
+	burstNotifiedLock.Lock()
+	if burstNotified[tank.ID] {
+		summary.Alerts = append(summary.Alerts, AlertBurst)
+	}
+	burstNotifiedLock.Unlock()
+
+	if history := tank.Meta.LeakHistory; len(history) > 0 && now.Sub(history[len(history)-1].Detected) < activeLeakWindow {
+		summary.Alerts = append(summary.Alerts, AlertLeak)
+	}
+
+	for _, schedule := range tank.Meta.PumpMaintenance {
+		if schedule.Notified {
+			summary.Alerts = append(summary.Alerts, AlertPumpMaintenance)
+			break
+		}
+	}
+
+	summary.OverdueTasks = getOverdueTasks(tank, now)
+	if len(summary.OverdueTasks) > 0 {
+		summary.Alerts = append(summary.Alerts, AlertTankMaintenance)
+	}
+
+	for _, pump := range summary.Pumps {
+		if last, ok := tank.Meta.FillRateNotified[pump.ActuatorID]; ok && now.Sub(last) < 24*time.Hour {
+			summary.Alerts = append(summary.Alerts, AlertPumpSlowFill)
+			break
+		}
+	}
+
+	if tank.Meta.MaintenanceMode.isActive(now) {
+		summary.Alerts = append(summary.Alerts, AlertMaintenanceMode)
+	}
+
+	return summary
+}
+
+// status ranks the tank by its worst alert
+func (s *TankSummary) updateStatus() {
+	s.Status = StatusOk
+	if !s.Online {
+		s.Status = StatusOffline
+		return
+	}
+	for _, alert := range s.Alerts {
+		if criticalAlerts[alert] {
+			s.Status = StatusCritical
+			return
+		}
+		s.Status = StatusWarning
+	}
+}
+
+// Forecasts computed at the same time by the fleet summary, each one reads the level history
+const forecastWorkers = 4
+
+// addForecasts fills in the days left of each tank, the forecasts are computed by a few workers
+func addForecasts(summaries []TankSummary, tanks map[string]Tank, now time.Time) {
+	jobs := make(chan *TankSummary)
+	var wg sync.WaitGroup
+	for n := 0; n < forecastWorkers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for summary := range jobs {
+				addForecast(summary, tanks[summary.ID], now)
+			}
+		}()
+	}
+
+	for i := range summaries {
+		tank := tanks[summaries[i].ID]
+		if tank.Meta.Settings.Capacity <= 0 || tank.Meta.ForecastSettings.Disabled {
+			continue
+		}
+		jobs <- &summaries[i]
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// addForecast fills in the days left of a tank and the running out alert
+func addForecast(summary *TankSummary, tank Tank, now time.Time) {
+	forecast, err := getCachedForecast(tank, summary.Liters)
+	if err != nil {
+		fmt.Println("Error forecasting water level:", err)
+		return
+	}
+
+	if forecast.Empty != nil && forecast.Empty.Expected != nil {
+		daysLeft := forecast.Empty.Expected.Sub(now).Hours() / 24
+		if daysLeft < 0 {
+			daysLeft = 0
+		}
+		summary.DaysLeft = &daysLeft
+		summary.EmptyAt = forecast.Empty.Expected
+	}
+
+	notifyHours := tank.Meta.ForecastSettings.NotifyHours
+	if notifyHours <= 0 {
+		notifyHours = 48
+	}
+	if reserve := forecast.Reserve; reserve != nil && reserve.Expected != nil {
+		hours := reserve.Expected.Sub(now).Hours()
+		if hours > 0 && hours <= notifyHours {
+			summary.Alerts = append(summary.Alerts, AlertRunningOut)
+		}
+	}
+}
+
+// sortSummaries orders the rows by a field, a leading "-" sorts in descending order
+func sortSummaries(summaries []TankSummary, field string) error {
+	descending := strings.HasPrefix(field, "-")
+	field = strings.TrimPrefix(field, "-")
+
+	statusRank := map[string]int{StatusCritical: 0, StatusWarning: 1, StatusOffline: 2, StatusOk: 3}
+
+	var less func(a, b TankSummary) bool
+	switch field {
+	case "", "name":
+		less = func(a, b TankSummary) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	case "percent":
+		less = func(a, b TankSummary) bool { return a.Percent < b.Percent }
+	case "liters":
+		less = func(a, b TankSummary) bool { return a.Liters < b.Liters }
+	case "daysLeft":
+		// Tanks without a forecast go last
+		less = func(a, b TankSummary) bool {
+			if a.DaysLeft == nil || b.DaysLeft == nil {
+				return a.DaysLeft != nil
+			}
+			return *a.DaysLeft < *b.DaysLeft
+		}
+	case "status":
+		less = func(a, b TankSummary) bool { return statusRank[a.Status] < statusRank[b.Status] }
+	case "alerts":
+		less = func(a, b TankSummary) bool { return len(a.Alerts) < len(b.Alerts) }
+	default:
+		return fmt.Errorf("sort must be name, percent, liters, daysLeft, status or alerts")
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if descending {
+			return less(summaries[j], summaries[i])
+		}
+		return less(summaries[i], summaries[j])
+	})
+	return nil
+}
+
+// filterSummaries keeps the rows matching the comma separated statuses and alerts, either may be empty
+func filterSummaries(summaries []TankSummary, statuses string, alerts string) []TankSummary {
+	wanted := func(list string, value string) bool {
+		for _, item := range strings.Split(list, ",") {
+			if strings.TrimSpace(item) == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	filtered := []TankSummary{}
+	for _, summary := range summaries {
+		if statuses != "" && !wanted(statuses, summary.Status) {
+			continue
+		}
+		if alerts != "" {
+			matched := false
+			for _, alert := range summary.Alerts {
+				if wanted(alerts, alert) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		filtered = append(filtered, summary)
+	}
+	return filtered
+}
+
+// summarizeFleet totals the rows
+func summarizeFleet(summaries []TankSummary) FleetTotals {
+	totals := FleetTotals{
+		Tanks:    len(summaries),
+		Statuses: map[string]int{StatusOk: 0, StatusWarning: 0, StatusCritical: 0, StatusOffline: 0},
+	}
+	for _, summary := range summaries {
+		if summary.Online {
+			totals.Online++
+		} else {
+			totals.Offline++
+		}
+		totals.Capacity += summary.Capacity
+		totals.Liters += summary.Liters
+		totals.Alerts += len(summary.Alerts)
+		totals.OverdueTasks += len(summary.OverdueTasks)
+		totals.Statuses[summary.Status]++
+		for _, pump := range summary.Pumps {
+			if pump.Running {
+				totals.PumpsRunning++
+			}
+		}
+		if summary.DaysLeft != nil && (totals.ShortestDaysLeft == nil || *summary.DaysLeft < *totals.ShortestDaysLeft) {
+			daysLeft := *summary.DaysLeft
+			totals.ShortestDaysLeft = &daysLeft
+		}
+	}
+	if totals.Capacity > 0 {
+		totals.Percent = totals.Liters / totals.Capacity * 100
+	}
+	return totals
+}
+
+// GetSummaryHandler returns the state of every tank on the gateway with fleet totals,
+// sort=percent lists the emptiest tanks first
+func GetSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	offlineAfter := defaultOfflineMinutes * time.Minute
+	if value := query.Get("offlineAfter"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			http.Error(w, "offlineAfter must be a duration such as 30m", http.StatusBadRequest)
+			return
+		}
+		offlineAfter = duration
+	}
+
+	devices, err := getTanks()
+	if err != nil {
+		fmt.Println("Error requesting devices:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The first device is the gateway itself, as in TankHandler
+	if len(devices) > 0 {
+		devices = devices[1:]
+	}
+
+	byID := make(map[string]Tank)
+	for _, device := range devices {
+		byID[device.ID] = device
+	}
+
+	now := time.Now()
+	summaries := []TankSummary{}
+	for _, device := range devices {
+		summaries = append(summaries, summarizeTank(device, byID, offlineAfter, now))
+	}
+
+	if query.Get("forecast") != "false" {
+		addForecasts(summaries, byID, now)
+	}
+
+	for i := range summaries {
+		summaries[i].updateStatus()
+	}
+
+	summaries = filterSummaries(summaries, query.Get("status"), query.Get("alert"))
+	if err := sortSummaries(summaries, query.Get("sort")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[%s] Fetched fleet summary: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, FleetSummary{
+		Totals: summarizeFleet(summaries),
+		Tanks:  summaries,
+	})
+}
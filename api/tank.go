@@ -8,8 +8,6 @@ import (
 	"log"
 	"math"
 	"net/http"
-	"net/url"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -24,6 +22,9 @@ type Tank struct {
 	Meta     TankMeta     `json:"meta" bson:"meta"`
 	Modified time.Time    `json:"modified" bson:"modified"`
 	Created  time.Time    `json:"created" bson:"created"`	
+	QualityIndex *QualityIndex `json:"qualityIndex,omitempty" bson:"-"`
+	Level    *LevelFusion `json:"level,omitempty" bson:"-"`
+	OverdueTasks []OverdueTask `json:"overdueTasks,omitempty" bson:"-"`
 }
 
 type TankMeta struct {
@@ -34,6 +35,31 @@ type TankMeta struct {
 	Profile				Profile		 `json:"profile" bson:"profile"`
 	ActuatorID			string	 	 `json:"actuatorID" bson:"actuatorID"`
 	Assigned			bool 		 `json:"assigned" bson:"assigned"`
+	PumpMaintenance		[]PumpMaintenance `json:"pumpMaintenance" bson:"pumpMaintenance"`
+	PumpSettings		PumpSettings `json:"pumpSettings" bson:"pumpSettings"`
+	MaintenanceMode		MaintenanceMode `json:"maintenanceMode" bson:"maintenanceMode"`
+	MaintenanceLog		[]MaintenancePeriod `json:"maintenanceLog" bson:"maintenanceLog"`
+	LeakSettings		LeakSettings `json:"leakSettings" bson:"leakSettings"`
+	LeakHistory			[]LeakRecord `json:"leakHistory" bson:"leakHistory"`
+	BurstSettings		BurstSettings `json:"burstSettings" bson:"burstSettings"`
+	ForecastSettings	ForecastSettings `json:"forecastSettings" bson:"forecastSettings"`
+	Timezone			string `json:"timezone" bson:"timezone"`
+	Tariff				Tariff `json:"tariff" bson:"tariff"`
+	Deliveries			[]Delivery `json:"deliveries" bson:"deliveries"`
+	Household			Household `json:"household" bson:"household"`
+	QualityProfile		string `json:"qualityProfile" bson:"qualityProfile"`
+	QualityLimits		map[string]QualityLimit `json:"qualityLimits" bson:"qualityLimits"`
+	FlowSettings		FlowSettings `json:"flowSettings" bson:"flowSettings"`
+	VirtualSensors		[]VirtualSensor `json:"virtualSensors" bson:"virtualSensors"`
+	Compensation		CompensationSettings `json:"compensation" bson:"compensation"`
+	LevelFusion			LevelFusionSettings `json:"levelFusion" bson:"levelFusion"`
+	DiagnosticSettings	DiagnosticSettings `json:"diagnosticSettings" bson:"diagnosticSettings"`
+	TemperatureSettings	TemperatureSettings `json:"temperatureSettings" bson:"temperatureSettings"`
+	MaintenanceTasks	[]MaintenanceTask `json:"maintenanceTasks" bson:"maintenanceTasks"`
+	DosingSettings		DosingSettings `json:"dosingSettings" bson:"dosingSettings"`
+	DosingLog			[]DosingRecord `json:"dosingLog" bson:"dosingLog"`
+	DoserRun			*DoserRun `json:"doserRun" bson:"doserRun"`
+	FillRateNotified	map[string]time.Time `json:"fillRateNotified" bson:"fillRateNotified"`
 }
 
 //Majiup sensor structure
@@ -104,6 +130,7 @@ type SensorMeta struct {
 	Unit        string  `json:"units" bson:"units"`
 	CriticalMin float64 `json:"critical_min" bson:"critical_min"`
 	CriticalMax float64 `json:"critical_max" bson:"critical_max"`
+	Quality     *QualityResult `json:"quality,omitempty" bson:"quality,omitempty"`
 }
 
 type ActuatorMeta struct {
@@ -262,6 +289,12 @@ type Analytics struct {
 	Average 		Average `json:"average" bson:"average"`
 	Trend 			Trend	`json:"trend" bson:"trend"`
 	DurationLeft	int	`json:"durationLeft" bson:"durationLeft"`
+	Pumps			[]PumpPerformance `json:"pumps" bson:"pumps"`
+	Events			EventSummary `json:"events" bson:"events"`
+	Forecast		Forecast `json:"forecast" bson:"forecast"`
+	Cost			*CostSummary `json:"cost" bson:"cost"`
+	Household		*HouseholdUsage `json:"household" bson:"household"`
+	Flow			*FlowSummary `json:"flow" bson:"flow"`
 }
 
 func getConsumption(quantity []WaterLevel ) []Consumption {
@@ -354,8 +387,6 @@ func getTrend(consumption []Consumption) Trend {
 
 	if len(consumption) > countValidForTrend {
 		consumption = consumption[len(consumption)-countValidForTrend:]
-	} else {
-		consumption = consumption
 	}
 
 	for i := 0; i <= len(consumption) - 1; i++ {
@@ -380,6 +411,9 @@ func getTrend(consumption []Consumption) Trend {
 
 func getDurationLeft(consumption []Consumption, currentAmount  float64, ) int {
 	avg := getConsumptionAverage(consumption, "hours")
+	if avg <= 0 || math.IsNaN(avg) || math.IsInf(avg, 0) {
+		return 0
+	}
 
 	hoursLeft := int(currentAmount / avg)
 	daysLeft := int(hoursLeft / 24)
@@ -427,232 +461,47 @@ func getAnalytics(w http.ResponseWriter, r *http.Request) {
 
 	tankID := vars["tankID"]
 
-	// Send a GET request to localhost/devices/tankID/sensors
-	resp, err := http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors", tankID))
-	if err != nil {
-		fmt.Println("Error retrieving sensors:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	sensorBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading sensor response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Unmarshal the sensor data into a slice of SensorData
-	var sensors []SensorData
-	err = json.Unmarshal(sensorBody, &sensors)
+	targetTank, err := getTank(tankID)
 	if err != nil {
-		fmt.Println("Error unmarshaling sensors:", err)
+		fmt.Println("Tank information not found:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Find the water level sensor based on the sensor kind in the meta field
-	var waterLevelSensor SensorData
-	for _, sensor := range sensors {
-		if sensor.Meta.Kind == "WaterLevel" {
-			waterLevelSensor = sensor
-			break
-		}
-	}
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
 
-	// Check if a water level sensor was found
-	if waterLevelSensor.ID == "" {
-		fmt.Println("Water level sensor not found")
-		// var values []SensorData
-		// w.WriteHeader(http.StatusNotFound)
-		// return
-	}
-
-	baseURL := "http://localhost/devices/%s/sensors/%s/values"
-	formattedURL := fmt.Sprintf(baseURL, tankID, waterLevelSensor.ID)
-
-	// Parse the URL
-	u, err := url.Parse(formattedURL)
-	if err != nil {
-		fmt.Println("Error parsing URL:", err)
-		return
-	}
-	
-	from := strings.ReplaceAll(r.URL.Query().Get("from"), " ", "+")
-	to := strings.ReplaceAll(r.URL.Query().Get("to"), " ", "+")
-
-	q := u.Query()
-	q.Set("from", from)
-	q.Set("to", to)
-	
-	u.RawQuery = q.Encode()
-
-	// Perform the GET request
-	resp, err = http.Get(u.String())
-
-	// resp, err = http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/values", tankID, waterLevelSensor.ID))
-
-	fmt.Println()
+	// Readings taken while the tank was in maintenance mode are left out
+	waterLevelEntries, err := getLevelHistory(targetTank, from, to)
 	if err != nil {
 		fmt.Println("Error retrieving water level values:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	defer resp.Body.Close()
-
-	// Check response status code
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("Unexpected status code:", resp.StatusCode)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Check Content-Type
-	contentType := resp.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		fmt.Println("Unexpected content type:", contentType)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Read the response body
-	valuesBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading values response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	
-
-	// Unmarshal the values data into a slice of ValueData
-	var values []SensorData
-	err = json.Unmarshal(valuesBody, &values)
-	if err != nil {
-		fmt.Println("Error unmarshaling values:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Send a GET request to localhost/devices
-	resp2, err := http.Get("http://localhost/devices")
-	if err != nil {
-		fmt.Println("Error requesting devices:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	defer resp2.Body.Close()
-
-	// fmt.Println(values)
-	
-	if len(values) < 2 {
-		
-		// resp, err = http.Get(fmt.Sprintf("http://localhost/devices/%s/sensors/%s/values", tankID, waterLevelSensor.ID))
-		// if err != nil {
-		// 	fmt.Println("Error retrieving water level values:", err)
-		// 	w.WriteHeader(http.StatusInternalServerError)
-		// 	return
-		// }
-	
-		// defer resp.Body.Close()
-	
-		// // Check response status code
-		// if resp.StatusCode != http.StatusOK {
-		// 	fmt.Println("Unexpected status code:", resp.StatusCode)
-		// 	w.WriteHeader(http.StatusInternalServerError)
-		// 	return
-		// }
-	
-		// // Check Content-Type
-		// contentType := resp.Header.Get("Content-Type")
-		// if contentType != "application/json" {
-		// 	fmt.Println("Unexpected content type:", contentType)
-		// 	w.WriteHeader(http.StatusInternalServerError)
-		// 	return
-		// }
-	
-		// // Read the response body
-		// valuesBody, err := ioutil.ReadAll(resp.Body)
-		// if err != nil {
-		// 	fmt.Println("Error reading values response body:", err)
-		// 	w.WriteHeader(http.StatusInternalServerError)
-		// 	return
-		// }
-		
-		// // Unmarshal the values data into a slice of ValueData
-		// err = json.Unmarshal(valuesBody, &values)
-		// if err != nil {
-		// 	fmt.Println("Error unmarshaling values:", err)
-		// 	w.WriteHeader(http.StatusInternalServerError)
-		// 	return
-		// }
-	}
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp2.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+	var analytics Analytics
 
-	// Unmarshal the JSON data into a slice of Tank
-	var tanks []Tank
-	err = json.Unmarshal(body, &tanks)
-	if err != nil {
-		fmt.Println("Error unmarshaling tanks:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if len(waterLevelEntries) == 0 {
+		writeJSON(w, analytics)
 		return
 	}
 
-	// Find the tank with the specified ID
-	var targetTank Tank
-	for _, tank := range tanks {
-		if tank.ID == tankID {
-			targetTank = tank
-			break
-		}
+	// Changes across maintenance periods are not consumption
+	var consumption []Consumption
+	for _, segment := range splitAtGaps(waterLevelEntries) {
+		consumption = append(consumption, getConsumption(getMovingAverage(segment, 2))...)
 	}
 
-	// Check if tank information is available
-	if targetTank.ID == "" {
-		fmt.Println("Tank information not found")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	var waterLevelEntries []WaterLevel
-	var timestamp *time.Time
-	for _, value := range values {
-		sensorValue := value.Value
-
-		timestamp = value.Time
-		liters := 0.0
-		if targetTank.Meta.Settings.Height > 0 && targetTank.Meta.Settings.Capacity > 0 {
-			calculatedValue := ((targetTank.Meta.Settings.Height - (sensorValue.(float64) - targetTank.Meta.Settings.Offset)) / targetTank.Meta.Settings.Height) * targetTank.Meta.Settings.Capacity
-			liters = float64(calculatedValue)
-		}
-
-		entry := WaterLevel{
-			Level:     liters,
-			Timestamp: timestamp,
-		}
-		waterLevelEntries = append(waterLevelEntries, entry)
-	}
-	
-	movingAverage := getMovingAverage(waterLevelEntries, 2)
-	consumption := getConsumption(movingAverage)
-
 	averageConsumptionDaily := getConsumptionAverage(consumption,  "days")
 	averageConsumptionHourly := getConsumptionAverage(consumption,  "hrs")
 
 	trend := getTrend(consumption)
 	durationLeft := getDurationLeft(consumption, waterLevelEntries[len(waterLevelEntries)-1].Level)	
 
-	var analytics Analytics
+	// Refills are segmented out so that they do not distort the consumption averages
+	events := detectEvents(waterLevelEntries, targetTank.Meta.Settings, nil)
+	analytics.Events = summarizeEvents(events)
+	analytics.Cost = getCostSummary(targetTank.Meta.Tariff, analytics.Events, events)
 
 	if len(consumption) > 2 {
 		analytics.Trend = trend
@@ -661,6 +510,39 @@ func getAnalytics(w http.ResponseWriter, r *http.Request) {
 		analytics.DurationLeft  =  durationLeft
 	}
 
+	// Liters per person per day against the WHO based targets, from the consumption events
+	measured := analytics.Events.ConsumptionHours+analytics.Events.IdleHours > 0
+	analytics.Household = getHouseholdUsage(targetTank.Meta.Household, analytics.Events.DailyConsumption, measured)
+
+	// Metered outflow reconciled with the consumption derived from the level
+	flowTo := time.Now()
+	if to != "" {
+		if parsed, err := parseTime(to, tankLocation(targetTank)); err == nil && parsed.Before(flowTo) {
+			flowTo = parsed
+		}
+	}
+	flow, err := getFlowSummary(targetTank, waterLevelEntries, *waterLevelEntries[0].Timestamp, flowTo)
+	if err != nil {
+		fmt.Println("Error reconciling flow meter:", err)
+	}
+	analytics.Flow = flow
+
+	// Fill rate of the pumps measured from the level change while they run
+	pumps, err := getTankPumpPerformance(targetTank, waterLevelEntries)
+	if err != nil {
+		fmt.Println("Error computing pump performance:", err)
+	}
+	analytics.Pumps = pumps
+
+	// Time to empty and to the reserve level from the seasonal consumption profile
+	forecast, err := getForecast(targetTank, waterLevelEntries[len(waterLevelEntries)-1].Level)
+	if err != nil {
+		fmt.Println("Error forecasting water level:", err)
+	}
+	analytics.Forecast = forecast
+	if forecast.Empty != nil {
+		analytics.DurationLeft = int(forecast.Empty.ExpectedHours / 24)
+	}
 
 	// responseJSON := struct {
 	// 	WaterLevels []WaterLevel `json:"waterLevels"`
@@ -722,6 +604,9 @@ func TankHandler(w http.ResponseWriter, r *http.Request) {
 	// Create a new slice to store the transformed devices
 	transformedDevices := make([]Tank, len(devices))
 
+	// Water quality profiles, loaded when a tank uses a custom one
+	var profiles []QualityProfile
+
 	for i, tank := range devices {
 		// fmt.Println(tank.Sensors)
 		var sensorEntry []SensorData
@@ -735,6 +620,17 @@ func TankHandler(w http.ResponseWriter, r *http.Request) {
 			Modified: tank.Modified,
 			Created:  tank.Created,
 		}
+		transformedDevices[i].Meta.MaintenanceMode.Active = tank.Meta.MaintenanceMode.isActive(time.Now())
+		transformedDevices[i].QualityIndex = getQualityIndex(tank)
+
+		transformedDevices[i].OverdueTasks = getOverdueTasks(tank, time.Now())
+
+		// Tanks with redundant level sensors also get their fused level
+		if len(levelSensors(tank)) > 1 {
+			if fusion, ok := getLevelFusion(tank); ok {
+				transformedDevices[i].Level = &fusion
+			}
+		}
 
 		tankHeight := tank.Meta.Settings.Height
 		tankCapacity := tank.Meta.Settings.Capacity
@@ -744,10 +640,16 @@ func TankHandler(w http.ResponseWriter, r *http.Request) {
 
 			// Check if the sensor kind is "WaterLevel"
 			if sensor.Meta.Kind == "WaterLevel" && tankHeight > 0 && tankCapacity > 0 {
-				waterLevelValue := (((tankHeight) - (sensor.Value.(float64)-tankOffset)) / tankHeight) * tankCapacity
+				distance, _ := compensateDistance(tank, sensor.Value.(float64))
+				waterLevelValue := (((tankHeight) - (distance-tankOffset)) / tankHeight) * tankCapacity
 				sensor.Value = int(waterLevelValue)
 			}
 
+			// Water quality probes report their readings without units
+			if parameter, ok := qualityParameter(sensor.Meta.Kind); ok && sensor.Meta.Unit == "" {
+				sensor.Meta.Unit = parameter.Unit
+			}
+
 			if sensor.Meta.Kind == "WaterPollutantSensor" {
 				var waterQuality string
 				// WaterQualityValue := sensor.Value
@@ -759,16 +661,18 @@ func TankHandler(w http.ResponseWriter, r *http.Request) {
 						return
 					}
 
-					if value > 0 && value < 300 {
-						waterQuality = "Excellent"
-					} else if value >= 300 && value < 900 {
-						waterQuality = "Good"
-					} else if value >= 900 {
-						waterQuality = "Poor"
-					} else {
-						waterQuality = "Unknown"
+					// Custom profiles are only fetched once for all the tanks
+					profile, ok := builtinQualityProfile(tank.Meta.QualityProfile)
+					if !ok {
+						if profiles == nil {
+							profiles = getQualityProfiles()
+						}
+						profile = findQualityProfile(profiles, tank.Meta.QualityProfile)
 					}
+					quality := profile.classify(value)
+					waterQuality = quality.Label
 					sensor.Value = waterQuality
+					sensor.Meta.Quality = &quality
 				}
 			}
 
@@ -847,6 +751,14 @@ func GetTankByIDHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tank.QualityIndex = getQualityIndex(tank)
+	tank.OverdueTasks = getOverdueTasks(tank, time.Now())
+	if len(levelSensors(tank)) > 1 {
+		if fusion, ok := getLevelFusion(tank); ok {
+			tank.Level = &fusion
+		}
+	}
+
 	// Marshal the tank struct into JSON
 	response, err := json.Marshal(tank)
 	if err != nil {
@@ -1385,6 +1297,20 @@ func postMetaField(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The maintenance mode and its log only change through the maintenance mode routes,
+	// which are limited to technicians
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(body, &fields); err != nil {
+		http.Error(w, "invalid profile", http.StatusBadRequest)
+		return
+	}
+	for _, field := range []string{"maintenanceMode", "maintenanceLog"} {
+		if _, ok := fields[field]; ok {
+			http.Error(w, fmt.Sprintf("%s can only be changed through /tanks/{tankID}/maintenance-mode", field), http.StatusForbidden)
+			return
+		}
+	}
+
 	// Send a POST request to localhost/devices/tankID/meta
 	client := http.DefaultClient
 	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost/devices/%s/meta", tankID), bytes.NewReader(body))
@@ -1415,6 +1341,11 @@ func postMetaField(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The tanks read by virtual sensors are indexed again when they are replaced here
+	if _, ok := fields["virtualSensors"]; ok {
+		resetVirtualDependents()
+	}
+
 	// Set the Content-Type header to application/json
 	w.Header().Set("Content-Type", "application/json")
 
@@ -1516,6 +1447,9 @@ func DeleteTank(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	removeTankAttachments(tankID)
+	resetVirtualDependents()
+
 	// Set the Content-Type header to application/json
 	w.Header().Set("Content-Type", "application/json")
 
@@ -0,0 +1,708 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of tank maintenance tasks, other kinds are accepted as they are
+const (
+	TaskCleaning     = "cleaning"
+	TaskDisinfection = "disinfection"
+	TaskInspection   = "inspection"
+)
+
+// Days before the due date the reminder is sent, unless set on the task
+const defaultReminderDays = 3
+
+// Completion records kept per task
+const maintenanceRecordsSize = 50
+
+// Attachments accepted per completion and the largest one
+const (
+	maxAttachments     = 5
+	maxAttachmentBytes = 1 << 20
+)
+
+// The maintenance tasks are read again and written under this lock, so that the reminders
+// sent and the changes made through the api at the same time are all kept
+var maintenanceTasksLock sync.Mutex
+
+var errTaskNotFound = errors.New("maintenance task not found")
+
+// Content types accepted for attachments, photos of the work done
+var attachmentContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Directory of the attachment files, with a directory per tank. The records in the tank
+// meta only reference them so that the photos are not sent with every tank.
+const attachmentsDir = "data/maintenance-attachments"
+
+// MaintenanceAttachment describes a file attached to a completion, its content is stored apart
+type MaintenanceAttachment struct {
+	ID          string `json:"id" bson:"id"`
+	Name        string `json:"name" bson:"name"`
+	ContentType string `json:"contentType" bson:"contentType"`
+	Size        int    `json:"size" bson:"size"`
+}
+
+// MaintenanceRecord is the completion of a maintenance task
+type MaintenanceRecord struct {
+	ID          string                  `json:"id" bson:"id"`
+	Completed   time.Time               `json:"completed" bson:"completed"`
+	By          string                  `json:"by" bson:"by"`
+	Notes       string                  `json:"notes" bson:"notes"`
+	Attachments []MaintenanceAttachment `json:"attachments" bson:"attachments"`
+}
+
+// MaintenanceTask is a cleaning, disinfection or inspection of a tank. A task with an interval
+// is due again that many days after each completion, a task without one is done once.
+type MaintenanceTask struct {
+	ID              string              `json:"id" bson:"id"`
+	Type            string              `json:"type" bson:"type"`
+	Title           string              `json:"title" bson:"title"`
+	IntervalDays    int                 `json:"intervalDays" bson:"intervalDays"`
+	Due             *time.Time          `json:"due" bson:"due"`
+	ReminderDays    int                 `json:"reminderDays" bson:"reminderDays"`
+	Assignee        string              `json:"assignee" bson:"assignee"`
+	Reminded        bool                `json:"reminded" bson:"reminded"`
+	OverdueNotified bool                `json:"overdueNotified" bson:"overdueNotified"`
+	Records         []MaintenanceRecord `json:"records" bson:"records"`
+}
+
+// maintenanceTaskUpdate holds the fields sent to change a task, the ones left out keep their
+// value so that an empty assignee or a 0 interval or reminder clears them
+type maintenanceTaskUpdate struct {
+	Type         *string    `json:"type"`
+	Title        *string    `json:"title"`
+	IntervalDays *int       `json:"intervalDays"`
+	Due          *time.Time `json:"due"`
+	ReminderDays *int       `json:"reminderDays"`
+	Assignee     *string    `json:"assignee"`
+}
+
+type MaintenanceTaskStatus struct {
+	MaintenanceTask
+	DaysRemaining *float64   `json:"daysRemaining"`
+	DueSoon       bool       `json:"dueSoon"`
+	Overdue       bool       `json:"overdue"`
+	Done          bool       `json:"done"`
+	LastCompleted *time.Time `json:"lastCompleted"`
+}
+
+// OverdueTask is the short form of an overdue task shown with the tanks and in the summary
+type OverdueTask struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Title       string    `json:"title"`
+	Due         time.Time `json:"due"`
+	DaysOverdue float64   `json:"daysOverdue"`
+}
+
+func (t MaintenanceTask) reminderDays() int {
+	if t.ReminderDays > 0 {
+		return t.ReminderDays
+	}
+	return defaultReminderDays
+}
+
+// title returns the title of the task, or its type when it has none
+func (t MaintenanceTask) title() string {
+	if t.Title != "" || t.Type == "" {
+		return t.Title
+	}
+	return strings.ToUpper(t.Type[:1]) + t.Type[1:]
+}
+
+func getTaskStatus(task MaintenanceTask, now time.Time) MaintenanceTaskStatus {
+	status := MaintenanceTaskStatus{MaintenanceTask: task}
+	if n := len(task.Records); n > 0 {
+		status.LastCompleted = &task.Records[n-1].Completed
+	}
+	if task.Due == nil {
+		status.Done = true
+		return status
+	}
+
+	days := math.Round(task.Due.Sub(now).Hours()/24*10) / 10
+	status.DaysRemaining = &days
+	status.Overdue = !now.Before(*task.Due)
+	status.DueSoon = !status.Overdue && task.Due.Sub(now) <= time.Duration(task.reminderDays())*24*time.Hour
+	return status
+}
+
+// getTaskStatuses evaluates the maintenance tasks of a tank
+func getTaskStatuses(tank Tank, now time.Time) []MaintenanceTaskStatus {
+	statuses := []MaintenanceTaskStatus{}
+	for _, task := range tank.Meta.MaintenanceTasks {
+		statuses = append(statuses, getTaskStatus(task, now))
+	}
+	return statuses
+}
+
+// getOverdueTasks returns the overdue maintenance tasks of a tank
+func getOverdueTasks(tank Tank, now time.Time) []OverdueTask {
+	overdue := []OverdueTask{}
+	for _, task := range tank.Meta.MaintenanceTasks {
+		if task.Due == nil || now.Before(*task.Due) {
+			continue
+		}
+		overdue = append(overdue, OverdueTask{
+			ID:          task.ID,
+			Type:        task.Type,
+			Title:       task.title(),
+			Due:         *task.Due,
+			DaysOverdue: math.Round(now.Sub(*task.Due).Hours()/24*10) / 10,
+		})
+	}
+	return overdue
+}
+
+// reminderDue tells whether a reminder or an overdue notification is to be sent for a task
+func reminderDue(task MaintenanceTask, now time.Time) bool {
+	status := getTaskStatus(task, now)
+	return (status.Overdue && !task.OverdueNotified) || (status.DueSoon && !task.Reminded)
+}
+
+// checkTankMaintenance sends a reminder when a task is about to be due and another one when it is overdue
+func checkTankMaintenance(tank Tank) {
+	now := time.Now()
+	due := false
+	for _, task := range tank.Meta.MaintenanceTasks {
+		due = due || reminderDue(task, now)
+	}
+	if !due {
+		return
+	}
+
+	err := updateMaintenanceTasks(tank.ID, func(tasks []MaintenanceTask) ([]MaintenanceTask, error) {
+		for i, task := range tasks {
+			if !reminderDue(task, now) {
+				continue
+			}
+			status := getTaskStatus(task, now)
+			assignee := ""
+			if task.Assignee != "" {
+				assignee = fmt.Sprintf(" It is assigned to %s.", task.Assignee)
+			}
+			dueDate := ""
+			if task.Due != nil {
+				dueDate = task.Due.In(tankLocation(tank)).Format("2 January 2006")
+			}
+
+			if status.Overdue {
+				title := fmt.Sprintf("%s of %s is overdue", task.title(), tank.Name)
+				body := fmt.Sprintf("%s of %s was due on %s.%s", task.title(), tank.Name, dueDate, assignee)
+				notifyTank(tank, title, body, PriorityHigh)
+				tasks[i].OverdueNotified = true
+			} else {
+				title := fmt.Sprintf("%s of %s is due soon", task.title(), tank.Name)
+				body := fmt.Sprintf("%s of %s is due on %s.%s", task.title(), tank.Name, dueDate, assignee)
+				notifyTank(tank, title, body, PriorityMedium)
+			}
+			tasks[i].Reminded = true
+		}
+		return tasks, nil
+	})
+	if err != nil {
+		fmt.Println("Error updating maintenance tasks:", err)
+	}
+}
+
+// updateMaintenanceTasks applies a change to the current maintenance tasks of a tank and stores them
+func updateMaintenanceTasks(tankID string, update func(tasks []MaintenanceTask) ([]MaintenanceTask, error)) error {
+	maintenanceTasksLock.Lock()
+	defer maintenanceTasksLock.Unlock()
+
+	var meta struct {
+		MaintenanceTasks []MaintenanceTask `json:"maintenanceTasks"`
+	}
+	if err := getTankMeta(tankID, &meta); err != nil {
+		return err
+	}
+	tasks, err := update(meta.MaintenanceTasks)
+	if err != nil {
+		return err
+	}
+	return postTankMeta(tankID, map[string]interface{}{"maintenanceTasks": tasks})
+}
+
+// decodeTask reads a maintenance task from a request body
+func decodeTask(r *http.Request) (MaintenanceTask, error) {
+	var task MaintenanceTask
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return task, err
+	}
+	err = json.Unmarshal(body, &task)
+	return task, err
+}
+
+// validateTask checks the fields of a task that can be set by the user
+func validateTask(task MaintenanceTask) error {
+	switch {
+	case strings.TrimSpace(task.Type) == "":
+		return fmt.Errorf("type is required, for example %s, %s or %s", TaskCleaning, TaskDisinfection, TaskInspection)
+	case task.IntervalDays < 0 || task.ReminderDays < 0:
+		return fmt.Errorf("intervalDays and reminderDays must not be negative")
+	}
+	return nil
+}
+
+// findTask returns the index of a task of the tank, -1 when there is none with the ID
+func findTask(tasks []MaintenanceTask, taskID string) int {
+	for i, task := range tasks {
+		if task.ID == taskID {
+			return i
+		}
+	}
+	return -1
+}
+
+// attachmentPath returns the file of an attachment, not ok for IDs that are not plain names
+func attachmentPath(tankID string, attachmentID string) (string, bool) {
+	for _, id := range []string{tankID, attachmentID} {
+		if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+			return "", false
+		}
+	}
+	return filepath.Join(attachmentsDir, tankID, attachmentID), true
+}
+
+// saveAttachment writes the content of an attachment to its file
+func saveAttachment(tankID string, attachmentID string, data []byte) error {
+	path, ok := attachmentPath(tankID, attachmentID)
+	if !ok {
+		return fmt.Errorf("invalid attachment %s", attachmentID)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// removeAttachments deletes the files of attachments, the ones already gone are skipped
+func removeAttachments(tankID string, attachments []MaintenanceAttachment) {
+	for _, attachment := range attachments {
+		path, ok := attachmentPath(tankID, attachment.ID)
+		if !ok {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Error removing maintenance attachment:", err)
+		}
+	}
+}
+
+// removeTankAttachments deletes the attachment files of a deleted tank
+func removeTankAttachments(tankID string) {
+	path, ok := attachmentPath(tankID, "_")
+	if !ok {
+		return
+	}
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		fmt.Println("Error removing maintenance attachments:", err)
+	}
+}
+
+// findAttachment returns the attachment with the ID among the records of the tasks of a tank
+func findAttachment(tank Tank, attachmentID string) (MaintenanceAttachment, bool) {
+	for _, task := range tank.Meta.MaintenanceTasks {
+		for _, record := range task.Records {
+			for _, attachment := range record.Attachments {
+				if attachment.ID == attachmentID {
+					return attachment, true
+				}
+			}
+		}
+	}
+	return MaintenanceAttachment{}, false
+}
+
+// GetMaintenanceTasksHandler lists the maintenance tasks of a tank with their due status
+func GetMaintenanceTasksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched maintenance tasks: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, getTaskStatuses(tank, time.Now()))
+}
+
+// PostMaintenanceTaskHandler adds a maintenance task to a tank, a recurring task without a
+// due date is first due one interval from now
+func PostMaintenanceTaskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	task, err := decodeTask(r)
+	if err != nil {
+		http.Error(w, "invalid maintenance task", http.StatusBadRequest)
+		return
+	}
+	if err = validateTask(task); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if task.IntervalDays == 0 && task.Due == nil {
+		http.Error(w, "a due date or an intervalDays is required", http.StatusBadRequest)
+		return
+	}
+
+	if task.Due == nil {
+		due := time.Now().AddDate(0, 0, task.IntervalDays)
+		task.Due = &due
+	}
+	task.ID = newID()
+	task.Type = strings.ToLower(strings.TrimSpace(task.Type))
+	task.Reminded = false
+	task.OverdueNotified = false
+	task.Records = []MaintenanceRecord{}
+
+	err = updateMaintenanceTasks(tankID, func(tasks []MaintenanceTask) ([]MaintenanceTask, error) {
+		return append(tasks, task), nil
+	})
+	if err != nil {
+		fmt.Println("Error storing maintenance tasks:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Maintenance task added: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, getTaskStatus(task, time.Now()))
+}
+
+// UpdateMaintenanceTaskHandler changes the title, type, interval, due date, reminder or assignee
+// of a task, a new due date sends the reminders again
+func UpdateMaintenanceTaskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	var update maintenanceTaskUpdate
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &update)
+	}
+	if err != nil {
+		http.Error(w, "invalid maintenance task", http.StatusBadRequest)
+		return
+	}
+
+	var task MaintenanceTask
+	var invalid error
+	err = updateMaintenanceTasks(tankID, func(tasks []MaintenanceTask) ([]MaintenanceTask, error) {
+		i := findTask(tasks, vars["taskID"])
+		if i < 0 {
+			return nil, errTaskNotFound
+		}
+
+		task = tasks[i]
+		if update.Type != nil {
+			task.Type = strings.ToLower(strings.TrimSpace(*update.Type))
+		}
+		if update.Title != nil {
+			task.Title = *update.Title
+		}
+		if update.Assignee != nil {
+			task.Assignee = *update.Assignee
+		}
+		if update.IntervalDays != nil {
+			task.IntervalDays = *update.IntervalDays
+		}
+		if update.ReminderDays != nil {
+			task.ReminderDays = *update.ReminderDays
+		}
+		if update.Due != nil {
+			task.Due = update.Due
+			task.Reminded = false
+			task.OverdueNotified = false
+		}
+		if invalid = validateTask(task); invalid != nil {
+			return nil, invalid
+		}
+		tasks[i] = task
+		return tasks, nil
+	})
+	if errors.Is(err, errTaskNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if invalid != nil {
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error storing maintenance tasks:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Maintenance task updated: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, getTaskStatus(task, time.Now()))
+}
+
+// DeleteMaintenanceTaskHandler removes a maintenance task with its records and attachments
+func DeleteMaintenanceTaskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	var removed MaintenanceTask
+	err := updateMaintenanceTasks(tankID, func(tasks []MaintenanceTask) ([]MaintenanceTask, error) {
+		i := findTask(tasks, vars["taskID"])
+		if i < 0 {
+			return nil, errTaskNotFound
+		}
+		removed = tasks[i]
+		return append(tasks[:i], tasks[i+1:]...), nil
+	})
+	if errors.Is(err, errTaskNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error storing maintenance tasks:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, record := range removed.Records {
+		removeAttachments(tankID, record.Attachments)
+	}
+
+	log.Printf("[%s] Maintenance task deleted: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Maintenance task deleted",
+	})
+}
+
+// CompleteMaintenanceTaskHandler records the completion of a task with who did it, notes and
+// photos sent as base64, and schedules the next one
+func CompleteMaintenanceTaskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	var completion struct {
+		By          string     `json:"by"`
+		Notes       string     `json:"notes"`
+		Completed   *time.Time `json:"completed"`
+		Attachments []struct {
+			Name string `json:"name"`
+			Data string `json:"data"`
+		} `json:"attachments"`
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &completion); err != nil {
+			http.Error(w, "invalid completion", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(completion.Attachments) > maxAttachments {
+		http.Error(w, fmt.Sprintf("at most %d attachments per completion", maxAttachments), http.StatusBadRequest)
+		return
+	}
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if findTask(tank.Meta.MaintenanceTasks, vars["taskID"]) < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	record := MaintenanceRecord{
+		ID:          newID(),
+		Completed:   now,
+		By:          completion.By,
+		Notes:       completion.Notes,
+		Attachments: []MaintenanceAttachment{},
+	}
+	if completion.Completed != nil {
+		if completion.Completed.After(now) {
+			http.Error(w, "completed must not be in the future", http.StatusBadRequest)
+			return
+		}
+		record.Completed = *completion.Completed
+	}
+
+	// The files are written before the record referencing them is stored
+	for n, file := range completion.Attachments {
+		// Data URLs are accepted as well as plain base64
+		data := file.Data
+		if comma := strings.Index(data, ","); strings.HasPrefix(data, "data:") && comma > 0 {
+			data = data[comma+1:]
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil || len(decoded) == 0 {
+			removeAttachments(tankID, record.Attachments)
+			http.Error(w, fmt.Sprintf("attachment %d is not valid base64", n+1), http.StatusBadRequest)
+			return
+		}
+		if len(decoded) > maxAttachmentBytes {
+			removeAttachments(tankID, record.Attachments)
+			http.Error(w, fmt.Sprintf("attachment %d is larger than %d KB", n+1, maxAttachmentBytes/1024), http.StatusBadRequest)
+			return
+		}
+		// The type is the one of the content whatever the request claims, only images are kept
+		contentType := http.DetectContentType(decoded)
+		if !attachmentContentTypes[contentType] {
+			removeAttachments(tankID, record.Attachments)
+			http.Error(w, fmt.Sprintf("attachment %d must be a JPEG, PNG, GIF or WebP image", n+1), http.StatusBadRequest)
+			return
+		}
+
+		attachment := MaintenanceAttachment{
+			ID:          fmt.Sprintf("%s-%d", record.ID, n+1),
+			Name:        filepath.Base(file.Name),
+			ContentType: contentType,
+			Size:        len(decoded),
+		}
+		if err = saveAttachment(tankID, attachment.ID, decoded); err != nil {
+			fmt.Println("Error storing maintenance attachment:", err)
+			removeAttachments(tankID, record.Attachments)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		record.Attachments = append(record.Attachments, attachment)
+	}
+
+	var task MaintenanceTask
+	dropped := []MaintenanceRecord{}
+	err = updateMaintenanceTasks(tankID, func(tasks []MaintenanceTask) ([]MaintenanceTask, error) {
+		i := findTask(tasks, vars["taskID"])
+		if i < 0 {
+			return nil, errTaskNotFound
+		}
+
+		task = tasks[i]
+		task.Records = append(task.Records, record)
+		if len(task.Records) > maintenanceRecordsSize {
+			dropped = task.Records[:len(task.Records)-maintenanceRecordsSize]
+			task.Records = task.Records[len(task.Records)-maintenanceRecordsSize:]
+		}
+
+		// The next one is due an interval after this completion, a one-off task is done
+		if task.IntervalDays > 0 {
+			due := record.Completed.AddDate(0, 0, task.IntervalDays)
+			task.Due = &due
+		} else {
+			task.Due = nil
+		}
+		task.Reminded = false
+		task.OverdueNotified = false
+		tasks[i] = task
+		return tasks, nil
+	})
+	if err != nil {
+		removeAttachments(tankID, record.Attachments)
+		if errors.Is(err, errTaskNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Println("Error storing maintenance tasks:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, old := range dropped {
+		removeAttachments(tankID, old.Attachments)
+	}
+
+	log.Printf("[%s] Maintenance task completed: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, getTaskStatus(task, now))
+}
+
+// GetMaintenanceAttachmentHandler serves a file attached to a completion
+func GetMaintenanceAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	attachment, ok := findAttachment(tank, vars["attachmentID"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	path, ok := attachmentPath(tank.ID, attachment.ID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("Error reading maintenance attachment:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched maintenance attachment: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	// Served as a download that browsers do not sniff, so a file cannot run as a page of the app
+	contentType := attachment.ContentType
+	if !attachmentContentTypes[contentType] {
+		contentType = "application/octet-stream"
+	}
+	name := attachment.Name
+	if name == "" || name == "." || name == string(filepath.Separator) {
+		name = attachment.ID
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
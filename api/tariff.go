@@ -0,0 +1,410 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	TariffFlat     = "flat"
+	TariffTiered   = "tiered"
+	TariffDelivery = "delivery"
+)
+
+const (
+	BasisDelivered = "delivered"
+	BasisConsumed  = "consumed"
+)
+
+// TariffBlock prices the liters of a month up to UpTo, a zero UpTo covers every remaining liter
+type TariffBlock struct {
+	UpTo         float64 `json:"upTo" bson:"upTo"`
+	RatePerLiter float64 `json:"ratePerLiter" bson:"ratePerLiter"`
+}
+
+// Tariff is the price of the water of a tank. Flat and tiered tariffs charge per liter,
+// tiered blocks are counted from the start of each month. Delivery tariffs charge each
+// truck delivery plus an optional price per liter.
+type Tariff struct {
+	Type          string        `json:"type" bson:"type"`
+	Currency      string        `json:"currency" bson:"currency"`
+	RatePerLiter  float64       `json:"ratePerLiter" bson:"ratePerLiter"`
+	Blocks        []TariffBlock `json:"blocks" bson:"blocks"`
+	DeliveryPrice float64       `json:"deliveryPrice" bson:"deliveryPrice"`
+	FixedMonthly  float64       `json:"fixedMonthly" bson:"fixedMonthly"`
+	Basis         string        `json:"basis" bson:"basis"`
+	MonthlyBudget float64       `json:"monthlyBudget" bson:"monthlyBudget"`
+}
+
+type DailyCost struct {
+	Date            string  `json:"date" bson:"date"`
+	ConsumedLiters  float64 `json:"consumedLiters" bson:"consumedLiters"`
+	DeliveredLiters float64 `json:"deliveredLiters" bson:"deliveredLiters"`
+	Deliveries      int     `json:"deliveries" bson:"deliveries"`
+	ConsumedCost    float64 `json:"consumedCost" bson:"consumedCost"`
+	DeliveredCost   float64 `json:"deliveredCost" bson:"deliveredCost"`
+}
+
+type CostReport struct {
+	Month           string      `json:"month" bson:"month"`
+	Currency        string      `json:"currency" bson:"currency"`
+	Tariff          string      `json:"tariff" bson:"tariff"`
+	Basis           string      `json:"basis" bson:"basis"`
+	Days            []DailyCost `json:"days" bson:"days"`
+	ConsumedLiters  float64     `json:"consumedLiters" bson:"consumedLiters"`
+	DeliveredLiters float64     `json:"deliveredLiters" bson:"deliveredLiters"`
+	Deliveries      int         `json:"deliveries" bson:"deliveries"`
+	ConsumedCost    float64     `json:"consumedCost" bson:"consumedCost"`
+	DeliveredCost   float64     `json:"deliveredCost" bson:"deliveredCost"`
+	Spent           float64     `json:"spent" bson:"spent"`
+	ProjectedSpend  float64     `json:"projectedSpend" bson:"projectedSpend"`
+	Budget          float64     `json:"budget" bson:"budget"`
+	OverBudget      bool        `json:"overBudget" bson:"overBudget"`
+}
+
+// CostSummary is the cost of the water in the analytics window
+type CostSummary struct {
+	Currency      string  `json:"currency" bson:"currency"`
+	ConsumedCost  float64 `json:"consumedCost" bson:"consumedCost"`
+	DeliveredCost float64 `json:"deliveredCost" bson:"deliveredCost"`
+	Deliveries    int     `json:"deliveries" bson:"deliveries"`
+}
+
+// Last budget alert sent, by tank, as "<month>:<level>"
+var budgetNotified = make(map[string]string)
+var budgetCheckedAt = make(map[string]time.Time)
+var budgetLock sync.Mutex
+
+// Days of the delivery log used to project the deliveries of the month
+const deliveryProjectionDays = 90
+
+// configured tells whether the tank has a tariff, tiered blocks that cannot be priced are
+// treated as no tariff
+func (t Tariff) configured() bool {
+	switch t.Type {
+	case TariffFlat, TariffDelivery:
+		return true
+	case TariffTiered:
+		return t.validate() == nil
+	}
+	return false
+}
+
+// validate checks the blocks of a tiered tariff, their UpTo going up and only the last one
+// left open with 0
+func (t Tariff) validate() error {
+	if t.Type != TariffTiered {
+		return nil
+	}
+	if len(t.Blocks) == 0 {
+		return fmt.Errorf("a tiered tariff needs blocks")
+	}
+	var lower float64
+	for i, block := range t.Blocks {
+		if block.UpTo == 0 && i == len(t.Blocks)-1 {
+			break
+		}
+		if block.UpTo <= lower {
+			return fmt.Errorf("block %d must go up to more than %v liters, only the last block can have an upTo of 0", i+1, lower)
+		}
+		lower = block.UpTo
+	}
+	return nil
+}
+
+func (t Tariff) basis() string {
+	if t.Basis == BasisConsumed {
+		return BasisConsumed
+	}
+	return BasisDelivered
+}
+
+// cost prices the liters of a month, without the fixed monthly charge
+func (t Tariff) cost(liters float64, deliveries int) float64 {
+	switch t.Type {
+	case TariffFlat:
+		return liters * t.RatePerLiter
+	case TariffTiered:
+		var total, lower float64
+		for _, block := range t.Blocks {
+			if block.UpTo <= 0 || liters <= block.UpTo {
+				return total + (liters-lower)*block.RatePerLiter
+			}
+			total += (block.UpTo - lower) * block.RatePerLiter
+			lower = block.UpTo
+		}
+		// Liters above the last block are charged at its rate
+		if len(t.Blocks) > 0 && liters > lower {
+			total += (liters - lower) * t.Blocks[len(t.Blocks)-1].RatePerLiter
+		}
+		return total
+	case TariffDelivery:
+		return float64(deliveries)*t.DeliveryPrice + liters*t.RatePerLiter
+	}
+	return 0
+}
+
+// countDeliveries returns the number of truck deliveries among the events
+func countDeliveries(events []WaterEvent) int {
+	deliveries := 0
+	for _, event := range events {
+		if event.Type == EventRefill && event.Source == RefillTruck {
+			deliveries++
+		}
+	}
+	return deliveries
+}
+
+// getCostSummary prices the consumption and refills of the analytics window
+func getCostSummary(tariff Tariff, summary EventSummary, events []WaterEvent) *CostSummary {
+	if !tariff.configured() {
+		return nil
+	}
+	deliveries := countDeliveries(events)
+	return &CostSummary{
+		Currency:      tariff.Currency,
+		ConsumedCost:  tariff.cost(summary.ConsumedLiters, 0),
+		DeliveredCost: tariff.cost(summary.RefilledLiters, deliveries),
+		Deliveries:    deliveries,
+	}
+}
+
+// projectDeliveries estimates the truck deliveries left in the month and the liters of each,
+// from the usual interval between the recent deliveries or, with too few of them, from the
+// deliveries needed to replace the water consumed at the pace of the month
+func projectDeliveries(history []Delivery, report CostReport, elapsedDays float64, remainingDays float64, now time.Time) (float64, float64) {
+	since := now.AddDate(0, 0, -deliveryProjectionDays)
+	var starts []time.Time
+	var volume float64
+	for _, delivery := range history {
+		if delivery.Dismissed || delivery.Start == nil || delivery.Start.Before(since) || delivery.Start.After(now) {
+			continue
+		}
+		starts = append(starts, *delivery.Start)
+		volume += delivery.MeasuredLiters
+	}
+
+	var perDelivery float64
+	if len(starts) > 0 {
+		perDelivery = volume / float64(len(starts))
+	} else if report.Deliveries > 0 {
+		perDelivery = report.DeliveredLiters / float64(report.Deliveries)
+	}
+
+	if len(starts) >= 2 {
+		sort.Slice(starts, func(i, j int) bool {
+			return starts[i].Before(starts[j])
+		})
+		interval := starts[len(starts)-1].Sub(starts[0]).Hours() / 24 / float64(len(starts)-1)
+		if interval > 0 {
+			return remainingDays / interval, perDelivery
+		}
+	}
+
+	if perDelivery > 0 && elapsedDays > 0 {
+		return report.ConsumedLiters / elapsedDays * remainingDays / perDelivery, perDelivery
+	}
+	return 0, perDelivery
+}
+
+// getCostReport prices the consumption and deliveries of each day of a month and projects the month spend
+func getCostReport(tank Tank, month time.Time) (CostReport, error) {
+	tariff := tank.Meta.Tariff
+	loc := tankLocation(tank)
+
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, loc)
+	end := start.AddDate(0, 1, 0)
+
+	report := CostReport{
+		Month:    start.Format("2006-01"),
+		Currency: tariff.Currency,
+		Tariff:   tariff.Type,
+		Basis:    tariff.basis(),
+		Days:     []DailyCost{},
+		Budget:   tariff.MonthlyBudget,
+	}
+
+	now := time.Now()
+	to := end
+	if now.Before(end) {
+		to = now
+	}
+	if !to.After(start) {
+		return report, nil
+	}
+
+	levels, err := getLevelHistory(tank, start.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return report, err
+	}
+	rollups, err := getRollups(levels, tank.Meta.Settings, IntervalDay, start, to, loc)
+	if err != nil {
+		return report, err
+	}
+	events, err := getTankEvents(tank, start.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return report, err
+	}
+
+	deliveriesPerDay := make(map[string]int)
+	for _, event := range events {
+		if event.Type == EventRefill && event.Source == RefillTruck {
+			deliveriesPerDay[event.Start.In(loc).Format("2006-01-02")]++
+		}
+	}
+
+	// Tiered blocks fill up over the month, so each day is priced as the increase of the month cost
+	for _, rollup := range rollups {
+		day := DailyCost{
+			Date:            rollup.Start.Format("2006-01-02"),
+			ConsumedLiters:  rollup.ConsumedLiters,
+			DeliveredLiters: rollup.RefilledLiters,
+		}
+		day.Deliveries = deliveriesPerDay[day.Date]
+
+		day.ConsumedCost = tariff.cost(report.ConsumedLiters+day.ConsumedLiters, 0) - tariff.cost(report.ConsumedLiters, 0)
+		day.DeliveredCost = tariff.cost(report.DeliveredLiters+day.DeliveredLiters, report.Deliveries+day.Deliveries) -
+			tariff.cost(report.DeliveredLiters, report.Deliveries)
+
+		report.ConsumedLiters += day.ConsumedLiters
+		report.DeliveredLiters += day.DeliveredLiters
+		report.Deliveries += day.Deliveries
+		report.ConsumedCost += day.ConsumedCost
+		report.DeliveredCost += day.DeliveredCost
+		report.Days = append(report.Days, day)
+	}
+
+	liters, deliveries := report.DeliveredLiters, report.Deliveries
+	report.Spent = report.DeliveredCost
+	if report.Basis == BasisConsumed {
+		liters, deliveries = report.ConsumedLiters, 0
+		report.Spent = report.ConsumedCost
+	}
+	report.Spent += tariff.FixedMonthly
+
+	// The month is projected at the pace of the days elapsed so far, truck deliveries come
+	// one at a time and are projected from their usual interval or volume instead
+	elapsed := to.Sub(start).Hours() / 24
+	total := end.Sub(start).Hours() / 24
+	if elapsed > 0 {
+		projectedLiters := liters * total / elapsed
+		projectedDeliveries := deliveries
+		if tariff.Type == TariffDelivery && report.Basis == BasisDelivered {
+			extra, perDelivery := projectDeliveries(tank.Meta.Deliveries, report, elapsed, total-elapsed, to)
+			projectedDeliveries = deliveries + int(extra+0.5)
+			projectedLiters = liters + float64(projectedDeliveries-deliveries)*perDelivery
+		}
+		report.ProjectedSpend = tariff.cost(projectedLiters, projectedDeliveries) + tariff.FixedMonthly
+	}
+
+	report.OverBudget = report.Budget > 0 && report.ProjectedSpend > report.Budget
+
+	return report, nil
+}
+
+// checkBudget alerts once a month when the projected spend exceeds the budget and once when the spend does
+func checkBudget(tank Tank) {
+	tariff := tank.Meta.Tariff
+	if !tariff.configured() || tariff.MonthlyBudget <= 0 {
+		return
+	}
+
+	now := time.Now()
+	budgetLock.Lock()
+	if last, ok := budgetCheckedAt[tank.ID]; ok && now.Sub(last) < time.Hour {
+		budgetLock.Unlock()
+		return
+	}
+	budgetCheckedAt[tank.ID] = now
+	budgetLock.Unlock()
+
+	report, err := getCostReport(tank, now.In(tankLocation(tank)))
+	if err != nil {
+		fmt.Println("Error computing water cost:", err)
+		return
+	}
+
+	level := ""
+	priority := PriorityMedium
+	if report.Spent > report.Budget {
+		level = "exceeded"
+		priority = PriorityHigh
+	} else if report.OverBudget {
+		level = "projected"
+	}
+	if level == "" {
+		return
+	}
+
+	key := report.Month + ":" + level
+	budgetLock.Lock()
+	last := budgetNotified[tank.ID]
+	// An exceeded budget was already worse than the projection
+	if last == key || last == report.Month+":exceeded" {
+		budgetLock.Unlock()
+		return
+	}
+	budgetNotified[tank.ID] = key
+	budgetLock.Unlock()
+
+	var title, body string
+	if level == "exceeded" {
+		title = fmt.Sprintf("%s is over its water budget", tank.Name)
+		body = fmt.Sprintf("%.2f %s has been spent on water for %s this month, above the budget of %.2f %s.",
+			report.Spent, report.Currency, tank.Name, report.Budget, report.Currency)
+	} else {
+		title = fmt.Sprintf("%s will exceed its water budget", tank.Name)
+		body = fmt.Sprintf("At the current pace %s will cost %.2f %s this month, above the budget of %.2f %s.",
+			tank.Name, report.ProjectedSpend, report.Currency, report.Budget, report.Currency)
+	}
+	notifyTank(tank, title, body, priority)
+}
+
+// GetCostsHandler returns the daily water cost of a tank for a month and the projected spend
+func GetCostsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err = tank.Meta.Tariff.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid tariff: %s", err), http.StatusBadRequest)
+		return
+	}
+	if !tank.Meta.Tariff.configured() {
+		http.Error(w, "no tariff configured for this tank", http.StatusNotFound)
+		return
+	}
+
+	loc := tankLocation(tank)
+	month := time.Now().In(loc)
+	if value := r.URL.Query().Get("month"); value != "" {
+		month, err = time.ParseInLocation("2006-01", value, loc)
+		if err != nil {
+			http.Error(w, "month must be formatted as YYYY-MM", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := getCostReport(tank, month)
+	if err != nil {
+		fmt.Println("Error computing water cost:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched water cost: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, report)
+}
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Water temperature risks
+const (
+	RiskFreeze     = "freeze"
+	RiskLegionella = "legionella"
+	RiskHeatStress = "heat-stress"
+)
+
+// Default thresholds in °C. Legionella grows between 25 and 45 °C, livestock drink less
+// and suffer heat stress when their water is above 30 °C.
+const (
+	defaultFreezeBelow     = 3.0
+	defaultLegionellaMin   = 25.0
+	defaultLegionellaMax   = 45.0
+	defaultLegionellaHours = 24.0
+	defaultHeatStressAbove = 30.0
+)
+
+// A reading stands for the temperature until the next one, for this long at most
+const maxTemperatureGap = 2 * time.Hour
+
+// Days of temperature summaries returned when no range is given
+const defaultTemperatureDays = 7
+
+// TemperatureSettings configures the water temperature safety alerts of a tank. Heat stress
+// is only checked for livestock, when Livestock is set or the tank uses the livestock quality profile.
+// Zero thresholds take the defaults, except the freeze threshold which takes it when unset as 0 °C
+// is a threshold of its own.
+type TemperatureSettings struct {
+	FreezeBelow     *float64 `json:"freezeBelow" bson:"freezeBelow"`
+	LegionellaMin   float64  `json:"legionellaMin" bson:"legionellaMin"`
+	LegionellaMax   float64  `json:"legionellaMax" bson:"legionellaMax"`
+	LegionellaHours float64  `json:"legionellaHours" bson:"legionellaHours"`
+	HeatStressAbove float64  `json:"heatStressAbove" bson:"heatStressAbove"`
+	Livestock       bool     `json:"livestock" bson:"livestock"`
+	Disabled        bool     `json:"disabled" bson:"disabled"`
+}
+
+// TemperatureDay summarizes the water temperature of a day, the hours are the time spent in each risk band
+type TemperatureDay struct {
+	Date            string  `json:"date"`
+	Min             float64 `json:"min"`
+	Max             float64 `json:"max"`
+	Average         float64 `json:"average"`
+	Readings        int     `json:"readings"`
+	FreezeHours     float64 `json:"freezeHours"`
+	LegionellaHours float64 `json:"legionellaHours"`
+	HeatStressHours float64 `json:"heatStressHours"`
+}
+
+// TemperatureSafety is the current water temperature of a tank with the risks it raises.
+// LegionellaStreak is the number of hours the water has stayed in the Legionella band up to now.
+type TemperatureSafety struct {
+	Temperature      *float64            `json:"temperature"`
+	Time             *time.Time          `json:"time"`
+	Risks            []string            `json:"risks"`
+	LegionellaStreak float64             `json:"legionellaStreak"`
+	Settings         TemperatureSettings `json:"settings"`
+	Days             []TemperatureDay    `json:"days"`
+}
+
+// Date of the last notification by tank and risk, and the time of the last check by tank
+var temperatureNotified = make(map[string]string)
+var temperatureCheckedAt = make(map[string]time.Time)
+var temperatureLegionella = make(map[string]bool)
+var temperatureLock sync.Mutex
+
+// withDefaults returns the settings with the default thresholds filled in
+func (s TemperatureSettings) withDefaults(tank Tank) TemperatureSettings {
+	if s.FreezeBelow == nil {
+		freezeBelow := defaultFreezeBelow
+		s.FreezeBelow = &freezeBelow
+	}
+	if s.LegionellaMin == 0 {
+		s.LegionellaMin = defaultLegionellaMin
+	}
+	if s.LegionellaMax == 0 {
+		s.LegionellaMax = defaultLegionellaMax
+	}
+	if s.LegionellaHours <= 0 {
+		s.LegionellaHours = defaultLegionellaHours
+	}
+	if s.HeatStressAbove == 0 {
+		s.HeatStressAbove = defaultHeatStressAbove
+	}
+	if tank.Meta.QualityProfile == "livestock" {
+		s.Livestock = true
+	}
+	return s
+}
+
+func (s TemperatureSettings) freezing(temperature float64) bool {
+	return temperature <= *s.FreezeBelow
+}
+
+func (s TemperatureSettings) inLegionellaBand(temperature float64) bool {
+	return temperature >= s.LegionellaMin && temperature <= s.LegionellaMax
+}
+
+func (s TemperatureSettings) heatStress(temperature float64) bool {
+	return s.Livestock && temperature >= s.HeatStressAbove
+}
+
+// temperatureDays summarizes valid readings, in chronological order, by day of the tank timezone
+func temperatureDays(history []HistoryPoint, settings TemperatureSettings, loc *time.Location) []TemperatureDay {
+	days := []TemperatureDay{}
+	var sum float64
+	for i, point := range history {
+		date := point.Time.In(loc).Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			if len(days) > 0 {
+				days[len(days)-1].Average = math.Round(sum/float64(days[len(days)-1].Readings)*10) / 10
+			}
+			days = append(days, TemperatureDay{Date: date, Min: point.Value, Max: point.Value})
+			sum = 0
+		}
+		day := &days[len(days)-1]
+		day.Min = math.Min(day.Min, point.Value)
+		day.Max = math.Max(day.Max, point.Value)
+		day.Readings++
+		sum += point.Value
+
+		var held time.Duration
+		if i+1 < len(history) {
+			held = history[i+1].Time.Sub(point.Time)
+			if held > maxTemperatureGap {
+				held = maxTemperatureGap
+			}
+		}
+		hours := held.Hours()
+		if settings.freezing(point.Value) {
+			day.FreezeHours += hours
+		}
+		if settings.inLegionellaBand(point.Value) {
+			day.LegionellaHours += hours
+		}
+		if settings.heatStress(point.Value) {
+			day.HeatStressHours += hours
+		}
+	}
+	if len(days) > 0 {
+		days[len(days)-1].Average = math.Round(sum/float64(days[len(days)-1].Readings)*10) / 10
+	}
+	for i := range days {
+		days[i].FreezeHours = math.Round(days[i].FreezeHours*10) / 10
+		days[i].LegionellaHours = math.Round(days[i].LegionellaHours*10) / 10
+		days[i].HeatStressHours = math.Round(days[i].HeatStressHours*10) / 10
+	}
+	return days
+}
+
+// legionellaStreak returns the hours the water has stayed in the Legionella band up to now,
+// a gap between readings longer than the maximum ends the streak
+func legionellaStreak(history []HistoryPoint, settings TemperatureSettings, now time.Time) float64 {
+	if len(history) == 0 {
+		return 0
+	}
+	last := history[len(history)-1]
+	if !settings.inLegionellaBand(last.Value) || now.Sub(last.Time) > maxTemperatureGap {
+		return 0
+	}
+	start := last.Time
+	for i := len(history) - 2; i >= 0; i-- {
+		if !settings.inLegionellaBand(history[i].Value) || history[i+1].Time.Sub(history[i].Time) > maxTemperatureGap {
+			break
+		}
+		start = history[i].Time
+	}
+	return math.Round(now.Sub(start).Hours()*10) / 10
+}
+
+// getTemperatureHistory returns the valid water temperatures of a tank between from and to
+func getTemperatureHistory(tank Tank, from string, to string) ([]HistoryPoint, error) {
+	sensor, ok := findSensor(tank.Sensors, "WaterThermometer")
+	if !ok {
+		return nil, fmt.Errorf("WaterThermometer sensor not found")
+	}
+	values, err := getSensorValues(tank.ID, sensor.ID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	history := []HistoryPoint{}
+	for _, point := range sensorHistoryPoints(values) {
+		if validTemperature(point.Value) {
+			history = append(history, point)
+		}
+	}
+	return history, nil
+}
+
+// currentTemperatureRisks returns the risks raised by the current water temperature of a tank.
+// The Legionella risk needs the history and is left to the caller.
+func currentTemperatureRisks(tank Tank, settings TemperatureSettings) (*float64, *time.Time, []string) {
+	risks := []string{}
+	sensor, ok := findSensor(tank.Sensors, "WaterThermometer")
+	if !ok {
+		return nil, nil, risks
+	}
+	temperature, ok := numericValue(sensor.Value)
+	if !ok || !validTemperature(temperature) {
+		return nil, sensor.Time, risks
+	}
+	if settings.freezing(temperature) {
+		risks = append(risks, RiskFreeze)
+	}
+	if settings.heatStress(temperature) {
+		risks = append(risks, RiskHeatStress)
+	}
+	return &temperature, sensor.Time, risks
+}
+
+// getTemperatureSafety returns the current temperature risks of a tank and its daily summaries between from and to
+func getTemperatureSafety(tank Tank, from time.Time, to time.Time) (TemperatureSafety, error) {
+	settings := tank.Meta.TemperatureSettings.withDefaults(tank)
+	temperature, at, risks := currentTemperatureRisks(tank, settings)
+	safety := TemperatureSafety{
+		Temperature: temperature,
+		Time:        at,
+		Risks:       risks,
+		Settings:    settings,
+	}
+
+	// The streak is measured on the readings leading to now, whatever the range asked for
+	streakFrom := time.Now().Add(-time.Duration(2*settings.LegionellaHours) * time.Hour)
+	if streakFrom.After(from) {
+		streakFrom = from
+	}
+	history, err := getTemperatureHistory(tank, streakFrom.Format(time.RFC3339), "")
+	if err != nil {
+		return safety, err
+	}
+	safety.LegionellaStreak = legionellaStreak(history, settings, time.Now())
+	if safety.LegionellaStreak >= settings.LegionellaHours {
+		safety.Risks = append(safety.Risks, RiskLegionella)
+	}
+
+	inRange := []HistoryPoint{}
+	for _, point := range history {
+		if !point.Time.Before(from) && !point.Time.After(to) {
+			inRange = append(inRange, point)
+		}
+	}
+	safety.Days = temperatureDays(inRange, settings, tankLocation(tank))
+	return safety, nil
+}
+
+// checkTemperatureSafety checks the water temperature of a tank at most once an hour and
+// notifies each risk at most once a day
+func checkTemperatureSafety(tank Tank) {
+	if tank.Meta.TemperatureSettings.Disabled {
+		return
+	}
+	if _, ok := findSensor(tank.Sensors, "WaterThermometer"); !ok {
+		return
+	}
+
+	now := time.Now()
+	temperatureLock.Lock()
+	if last, ok := temperatureCheckedAt[tank.ID]; ok && now.Sub(last) < time.Hour {
+		temperatureLock.Unlock()
+		return
+	}
+	temperatureCheckedAt[tank.ID] = now
+	temperatureLock.Unlock()
+
+	settings := tank.Meta.TemperatureSettings.withDefaults(tank)
+	history, err := getTemperatureHistory(tank, now.Add(-time.Duration(2*settings.LegionellaHours)*time.Hour).Format(time.RFC3339), "")
+	if err != nil {
+		fmt.Println("Error retrieving water temperature history:", err)
+		return
+	}
+	streak := legionellaStreak(history, settings, now)
+
+	temperatureLock.Lock()
+	temperatureLegionella[tank.ID] = streak >= settings.LegionellaHours
+	temperatureLock.Unlock()
+
+	temperature, _, risks := currentTemperatureRisks(tank, settings)
+	if streak >= settings.LegionellaHours {
+		risks = append(risks, RiskLegionella)
+	}
+
+	date := now.In(tankLocation(tank)).Format("2006-01-02")
+	for _, risk := range risks {
+		key := tank.ID + "/" + risk
+		temperatureLock.Lock()
+		notified := temperatureNotified[key] == date
+		temperatureNotified[key] = date
+		temperatureLock.Unlock()
+		if notified {
+			continue
+		}
+
+		switch risk {
+		case RiskFreeze:
+			notifyTank(tank, fmt.Sprintf("Freeze risk at %s", tank.Name),
+				fmt.Sprintf("The water in %s is at %.1f °C. Insulate the tank and its pipes, or drain the exposed pipes.", tank.Name, *temperature),
+				PriorityHigh)
+		case RiskHeatStress:
+			notifyTank(tank, fmt.Sprintf("Water too warm for livestock at %s", tank.Name),
+				fmt.Sprintf("The water in %s is at %.1f °C, animals drink less and suffer heat stress above %.0f °C. Shade the tank or refill it with cooler water.",
+					tank.Name, *temperature, settings.HeatStressAbove),
+				PriorityMedium)
+		case RiskLegionella:
+			notifyTank(tank, fmt.Sprintf("Legionella risk at %s", tank.Name),
+				fmt.Sprintf("The water in %s has stayed between %.0f and %.0f °C for %.0f hours, where Legionella grows. Keep the tank cool and consider disinfecting it.",
+					tank.Name, settings.LegionellaMin, settings.LegionellaMax, streak),
+				PriorityMedium)
+		}
+	}
+}
+
+// GetTemperatureSafetyHandler returns the temperature risks of a tank and its daily minimum,
+// maximum and hours in each risk band
+func GetTemperatureSafetyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, ok := findSensor(tank.Sensors, "WaterThermometer"); !ok {
+		http.Error(w, "no WaterThermometer sensor on this tank", http.StatusNotFound)
+		return
+	}
+
+	loc := tankLocation(tank)
+	to := time.Now()
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid to time", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.AddDate(0, 0, -defaultTemperatureDays)
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = parseTime(value, loc); err != nil {
+			http.Error(w, "invalid from time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	safety, err := getTemperatureSafety(tank, from, to)
+	if err != nil {
+		fmt.Println("Error computing temperature safety:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched temperature safety: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, safety)
+}
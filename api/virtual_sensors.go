@@ -0,0 +1,708 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Sensor kind of the gateway sensors storing the values of virtual sensors
+const KindVirtual = "VirtualSensor"
+
+// VirtualSensor is a sensor computed from an expression over the other sensors and the
+// settings of a tank. Its values are stored in a gateway sensor so that its history,
+// alerts and charts work like the ones of a physical sensor.
+type VirtualSensor struct {
+	Key        string `json:"key" bson:"key"`
+	Name       string `json:"name" bson:"name"`
+	Unit       string `json:"unit" bson:"unit"`
+	Expression string `json:"expression" bson:"expression"`
+	SensorID   string `json:"sensorID" bson:"sensorID"`
+	Disabled   bool   `json:"disabled" bson:"disabled"`
+}
+
+type VirtualSensorStatus struct {
+	VirtualSensor
+	Value interface{} `json:"value"`
+	Time  *time.Time  `json:"time"`
+}
+
+// Variables taken from the level sensor and the settings of a tank
+var virtualSettings = []string{"height", "offset", "capacity", "distance", "liters", "percent"}
+
+// Inputs of the last stored value and alert state, by tank and virtual sensor
+var virtualFingerprints = make(map[string]string)
+var virtualAlerted = make(map[string]bool)
+var virtualLock sync.Mutex
+
+// Values of virtual sensors stored by this process, by gateway sensor, with the time span
+// of the write. The gateway publishes the tank again for each of them.
+var virtualWrites = make(map[string]virtualWrite)
+
+type virtualWrite struct {
+	from, to time.Time
+}
+
+// Difference allowed between the clock of the gateway and the one of the api
+const virtualWriteSlack = time.Second
+
+// Tanks with virtual sensors reading another tank through tank.<tankID>.<variable>, by the
+// tank they read. It is built from all the tanks when first needed and again after virtual
+// sensors change, rather than for each update.
+var virtualDependents map[string][]string
+var virtualDependentsLock sync.Mutex
+
+// referenceError is returned for variables that can never be resolved, unlike
+// sensors that have no value yet
+type referenceError struct {
+	message string
+}
+
+func (e referenceError) Error() string {
+	return e.message
+}
+
+func unknownVariable(name string) error {
+	return referenceError{fmt.Sprintf("unknown variable %s", name)}
+}
+
+// virtualScope resolves the variables of expressions. Each sensor read is recorded in the
+// inputs, a value is only stored again when its inputs have changed, so storing it does
+// not trigger another evaluation.
+type virtualScope struct {
+	tank     Tank
+	computed map[string]float64
+	prints   map[string]string
+	before   map[string]bool
+	others   map[string]Tank
+	nested   bool
+	inputs   []string
+}
+
+func newVirtualScope(tank Tank) *virtualScope {
+	return &virtualScope{
+		tank:     tank,
+		computed: make(map[string]float64),
+		prints:   make(map[string]string),
+		before:   make(map[string]bool),
+		others:   make(map[string]Tank),
+	}
+}
+
+// readSensor returns the current value of a sensor and records it as an input
+func (s *virtualScope) readSensor(sensor SensorData) (float64, error) {
+	value, ok := numericValue(sensor.Value)
+	if !ok {
+		return 0, fmt.Errorf("sensor %s has no value", sensor.Name)
+	}
+	at := ""
+	if sensor.Time != nil {
+		at = sensor.Time.Format(time.RFC3339Nano)
+	}
+	s.inputs = append(s.inputs, sensor.ID+"@"+at)
+	return value, nil
+}
+
+func (s *virtualScope) readSensorID(sensorID string) (float64, error) {
+	for _, sensor := range s.tank.Sensors {
+		if sensor.ID == sensorID {
+			return s.readSensor(sensor)
+		}
+	}
+	return 0, referenceError{fmt.Sprintf("sensor %s not found", sensorID)}
+}
+
+// lookup resolves a variable: the settings and level of the tank, a virtual sensor defined
+// before, a sensor by kind or slug, sensor_<sensorID>, or tank.<tankID>.<variable> of another tank
+func (s *virtualScope) lookup(name string) (float64, error) {
+	if strings.HasPrefix(name, "tank.") && !s.nested {
+		parts := strings.SplitN(strings.TrimPrefix(name, "tank."), ".", 2)
+		if len(parts) != 2 {
+			return 0, unknownVariable(name)
+		}
+		other, err := s.otherTank(parts[0])
+		if err != nil {
+			return 0, err
+		}
+		scope := newVirtualScope(other)
+		scope.nested = true
+		value, err := scope.lookup(parts[1])
+		s.inputs = append(s.inputs, scope.inputs...)
+		return value, err
+	}
+	if strings.Contains(name, ".") {
+		return 0, unknownVariable(name)
+	}
+
+	settings := s.tank.Meta.Settings
+	switch strings.ToLower(name) {
+	case "height":
+		s.inputs = append(s.inputs, fmt.Sprintf("height=%v", settings.Height))
+		return settings.Height, nil
+	case "offset":
+		s.inputs = append(s.inputs, fmt.Sprintf("offset=%v", settings.Offset))
+		return settings.Offset, nil
+	case "capacity":
+		s.inputs = append(s.inputs, fmt.Sprintf("capacity=%v", settings.Capacity))
+		return settings.Capacity, nil
+	case "distance", "liters", "percent":
+		sensor, ok := levelSensor(s.tank)
+		if !ok {
+			return 0, fmt.Errorf("no water level sensor")
+		}
+		distance, err := s.readSensor(sensor)
+		if err != nil {
+			return 0, err
+		}
+		s.inputs = append(s.inputs, fmt.Sprintf("settings=%v", settings))
+		// The temperature is an input of compensated liters, a missing one leaves them uncompensated
+		if thermometer, ok := compensationSensor(s.tank); ok {
+			s.readSensor(thermometer)
+		}
+		liters := currentLiters(s.tank, distance)
+		switch strings.ToLower(name) {
+		case "liters":
+			return liters, nil
+		case "percent":
+			if settings.Capacity <= 0 {
+				return 0, fmt.Errorf("the capacity of the tank is not set")
+			}
+			return liters / settings.Capacity * 100, nil
+		}
+		return distance, nil
+	}
+
+	if value, ok := s.computed[name]; ok {
+		s.inputs = append(s.inputs, s.prints[name])
+		return value, nil
+	}
+	for _, virtual := range s.tank.Meta.VirtualSensors {
+		if virtual.Key == name {
+			// Only physical sensors of other tanks are read, so that virtual sensors of two
+			// tanks cannot keep updating each other
+			if s.nested {
+				return 0, referenceError{fmt.Sprintf("%s is a virtual sensor of another tank", name)}
+			}
+			if !s.before[name] {
+				return 0, referenceError{fmt.Sprintf("%s is not available, a virtual sensor can only use the ones defined before it", name)}
+			}
+			return s.readSensorID(virtual.SensorID)
+		}
+	}
+
+	if strings.HasPrefix(name, "sensor_") {
+		return s.readSensorID(strings.TrimPrefix(name, "sensor_"))
+	}
+
+	if kind, ok := sensorKind(strings.ReplaceAll(name, "_", "-")); ok && kind.Kind != KindVirtual {
+		sensor, ok := findSensor(s.tank.Sensors, kind.Kind)
+		if !ok {
+			return 0, fmt.Errorf("no %s sensor", kind.Kind)
+		}
+		return s.readSensor(sensor)
+	}
+
+	return 0, unknownVariable(name)
+}
+
+func (s *virtualScope) otherTank(tankID string) (Tank, error) {
+	if tank, ok := s.others[tankID]; ok {
+		return tank, nil
+	}
+	tank, err := getTank(tankID)
+	if err != nil {
+		return tank, referenceError{fmt.Sprintf("tank %s not found", tankID)}
+	}
+	s.others[tankID] = tank
+	return tank, nil
+}
+
+// evaluate computes a virtual sensor and returns its value with the fingerprint of its inputs
+func (s *virtualScope) evaluate(virtual VirtualSensor) (float64, string, error) {
+	e, err := parseExpression(virtual.Expression)
+	if err != nil {
+		return 0, "", err
+	}
+
+	s.inputs = nil
+	value, err := e.evaluate(s.lookup)
+	if err != nil {
+		return 0, "", err
+	}
+
+	fingerprint := virtual.Expression + "|" + strings.Join(s.inputs, ",")
+	s.computed[virtual.Key] = value
+	s.prints[virtual.Key] = fingerprint
+	return value, fingerprint, nil
+}
+
+// evaluateVirtualSensors computes the virtual sensors of a tank in order and stores the values
+// whose inputs changed, alerts are not sent while the tank is in maintenance mode
+func evaluateVirtualSensors(tank Tank) {
+	scope := newVirtualScope(tank)
+	for _, virtual := range tank.Meta.VirtualSensors {
+		if virtual.Disabled || virtual.SensorID == "" {
+			continue
+		}
+
+		value, fingerprint, err := scope.evaluate(virtual)
+		if err != nil {
+			fmt.Println("Error evaluating virtual sensor", virtual.Key, ":", err)
+			continue
+		}
+
+		key := tank.ID + "/" + virtual.Key
+		virtualLock.Lock()
+		unchanged := virtualFingerprints[key] == fingerprint
+		virtualFingerprints[key] = fingerprint
+		virtualLock.Unlock()
+		if unchanged {
+			continue
+		}
+
+		from := time.Now()
+		if err = postSensorValue(tank.ID, virtual.SensorID, value); err != nil {
+			fmt.Println("Error storing virtual sensor value:", err)
+			virtualLock.Lock()
+			delete(virtualFingerprints, key)
+			virtualLock.Unlock()
+			continue
+		}
+		virtualLock.Lock()
+		virtualWrites[virtual.SensorID] = virtualWrite{from: from, to: time.Now()}
+		virtualLock.Unlock()
+
+		if !tank.Meta.MaintenanceMode.isActive(time.Now()) {
+			checkVirtualAlert(tank, virtual, value)
+		}
+	}
+}
+
+// virtualSensorUpdate tells whether the last change of a tank is a virtual sensor value
+// stored by this process, when the tank was evaluated for the change before it. Each write
+// is matched once, values stored by anything else are handled like any other reading.
+func virtualSensorUpdate(tank Tank) bool {
+	var latest *SensorData
+	for i, sensor := range tank.Sensors {
+		if sensor.Time != nil && (latest == nil || sensor.Time.After(*latest.Time)) {
+			latest = &tank.Sensors[i]
+		}
+	}
+	if latest == nil {
+		return false
+	}
+	for _, actuator := range tank.Actuators {
+		if actuator.Time != nil && actuator.Time.After(*latest.Time) {
+			return false
+		}
+	}
+
+	virtualLock.Lock()
+	defer virtualLock.Unlock()
+	write, ok := virtualWrites[latest.ID]
+	if !ok || latest.Time.Before(write.from.Add(-virtualWriteSlack)) || latest.Time.After(write.to.Add(virtualWriteSlack)) {
+		return false
+	}
+	delete(virtualWrites, latest.ID)
+	return true
+}
+
+// dependentTanks returns the IDs of the tanks with virtual sensors reading a tank
+func dependentTanks(tankID string) ([]string, error) {
+	virtualDependentsLock.Lock()
+	defer virtualDependentsLock.Unlock()
+
+	if virtualDependents == nil {
+		tanks, err := getTanks()
+		if err != nil {
+			return nil, err
+		}
+		dependents := make(map[string][]string)
+		for _, tank := range tanks {
+			read := make(map[string]bool)
+			for _, virtual := range tank.Meta.VirtualSensors {
+				if virtual.Disabled {
+					continue
+				}
+				e, err := parseExpression(virtual.Expression)
+				if err != nil {
+					continue
+				}
+				for _, name := range e.variables {
+					if !strings.HasPrefix(name, "tank.") {
+						continue
+					}
+					other := strings.SplitN(strings.TrimPrefix(name, "tank."), ".", 2)[0]
+					if other != tank.ID && !read[other] {
+						read[other] = true
+						dependents[other] = append(dependents[other], tank.ID)
+					}
+				}
+			}
+		}
+		virtualDependents = dependents
+	}
+	return virtualDependents[tankID], nil
+}
+
+// resetVirtualDependents drops the index of dependent tanks after virtual sensors changed
+func resetVirtualDependents() {
+	virtualDependentsLock.Lock()
+	virtualDependents = nil
+	virtualDependentsLock.Unlock()
+}
+
+// evaluateDependentVirtualSensors evaluates the virtual sensors of the other tanks that use
+// the readings of a tank through tank.<tankID>.<variable>
+func evaluateDependentVirtualSensors(tank Tank) {
+	dependents, err := dependentTanks(tank.ID)
+	if err != nil {
+		fmt.Println("Error retrieving tanks:", err)
+		return
+	}
+
+	for _, tankID := range dependents {
+		other, err := getTank(tankID)
+		if err != nil {
+			fmt.Println("Error retrieving tank:", err)
+			continue
+		}
+		evaluateVirtualSensors(other)
+	}
+}
+
+// checkVirtualAlert notifies when a virtual sensor crosses the critical limits of its gateway sensor
+func checkVirtualAlert(tank Tank, virtual VirtualSensor, value float64) {
+	var meta SensorMeta
+	for _, sensor := range tank.Sensors {
+		if sensor.ID == virtual.SensorID {
+			meta = sensor.Meta
+		}
+	}
+	outside := outsideLimits(value, meta)
+
+	key := tank.ID + "/" + virtual.Key
+	virtualLock.Lock()
+	alerted := virtualAlerted[key]
+	virtualAlerted[key] = outside
+	virtualLock.Unlock()
+
+	if !outside || alerted {
+		return
+	}
+
+	title := fmt.Sprintf("%s of %s is out of range", virtual.Name, tank.Name)
+	body := fmt.Sprintf("%s of %s is %.2f %s, outside the limits of %v to %v.",
+		virtual.Name, tank.Name, value, virtual.Unit, meta.CriticalMin, meta.CriticalMax)
+	notifyTank(tank, title, body, PriorityMedium)
+}
+
+// validateVirtualSensor checks the key and the expression of a virtual sensor placed at
+// position among the virtual sensors of the tank. Sensors without a value yet are accepted.
+func validateVirtualSensor(tank Tank, virtual VirtualSensor, position int) error {
+	if virtual.Key == "" || !isIdentifierStart(virtual.Key[0]) || strings.Contains(virtual.Key, ".") {
+		return fmt.Errorf("key must start with a letter and use only letters, digits and _")
+	}
+	for i := 1; i < len(virtual.Key); i++ {
+		if !isIdentifierPart(virtual.Key[i]) {
+			return fmt.Errorf("key must start with a letter and use only letters, digits and _")
+		}
+	}
+	for _, reserved := range virtualSettings {
+		if strings.EqualFold(virtual.Key, reserved) {
+			return fmt.Errorf("%s is reserved", virtual.Key)
+		}
+	}
+	if _, ok := sensorKind(strings.ReplaceAll(virtual.Key, "_", "-")); ok || strings.HasPrefix(virtual.Key, "sensor_") || virtual.Key == "evaluate" {
+		return fmt.Errorf("%s is reserved", virtual.Key)
+	}
+
+	e, err := parseExpression(virtual.Expression)
+	if err != nil {
+		return err
+	}
+
+	scope := newVirtualScope(tank)
+	for i, other := range tank.Meta.VirtualSensors {
+		if i < position {
+			scope.before[other.Key] = true
+		}
+	}
+	for _, name := range e.variables {
+		if name == virtual.Key {
+			return fmt.Errorf("%s cannot use itself", virtual.Key)
+		}
+		if _, err := scope.lookup(name); err != nil {
+			if _, ok := err.(referenceError); ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeVirtualSensor reads a virtual sensor from the request body
+func decodeVirtualSensor(w http.ResponseWriter, r *http.Request) (VirtualSensor, bool) {
+	var virtual VirtualSensor
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fmt.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return virtual, false
+	}
+	if err = json.Unmarshal(body, &virtual); err != nil {
+		fmt.Println("Error unmarshaling virtual sensor:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return virtual, false
+	}
+	return virtual, true
+}
+
+// GetVirtualSensorsHandler lists the virtual sensors of a tank with their current value
+func GetVirtualSensorsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tank, err := getTank(vars["tankID"])
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	statuses := []VirtualSensorStatus{}
+	for _, virtual := range tank.Meta.VirtualSensors {
+		status := VirtualSensorStatus{VirtualSensor: virtual}
+		for _, sensor := range tank.Sensors {
+			if sensor.ID == virtual.SensorID {
+				status.Value = sensor.Value
+				status.Time = sensor.Time
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	log.Printf("[%s] Fetched virtual sensors: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, statuses)
+}
+
+// PostVirtualSensorHandler adds a virtual sensor to a tank and creates the gateway sensor storing its values
+func PostVirtualSensorHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tank, err := getTank(vars["tankID"])
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	virtual, ok := decodeVirtualSensor(w, r)
+	if !ok {
+		return
+	}
+	if virtual.Name == "" {
+		virtual.Name = virtual.Key
+	}
+	for _, other := range tank.Meta.VirtualSensors {
+		if other.Key == virtual.Key {
+			http.Error(w, fmt.Sprintf("a virtual sensor %s already exists", virtual.Key), http.StatusConflict)
+			return
+		}
+	}
+	if err = validateVirtualSensor(tank, virtual, len(tank.Meta.VirtualSensors)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	virtual.SensorID, err = createSensor(tank.ID, virtual.Name, map[string]interface{}{
+		"kind":  KindVirtual,
+		"units": virtual.Unit,
+	})
+	if err != nil {
+		fmt.Println("Error creating virtual sensor:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tank.Meta.VirtualSensors = append(tank.Meta.VirtualSensors, virtual)
+	if err = postTankMeta(tank.ID, map[string]interface{}{"virtualSensors": tank.Meta.VirtualSensors}); err != nil {
+		fmt.Println("Error storing virtual sensors:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resetVirtualDependents()
+
+	// The first value is stored right away rather than at the next update of the tank
+	evaluateVirtualSensors(tank)
+
+	log.Printf("[%s] Virtual sensor added: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, virtual)
+}
+
+// UpdateVirtualSensorHandler changes the expression, unit or disabled state of a virtual sensor
+func UpdateVirtualSensorHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tank, err := getTank(vars["tankID"])
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	update, ok := decodeVirtualSensor(w, r)
+	if !ok {
+		return
+	}
+
+	position := -1
+	for i, virtual := range tank.Meta.VirtualSensors {
+		if virtual.Key == vars["key"] {
+			position = i
+		}
+	}
+	if position < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	virtual := tank.Meta.VirtualSensors[position]
+	if update.Expression != "" {
+		virtual.Expression = update.Expression
+	}
+	if update.Unit != "" && update.Unit != virtual.Unit {
+		virtual.Unit = update.Unit
+		if err = postSensorMeta(tank.ID, virtual.SensorID, map[string]interface{}{"units": virtual.Unit}); err != nil {
+			fmt.Println("Error updating sensor meta:", err)
+		}
+	}
+	virtual.Disabled = update.Disabled
+
+	if err = validateVirtualSensor(tank, virtual, position); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tank.Meta.VirtualSensors[position] = virtual
+	if err = postTankMeta(tank.ID, map[string]interface{}{"virtualSensors": tank.Meta.VirtualSensors}); err != nil {
+		fmt.Println("Error storing virtual sensors:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resetVirtualDependents()
+
+	evaluateVirtualSensors(tank)
+
+	log.Printf("[%s] Virtual sensor updated: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, virtual)
+}
+
+// DeleteVirtualSensorHandler removes a virtual sensor and its history, unless others use it
+func DeleteVirtualSensorHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	tank, err := getTank(vars["tankID"])
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	remaining := []VirtualSensor{}
+	var removed *VirtualSensor
+	for i, virtual := range tank.Meta.VirtualSensors {
+		if virtual.Key == key {
+			removed = &tank.Meta.VirtualSensors[i]
+			continue
+		}
+		if e, err := parseExpression(virtual.Expression); err == nil {
+			for _, name := range e.variables {
+				if name == key {
+					http.Error(w, fmt.Sprintf("%s is used by %s", key, virtual.Key), http.StatusConflict)
+					return
+				}
+			}
+		}
+		remaining = append(remaining, virtual)
+	}
+	if removed == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if removed.SensorID != "" {
+		if err = deleteSensor(tank.ID, removed.SensorID); err != nil {
+			fmt.Println("Error deleting virtual sensor:", err)
+		}
+	}
+
+	if err = postTankMeta(tank.ID, map[string]interface{}{"virtualSensors": remaining}); err != nil {
+		fmt.Println("Error storing virtual sensors:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resetVirtualDependents()
+
+	virtualLock.Lock()
+	delete(virtualFingerprints, tank.ID+"/"+key)
+	delete(virtualAlerted, tank.ID+"/"+key)
+	delete(virtualWrites, removed.SensorID)
+	virtualLock.Unlock()
+
+	log.Printf("[%s] Virtual sensor deleted: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]string{
+		"message": "Virtual sensor deleted",
+	})
+}
+
+// EvaluateExpressionHandler computes an expression against the current values of a tank
+// without storing it, to try an expression before saving a virtual sensor
+func EvaluateExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tank, err := getTank(vars["tankID"])
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	virtual, ok := decodeVirtualSensor(w, r)
+	if !ok {
+		return
+	}
+
+	scope := newVirtualScope(tank)
+	for _, other := range tank.Meta.VirtualSensors {
+		scope.before[other.Key] = true
+	}
+	virtual.Key = "_"
+	value, _, err := scope.evaluate(virtual)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[%s] Evaluated expression: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]interface{}{
+		"expression": virtual.Expression,
+		"value":      value,
+	})
+}
@@ -0,0 +1,357 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Water quality sensor kinds, TDS probes keep the kind the app always used
+const (
+	KindTDS          = "WaterPollutantSensor"
+	KindPH           = "PHSensor"
+	KindTurbidity    = "TurbiditySensor"
+	KindChlorine     = "ChlorineSensor"
+	KindORP          = "ORPSensor"
+	KindConductivity = "ConductivitySensor"
+)
+
+// Days of water quality index history returned when no range is given
+const defaultQualityIndexDays = 7
+
+// QualityLimit holds the guideline range of a parameter. The sub-index is 100 inside
+// Min and Max and falls to 0 at ZeroMin below and ZeroMax above. A zero Min or Max
+// leaves that side unbounded.
+type QualityLimit struct {
+	Min     float64 `json:"min" bson:"min"`
+	Max     float64 `json:"max" bson:"max"`
+	ZeroMin float64 `json:"zeroMin" bson:"zeroMin"`
+	ZeroMax float64 `json:"zeroMax" bson:"zeroMax"`
+}
+
+// QualityParameter describes a water quality sensor kind, readings outside the
+// valid range come from a faulty or dry probe and are left out of the index
+type QualityParameter struct {
+	Kind      string       `json:"kind"`
+	Name      string       `json:"name"`
+	Unit      string       `json:"unit"`
+	ValidMin  float64      `json:"validMin"`
+	ValidMax  float64      `json:"validMax"`
+	Guideline QualityLimit `json:"guideline"`
+}
+
+// Recognized water quality parameters with WHO guideline values for drinking water
+var qualityParameters = []QualityParameter{
+	{
+		// TDS probes read 0 out of the water
+		Kind: KindTDS, Name: "Total dissolved solids", Unit: "ppm",
+		ValidMin: 1, ValidMax: 10000,
+		Guideline: QualityLimit{Max: 900, ZeroMax: 2000},
+	},
+	{
+		Kind: KindPH, Name: "pH", Unit: "pH",
+		ValidMin: 0, ValidMax: 14,
+		Guideline: QualityLimit{Min: 6.5, Max: 8.5, ZeroMin: 4.5, ZeroMax: 10.5},
+	},
+	{
+		Kind: KindTurbidity, Name: "Turbidity", Unit: "NTU",
+		ValidMin: 0, ValidMax: 4000,
+		Guideline: QualityLimit{Max: 5, ZeroMax: 50},
+	},
+	{
+		// A residual of at least 0.2 mg/L protects stored water, above 5 mg/L it is not palatable
+		Kind: KindChlorine, Name: "Free chlorine", Unit: "mg/L",
+		ValidMin: 0, ValidMax: 20,
+		Guideline: QualityLimit{Min: 0.2, Max: 5, ZeroMin: 0, ZeroMax: 10},
+	},
+	{
+		// 650 mV and above is taken as effective disinfection
+		Kind: KindORP, Name: "Oxidation reduction potential", Unit: "mV",
+		ValidMin: -1000, ValidMax: 1500,
+		Guideline: QualityLimit{Min: 650, ZeroMin: 300},
+	},
+	{
+		// Conductivity probes read 0 out of the water
+		Kind: KindConductivity, Name: "Conductivity", Unit: "µS/cm",
+		ValidMin: 1, ValidMax: 20000,
+		Guideline: QualityLimit{Max: 1500, ZeroMax: 4000},
+	},
+}
+
+// ParameterReading is the reading of one parameter with its sub-index
+type ParameterReading struct {
+	Kind   string       `json:"kind"`
+	Name   string       `json:"name"`
+	Unit   string       `json:"unit"`
+	Value  float64      `json:"value"`
+	Valid  bool         `json:"valid"`
+	Within bool         `json:"within"`
+	Index  float64      `json:"index"`
+	Limit  QualityLimit `json:"limit"`
+}
+
+// QualityIndex combines the parameters of a tank, the index is the one of the
+// worst parameter so a single failing parameter cannot be averaged away
+type QualityIndex struct {
+	Time         *time.Time         `json:"time"`
+	Index        float64            `json:"index"`
+	Category     string             `json:"category"`
+	Limiting     string             `json:"limiting"`
+	LimitingName string             `json:"limitingName"`
+	Parameters   []ParameterReading `json:"parameters"`
+}
+
+// qualityParameter returns the recognized parameter of a sensor kind
+func qualityParameter(kind string) (QualityParameter, bool) {
+	for _, parameter := range qualityParameters {
+		if parameter.Kind == kind {
+			return parameter, true
+		}
+	}
+	return QualityParameter{}, false
+}
+
+// limit returns the guideline of the parameter, overridden by the limits of the tank. The
+// TDS limit follows the quality profile of the tank.
+func (p QualityParameter) limit(tank Tank) QualityLimit {
+	if limit, ok := tank.Meta.QualityLimits[p.Kind]; ok {
+		return limit
+	}
+	if p.Kind == KindTDS {
+		return tankQualityProfile(tank).tdsLimit(p.Guideline)
+	}
+	return p.Guideline
+}
+
+// valid tells whether a reading is within the range of the probe
+func (p QualityParameter) valid(value float64) bool {
+	return value >= p.ValidMin && value <= p.ValidMax && !math.IsNaN(value)
+}
+
+// subIndex scores a value from 100 inside the limit down to 0 at the zero points
+func (l QualityLimit) subIndex(value float64) float64 {
+	score := 100.0
+	if l.Min > 0 && value < l.Min {
+		score = 0
+		if l.ZeroMin < l.Min {
+			score = 100 * (value - l.ZeroMin) / (l.Min - l.ZeroMin)
+		}
+	} else if l.Max > 0 && value > l.Max {
+		zero := l.ZeroMax
+		if zero <= l.Max {
+			zero = 2 * l.Max
+		}
+		score = 100 * (zero - value) / (zero - l.Max)
+	}
+	return math.Round(math.Max(0, math.Min(100, score))*10) / 10
+}
+
+func qualityCategory(index float64) string {
+	switch {
+	case index >= 90:
+		return "Excellent"
+	case index >= 70:
+		return "Good"
+	case index >= 50:
+		return "Fair"
+	case index >= 25:
+		return "Poor"
+	}
+	return "Very poor"
+}
+
+// readParameter validates and scores a reading of a parameter against its limit
+func readParameter(parameter QualityParameter, limit QualityLimit, value float64) ParameterReading {
+	reading := ParameterReading{
+		Kind:  parameter.Kind,
+		Name:  parameter.Name,
+		Unit:  parameter.Unit,
+		Value: value,
+		Valid: parameter.valid(value),
+		Limit: limit,
+	}
+	if reading.Valid {
+		reading.Index = limit.subIndex(value)
+		reading.Within = reading.Index >= 100
+	}
+	return reading
+}
+
+// combineReadings builds the index from the valid readings, nil when there are none
+func combineReadings(readings []ParameterReading) *QualityIndex {
+	index := QualityIndex{Index: 100, Parameters: readings}
+	found := false
+	for _, reading := range readings {
+		if !reading.Valid {
+			continue
+		}
+		if !found || reading.Index < index.Index {
+			index.Index = reading.Index
+			index.Limiting = reading.Kind
+			index.LimitingName = reading.Name
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	index.Category = qualityCategory(index.Index)
+	return &index
+}
+
+// getQualityIndex returns the water quality index of the latest readings of a tank,
+// nil when the tank has no water quality sensors with a valid reading
+func getQualityIndex(tank Tank) *QualityIndex {
+	readings := []ParameterReading{}
+	var latest *time.Time
+	for _, sensor := range tank.Sensors {
+		parameter, ok := qualityParameter(sensor.Meta.Kind)
+		if !ok {
+			continue
+		}
+		value, ok := numericValue(sensor.Value)
+		if !ok {
+			continue
+		}
+		readings = append(readings, readParameter(parameter, parameter.limit(tank), value))
+		if sensor.Time != nil && (latest == nil || sensor.Time.After(*latest)) {
+			latest = sensor.Time
+		}
+	}
+
+	index := combineReadings(readings)
+	if index != nil {
+		index.Time = latest
+	}
+	return index
+}
+
+// getQualityIndexHistory averages each parameter over the intervals and computes the index of
+// each interval, a parameter without readings in an interval keeps its previous value
+func getQualityIndexHistory(tank Tank, from string, to string, options DownsampleOptions, loc *time.Location) ([]QualityIndex, error) {
+	series := make(map[time.Time]map[string]float64)
+	parameters := []QualityParameter{}
+	limits := make(map[string]QualityLimit)
+	for _, sensor := range tank.Sensors {
+		parameter, ok := qualityParameter(sensor.Meta.Kind)
+		if !ok {
+			continue
+		}
+		values, err := getSensorValues(tank.ID, sensor.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		history := []HistoryPoint{}
+		for _, point := range sensorHistoryPoints(values) {
+			if parameter.valid(point.Value) {
+				history = append(history, point)
+			}
+		}
+		if len(history) == 0 {
+			continue
+		}
+		parameters = append(parameters, parameter)
+		limits[parameter.Kind] = parameter.limit(tank)
+
+		// Even a short history is bucketed so the parameters line up in time
+		if len(history) < 3 {
+			history = append(history, history[len(history)-1])
+		}
+		for _, point := range downsample(history, options, loc) {
+			if series[point.Time] == nil {
+				series[point.Time] = make(map[string]float64)
+			}
+			series[point.Time][parameter.Kind] = point.Value
+		}
+	}
+
+	times := []time.Time{}
+	for t := range series {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+
+	indexes := []QualityIndex{}
+	last := make(map[string]float64)
+	for _, t := range times {
+		for kind, value := range series[t] {
+			last[kind] = value
+		}
+		readings := []ParameterReading{}
+		for _, parameter := range parameters {
+			if value, ok := last[parameter.Kind]; ok {
+				readings = append(readings, readParameter(parameter, limits[parameter.Kind], value))
+			}
+		}
+		if index := combineReadings(readings); index != nil {
+			at := t
+			index.Time = &at
+			indexes = append(indexes, *index)
+		}
+	}
+	return indexes, nil
+}
+
+// GetQualityParametersHandler lists the recognized water quality sensor kinds
+func GetQualityParametersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[%s] Fetched water quality parameters: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, qualityParameters)
+}
+
+// GetQualityIndexHandler returns the water quality index of a tank, the latest one
+// and a series over the requested range
+func GetQualityIndexHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tankID := vars["tankID"]
+
+	tank, err := getTank(tankID)
+	if err != nil {
+		fmt.Println("Error retrieving tank:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Hourly averages unless another interval is requested
+	options := DownsampleOptions{Agg: AggAvg, Interval: time.Hour}
+	if interval := r.URL.Query().Get("interval"); interval != "" {
+		if validInterval(interval) {
+			options.Interval = 0
+			options.Calendar = interval
+		} else {
+			duration, err := time.ParseDuration(interval)
+			if err != nil || duration <= 0 {
+				http.Error(w, "invalid interval", http.StatusBadRequest)
+				return
+			}
+			options.Interval = duration
+		}
+	}
+
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = time.Now().AddDate(0, 0, -defaultQualityIndexDays).Format(time.RFC3339)
+	}
+
+	history, err := getQualityIndexHistory(tank, from, r.URL.Query().Get("to"), options, tankLocation(tank))
+	if err != nil {
+		fmt.Println("Error computing water quality index:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[%s] Fetched water quality index: %s %s", time.Now().Format(time.RFC3339), r.Method, r.URL.Path)
+
+	writeJSON(w, map[string]interface{}{
+		"current": getQualityIndex(tank),
+		"history": history,
+	})
+}
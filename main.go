@@ -619,87 +619,18 @@ func updateTankMessages(tankID string, newMessage Message) {
 // }
 
 
-func checkValForNotifcation(tankID string) {
-
-	// Send a GET request to localhost/devices/tankID
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/devices/%s", tankID), nil)
-	if err != nil {
-		fmt.Println("Error creating request:", err)
-		return
-	}
-
-	// Set the Content-Type and Accept headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-
-	// Send the request
-	client := http.DefaultClient
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error sending request:", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		return
-	}
-
-	// Unmarshal the JSON data into a Tank struct
-	var tank Tank
-	err = json.Unmarshal(body, &tank)
-	if err != nil {
-		fmt.Println("Error unmarshaling tank:", err)
-		return
-	}
-
-	liters := 0.0
-
-	tankHeight := tank.Meta.Settings.Height
-	tankOffset := tank.Meta.Settings.Offset
-	tankCapacity := tank.Meta.Settings.Capacity
-
-	var val float64
-	var lowerLimit, upperLimit float64
-	found := false
-	
-	for _, sensor := range tank.Sensors {
-		if sensor.Meta.Kind == "WaterLevel" {
-			// Get value
-			switch v := sensor.Value.(type) {
-			case float64:
-				val = v
-			case int:
-				val = float64(v)
-			case json.Number:
-				val, _ = v.Float64()
-			default:
-				fmt.Println("Unsupported sensor value type")
-				return
-			}
-	
-			// Capture sensor ID and critical limits
-			lowerLimit = sensor.Meta.CriticalMin
-			upperLimit = sensor.Meta.CriticalMax
-	
-			found = true
-			break
-		}
-	}
+func checkValForNotifcation(tank api.Tank) {
 
+	// The level is compensated for the temperature like everywhere else in the api
+	level, found := api.TankLevel(tank)
 	if !found {
 		fmt.Println("WaterLevel sensor not found")
 		return
 	}
 
-	calculatedValue := ((tankHeight - (val - tankOffset)) / tankHeight) * tankCapacity
-	
-	liters = float64(calculatedValue)
-
-	percentage := (liters/tankCapacity)*100
+	lowerLimit := level.CriticalMin
+	upperLimit := level.CriticalMax
+	percentage := level.Percent
 
 	date := time.Now().Add(3*time.Hour).Format("2006-01-02 15:04:05")
 
@@ -847,7 +778,21 @@ var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Me
 
 	if len(matches) >= 2 {
 		deviceID := matches[1]
-		checkValForNotifcation(deviceID)
+		// The tank is fetched once for the level alerts and the checks of the api
+		tank, err := api.GetTank(deviceID)
+		if err != nil {
+			fmt.Println("Error retrieving tank:", err)
+			return
+		}
+		// Storing a virtual sensor value publishes the tank again, its inputs did not change
+		// and the checks already ran for the reading it was computed from
+		if api.VirtualSensorUpdate(tank) {
+			return
+		}
+		if !api.TankInMaintenance(tank) {
+			checkValForNotifcation(tank)
+		}
+		api.HandleTankUpdate(tank)
 	} else {
 		fmt.Println("No match for topic")
 	}
@@ -1018,6 +963,9 @@ func main() {
 
 	// Start MQTT connection in a separate goroutine
 
+	// Dosers left running by a restart are switched off before new refills are dosed
+	api.StopDosers()
+
 	topics := getMqttTopics()
 
 	fmt.Println(topics)